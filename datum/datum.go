@@ -0,0 +1,87 @@
+// Package datum reads fields from device data decoded from the database into generic maps
+package datum
+
+import (
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// MgdLPerMmolL converts blood glucose from mmol/L to mg/dL, with the same factor as the platform
+	MgdLPerMmolL = 18.01559
+
+	// UnitsMgdL is mg/dL
+	UnitsMgdL = "mg/dL"
+	// UnitsMmolL is mmol/L, the units in which blood glucose is stored
+	UnitsMmolL = "mmol/L"
+)
+
+// Lookup returns the value of the field at the "." separated path, or nil if it doesn't exist
+func Lookup(datum map[string]interface{}, path string) interface{} {
+	var value interface{} = datum
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if value, ok = object[key]; !ok {
+			return nil
+		}
+	}
+	return value
+}
+
+// Float returns the value as a float64, if it is a number
+func Float(value interface{}) (float64, bool) {
+	switch typed := value.(type) {
+	case float64:
+		return typed, true
+	case int32:
+		return float64(typed), true
+	case int64:
+		return float64(typed), true
+	case int:
+		return float64(typed), true
+	}
+	return 0, false
+}
+
+// Time returns the datum's `time` in UTC
+func Time(datum map[string]interface{}) (time.Time, bool) {
+	switch typed := datum["time"].(type) {
+	case primitive.DateTime:
+		return typed.Time().UTC(), true
+	case time.Time:
+		return typed.UTC(), true
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, typed)
+		return parsed.UTC(), err == nil
+	}
+	return time.Time{}, false
+}
+
+// BloodGlucoseMgdL returns the blood glucose value of the field in mg/dL, converted according to the
+// datum's `units`
+func BloodGlucoseMgdL(datum map[string]interface{}, field string) (float64, bool) {
+	value, ok := Float(datum[field])
+	if !ok {
+		return 0, false
+	}
+	switch datum["units"] {
+	case "mmol/L", "mmol/l":
+		return value * MgdLPerMmolL, true
+	case "mg/dL", "mg/dl":
+		return value, true
+	}
+	return 0, false
+}
+
+// BloodGlucoseInUnits converts the mg/dL value to the units, which are UnitsMgdL or UnitsMmolL
+func BloodGlucoseInUnits(mgdL float64, units string) float64 {
+	if units == UnitsMmolL {
+		return mgdL / MgdLPerMmolL
+	}
+	return mgdL
+}
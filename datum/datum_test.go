@@ -0,0 +1,76 @@
+package datum_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/tidepool-org/tide-whisperer/datum"
+)
+
+func Test_Lookup(t *testing.T) {
+	d := map[string]interface{}{
+		"nutrition": map[string]interface{}{"carbohydrate": map[string]interface{}{"net": 30.0}},
+		"value":     5.5,
+	}
+
+	if value := datum.Lookup(d, "nutrition.carbohydrate.net"); value != 30.0 {
+		t.Errorf("Lookup returned %v for nested path", value)
+	}
+	if value := datum.Lookup(d, "value"); value != 5.5 {
+		t.Errorf("Lookup returned %v for top level path", value)
+	}
+	if value := datum.Lookup(d, "value.units"); value != nil {
+		t.Errorf("Lookup returned %v for path below a value", value)
+	}
+	if value := datum.Lookup(d, "nutrition.fat"); value != nil {
+		t.Errorf("Lookup returned %v for missing path", value)
+	}
+}
+
+func Test_Float(t *testing.T) {
+	for _, value := range []interface{}{int32(3), int64(3), 3, 3.0} {
+		if f, ok := datum.Float(value); !ok || f != 3 {
+			t.Errorf("Float returned %v, %v for %T", f, ok, value)
+		}
+	}
+	if _, ok := datum.Float("3"); ok {
+		t.Error("Float fails to reject string")
+	}
+}
+
+func Test_Time(t *testing.T) {
+	expected, _ := time.Parse(time.RFC3339, "2019-03-15T01:24:28Z")
+
+	for _, value := range []interface{}{primitive.NewDateTimeFromTime(expected), expected, "2019-03-15T01:24:28Z"} {
+		if parsed, ok := datum.Time(map[string]interface{}{"time": value}); !ok || !parsed.Equal(expected) {
+			t.Errorf("Time returned %v, %v for %T", parsed, ok, value)
+		}
+	}
+	if _, ok := datum.Time(map[string]interface{}{}); ok {
+		t.Error("Time fails to reject missing time")
+	}
+}
+
+func Test_BloodGlucoseMgdL(t *testing.T) {
+	if value, ok := datum.BloodGlucoseMgdL(map[string]interface{}{"value": 10.0, "units": "mmol/L"}, "value"); !ok || value != 180.1559 {
+		t.Errorf("BloodGlucoseMgdL returned %v, %v for mmol/L", value, ok)
+	}
+	if value, ok := datum.BloodGlucoseMgdL(map[string]interface{}{"bgInput": int32(120), "units": "mg/dL"}, "bgInput"); !ok || value != 120 {
+		t.Errorf("BloodGlucoseMgdL returned %v, %v for mg/dL", value, ok)
+	}
+	if _, ok := datum.BloodGlucoseMgdL(map[string]interface{}{"value": 10.0}, "value"); ok {
+		t.Error("BloodGlucoseMgdL fails to reject missing units")
+	}
+}
+
+func Test_BloodGlucoseInUnits(t *testing.T) {
+	if value := datum.BloodGlucoseInUnits(180.1559, datum.UnitsMmolL); math.Abs(value-10) > 1e-9 {
+		t.Errorf("BloodGlucoseInUnits returned %v for mmol/L", value)
+	}
+	if value := datum.BloodGlucoseInUnits(180, datum.UnitsMgdL); value != 180 {
+		t.Errorf("BloodGlucoseInUnits returned %v for mg/dL", value)
+	}
+}
@@ -0,0 +1,269 @@
+package export
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/tidepool-org/tide-whisperer/datum"
+)
+
+// RangeIndexColumn is the column of the index of the date range that includes each datum, written
+// after the type specific columns when the data is read with date ranges
+const RangeIndexColumn = "rangeIndex"
+
+// commonColumns are written for every type, ahead of the type specific columns
+var commonColumns = []string{"time", "type", "subType", "deviceTime", "timezoneOffset", "deviceId", "uploadId", "id"}
+
+// typeColumns are the columns written for each type. Nested fields are separated by ".".
+var typeColumns = map[string][]string{
+	"basal":            {"deliveryType", "rate", "percent", "duration", "expectedDuration", "scheduleName"},
+	"bloodKetone":      {"value", "units"},
+	"bolus":            {"normal", "expectedNormal", "extended", "expectedExtended", "duration", "expectedDuration"},
+	"cbg":              {"value", "units", "sampleInterval"},
+	"cgmSettings":      {"manufacturers", "model", "serialNumber", "units", "transmitterId"},
+	"deviceEvent":      {"reason", "status", "alarmType", "primeTarget", "volume", "units", "duration"},
+	"dosingDecision":   {"reason", "units"},
+	"food":             {"name", "nutrition.carbohydrate.net", "nutrition.carbohydrate.units"},
+	"insulin":          {"dose.total", "dose.units", "formulation.name"},
+	"physicalActivity": {"name", "duration.value", "duration.units", "distance.value", "distance.units", "energy.value", "energy.units"},
+	"pumpSettings":     {"manufacturers", "model", "serialNumber", "activeSchedule", "units.carb", "units.bg"},
+	"reportedState":    {"states"},
+	"smbg":             {"value", "units", "subType"},
+	"upload":           {"deviceManufacturers", "deviceModel", "deviceSerialNumber", "dataSetType", "client.name", "client.version"},
+	"water":            {"amount.value", "amount.units"},
+	"wizard":           {"carbInput", "insulinCarbRatio", "insulinSensitivity", "insulinOnBoard", "bgInput", "units", "recommended.carb", "recommended.correction", "recommended.net"},
+}
+
+type (
+	// csvWriter writes the data as a single CSV file. The columns are the union of the columns of
+	// the requested types, so that every row has the same layout.
+	csvWriter struct {
+		w       *csv.Writer
+		columns []string
+		started bool
+	}
+
+	// csvZipWriter writes the data as a ZIP archive with one CSV file per type. The files are
+	// written to temporary files until Close, as the data is not read in type order, so that large
+	// exports aren't held in memory.
+	csvZipWriter struct {
+		w          io.Writer
+		rangeIndex bool
+		files      map[string]*os.File
+		writers    map[string]*csvWriter
+	}
+)
+
+// CSVColumns returns the columns of a CSV file holding the types. All known types are included if
+// types is empty.
+func CSVColumns(types []string) []string {
+	if len(types) == 0 || (len(types) == 1 && types[0] == "") {
+		types = make([]string, 0, len(typeColumns))
+		for typ := range typeColumns {
+			types = append(types, typ)
+		}
+		sort.Strings(types)
+	}
+
+	columns := append([]string{}, commonColumns...)
+	for _, typ := range types {
+		for _, column := range typeColumns[typ] {
+			if !containsString(columns, column) {
+				columns = append(columns, column)
+			}
+		}
+	}
+	return columns
+}
+
+// csvColumns returns the CSVColumns of the types, followed by the RangeIndexColumn if rangeIndex is set
+func csvColumns(types []string, rangeIndex bool) []string {
+	columns := CSVColumns(types)
+	if rangeIndex {
+		columns = append(columns, RangeIndexColumn)
+	}
+	return columns
+}
+
+func newCSVWriter(w io.Writer, columns []string) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(w), columns: columns}
+}
+
+func (c *csvWriter) ContentType() string {
+	return "text/csv"
+}
+
+func (c *csvWriter) WriteDatum(d map[string]interface{}) error {
+	if err := c.start(); err != nil {
+		return err
+	}
+
+	row := make([]string, len(c.columns))
+	for idx, column := range c.columns {
+		value, err := csvValue(datum.Lookup(d, column))
+		if err != nil {
+			return err
+		}
+		row[idx] = value
+	}
+	return c.w.Write(row)
+}
+
+func (c *csvWriter) Close() error {
+	if err := c.start(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) start() error {
+	if c.started {
+		return nil
+	}
+	c.started = true
+	return c.w.Write(c.columns)
+}
+
+func newCSVZipWriter(w io.Writer, rangeIndex bool) *csvZipWriter {
+	return &csvZipWriter{
+		w:          w,
+		rangeIndex: rangeIndex,
+		files:      map[string]*os.File{},
+		writers:    map[string]*csvWriter{},
+	}
+}
+
+func (c *csvZipWriter) ContentType() string {
+	return "application/zip"
+}
+
+func (c *csvZipWriter) WriteDatum(d map[string]interface{}) error {
+	typ, _ := d["type"].(string)
+	if typ == "" {
+		typ = "unknown"
+	}
+
+	writer, ok := c.writers[typ]
+	if !ok {
+		file, err := os.CreateTemp("", "tide-whisperer-*.csv")
+		if err != nil {
+			return err
+		}
+		writer = newCSVWriter(file, csvColumns([]string{typ}, c.rangeIndex))
+		c.files[typ] = file
+		c.writers[typ] = writer
+	}
+	return writer.WriteDatum(d)
+}
+
+// Close writes the archive, and removes the temporary files
+func (c *csvZipWriter) Close() error {
+	defer c.removeFiles()
+
+	types := make([]string, 0, len(c.writers))
+	for typ := range c.writers {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	archive := zip.NewWriter(c.w)
+	for _, typ := range types {
+		if err := c.writers[typ].Close(); err != nil {
+			return err
+		}
+		if _, err := c.files[typ].Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		file, err := archive.Create(typ + ".csv")
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(file, c.files[typ]); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func (c *csvZipWriter) removeFiles() {
+	for _, file := range c.files {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	c.files = map[string]*os.File{}
+}
+
+// csvValue formats a value decoded from the database as a CSV field
+func csvValue(value interface{}) (string, error) {
+	switch typed := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return csvString(typed), nil
+	case bool:
+		return strconv.FormatBool(typed), nil
+	case int32:
+		return strconv.FormatInt(int64(typed), 10), nil
+	case int64:
+		return strconv.FormatInt(typed, 10), nil
+	case int:
+		return strconv.Itoa(typed), nil
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64), nil
+	case primitive.DateTime:
+		return typed.Time().UTC().Format(time.RFC3339Nano), nil
+	case time.Time:
+		return typed.UTC().Format(time.RFC3339Nano), nil
+	case primitive.A:
+		return csvList(typed)
+	case []interface{}:
+		return csvList(typed)
+	}
+
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("unable to format %T as csv: %w", value, err)
+	}
+	return string(bytes), nil
+}
+
+// csvString escapes strings that spreadsheets would evaluate as formulas, by prefixing them with "'"
+func csvString(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// csvList formats a list of values as a single field with the values separated by ";"
+func csvList(values []interface{}) (string, error) {
+	fields := make([]string, len(values))
+	for idx, value := range values {
+		field, err := csvValue(value)
+		if err != nil {
+			return "", err
+		}
+		fields[idx] = field
+	}
+	return strings.Join(fields, ";"), nil
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, x := range haystack {
+		if x == needle {
+			return true
+		}
+	}
+	return false
+}
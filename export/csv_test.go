@@ -0,0 +1,143 @@
+package export_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/tidepool-org/tide-whisperer/export"
+)
+
+func testCSVData() []map[string]interface{} {
+	cbgTime, _ := time.Parse(time.RFC3339, "2019-03-15T01:24:28Z")
+	foodTime, _ := time.Parse(time.RFC3339, "2019-03-15T02:00:00.5Z")
+	return []map[string]interface{}{
+		{"time": primitive.NewDateTimeFromTime(cbgTime), "type": "cbg", "value": 5.5, "units": "mmol/L", "uploadId": "upload1"},
+		{"time": primitive.NewDateTimeFromTime(foodTime), "type": "food", "nutrition": map[string]interface{}{
+			"carbohydrate": map[string]interface{}{"net": int32(30), "units": "grams"},
+		}},
+	}
+}
+
+func Test_CSVColumns(t *testing.T) {
+	columns := export.CSVColumns([]string{"cbg", "smbg"})
+
+	expected := []string{"time", "type", "subType", "deviceTime", "timezoneOffset", "deviceId", "uploadId", "id", "value", "units", "sampleInterval"}
+	if !reflect.DeepEqual(columns, expected) {
+		t.Errorf("CSVColumns returned %v, expected %v", columns, expected)
+	}
+}
+
+func Test_CSVColumns_AllTypes(t *testing.T) {
+	columns := export.CSVColumns([]string{""})
+
+	for _, column := range []string{"value", "rate", "normal", "nutrition.carbohydrate.net", "deviceModel"} {
+		found := false
+		for _, c := range columns {
+			found = found || c == column
+		}
+		if !found {
+			t.Errorf("CSVColumns for all types is missing %q", column)
+		}
+	}
+}
+
+func Test_CSVWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := export.NewWriter(export.FormatCSV, &buffer, export.Options{Types: []string{"cbg", "food"}})
+	writeData(t, writer, testCSVData()...)
+
+	expected := "time,type,subType,deviceTime,timezoneOffset,deviceId,uploadId,id,value,units,sampleInterval,name,nutrition.carbohydrate.net,nutrition.carbohydrate.units\n" +
+		"2019-03-15T01:24:28Z,cbg,,,,,upload1,,5.5,mmol/L,,,,\n" +
+		"2019-03-15T02:00:00.5Z,food,,,,,,,,,,,30,grams\n"
+	if buffer.String() != expected {
+		t.Errorf("CSV writer wrote %q, expected %q", buffer.String(), expected)
+	}
+	if writer.ContentType() != "text/csv" {
+		t.Errorf("CSV writer has content type %q", writer.ContentType())
+	}
+}
+
+func Test_CSVWriter_Formula(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := export.NewWriter(export.FormatCSV, &buffer, export.Options{Types: []string{"food"}})
+	writeData(t, writer,
+		map[string]interface{}{"type": "food", "name": "=HYPERLINK(\"http://example.com\")", "deviceId": "-1+1", "uploadId": "@upload", "id": "+id"},
+		map[string]interface{}{"type": "food", "name": "pizza", "nutrition": map[string]interface{}{"carbohydrate": map[string]interface{}{"net": -1.5}}},
+	)
+
+	expected := "time,type,subType,deviceTime,timezoneOffset,deviceId,uploadId,id,name,nutrition.carbohydrate.net,nutrition.carbohydrate.units\n" +
+		",food,,,,'-1+1,'@upload,'+id,\"'=HYPERLINK(\"\"http://example.com\"\")\",,\n" +
+		",food,,,,,,,pizza,-1.5,\n"
+	if buffer.String() != expected {
+		t.Errorf("CSV writer wrote %q, expected %q", buffer.String(), expected)
+	}
+}
+
+func Test_CSVWriter_RangeIndex(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := export.NewWriter(export.FormatCSV, &buffer, export.Options{Types: []string{"cbg"}, RangeIndex: true})
+	data := testCSVData()[:1]
+	data[0]["rangeIndex"] = int32(1)
+	writeData(t, writer, data...)
+
+	expected := "time,type,subType,deviceTime,timezoneOffset,deviceId,uploadId,id,value,units,sampleInterval,rangeIndex\n" +
+		"2019-03-15T01:24:28Z,cbg,,,,,upload1,,5.5,mmol/L,,1\n"
+	if buffer.String() != expected {
+		t.Errorf("CSV writer wrote %q, expected %q", buffer.String(), expected)
+	}
+}
+
+func Test_CSVWriter_Empty(t *testing.T) {
+	var buffer bytes.Buffer
+	writeData(t, export.NewWriter(export.FormatCSV, &buffer, export.Options{Types: []string{"bloodKetone"}}))
+
+	expected := "time,type,subType,deviceTime,timezoneOffset,deviceId,uploadId,id,value,units\n"
+	if buffer.String() != expected {
+		t.Errorf("CSV writer wrote %q, expected %q", buffer.String(), expected)
+	}
+}
+
+func Test_CSVZipWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := export.NewWriter(export.FormatCSVZip, &buffer, export.Options{})
+	writeData(t, writer, testCSVData()...)
+
+	archive, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatalf("ZIP writer wrote invalid archive: %s", err)
+	}
+
+	expected := map[string]string{
+		"cbg.csv": "time,type,subType,deviceTime,timezoneOffset,deviceId,uploadId,id,value,units,sampleInterval\n" +
+			"2019-03-15T01:24:28Z,cbg,,,,,upload1,,5.5,mmol/L,\n",
+		"food.csv": "time,type,subType,deviceTime,timezoneOffset,deviceId,uploadId,id,name,nutrition.carbohydrate.net,nutrition.carbohydrate.units\n" +
+			"2019-03-15T02:00:00.5Z,food,,,,,,,,30,grams\n",
+	}
+	if len(archive.File) != len(expected) {
+		t.Errorf("ZIP writer wrote %d files, expected %d", len(archive.File), len(expected))
+	}
+	for _, file := range archive.File {
+		reader, _ := file.Open()
+		contents, _ := io.ReadAll(reader)
+		reader.Close()
+		if string(contents) != expected[file.Name] {
+			t.Errorf("ZIP writer wrote %q to %s, expected %q", contents, file.Name, expected[file.Name])
+		}
+	}
+	if writer.ContentType() != "application/zip" {
+		t.Errorf("ZIP writer has content type %q", writer.ContentType())
+	}
+
+	// The temporary files are removed once the archive is written
+	if files, _ := filepath.Glob(filepath.Join(os.TempDir(), "tide-whisperer-*.csv")); len(files) != 0 {
+		t.Errorf("ZIP writer left temporary files %v", files)
+	}
+}
@@ -0,0 +1,145 @@
+// Package export writes device data to HTTP responses in the formats supported by the data API
+package export
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	// FormatJSON writes the data as a single JSON array
+	FormatJSON = "json"
+	// FormatNDJSON writes each datum as a JSON object on its own line
+	FormatNDJSON = "ndjson"
+	// FormatCSV writes the data as a single CSV file
+	FormatCSV = "csv"
+	// FormatCSVZip writes the data as a ZIP archive with one CSV file per type
+	FormatCSVZip = "zip"
+	// FormatFHIR writes the data as FHIR R4 resources in a searchset Bundle
+	FormatFHIR = "fhir"
+)
+
+// formatMediaTypes maps the media types accepted in the Accept header to formats
+var formatMediaTypes = map[string]string{
+	"application/json":      FormatJSON,
+	"application/x-ndjson":  FormatNDJSON,
+	"text/csv":              FormatCSV,
+	"application/zip":       FormatCSVZip,
+	"application/fhir+json": FormatFHIR,
+}
+
+type (
+	// Writer writes device data in a particular format
+	Writer interface {
+		// ContentType returns the Content-Type of the written data
+		ContentType() string
+		// WriteDatum writes a single datum
+		WriteDatum(datum map[string]interface{}) error
+		// Close finishes writing the data. It doesn't close the underlying io.Writer.
+		Close() error
+	}
+
+	// Options configures a Writer
+	Options struct {
+		// Types are the types requested, which decide the columns of a CSV file
+		Types []string
+		// UserID is the ID of the user the data belongs to
+		UserID string
+		// SelfURL is the URL of the request, linked from a FHIR Bundle
+		SelfURL string
+		// NextURL is the URL of the next page of data, linked from a FHIR Bundle
+		NextURL string
+		// RangeIndex adds a rangeIndex column to CSV files, for data tagged with the date range it is in
+		RangeIndex bool
+	}
+
+	flusher interface {
+		Flush()
+	}
+)
+
+// RequestedFormat returns the format requested by the `format` query parameter or, if that is not
+// set, by the Accept header. JSON is returned if neither asks for a supported format, so that clients
+// sending generic Accept headers keep receiving JSON. The `fields` parameter is rejected for FHIR, whose
+// resources are built from the value and units fields it would drop.
+func RequestedFormat(req *http.Request) (string, error) {
+	format, err := requestedFormat(req)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := req.URL.Query()["fields"]; ok && format == FormatFHIR {
+		return "", errors.New("fields parameter not valid with fhir format")
+	}
+	return format, nil
+}
+
+func requestedFormat(req *http.Request) (string, error) {
+	if values, ok := req.URL.Query()["format"]; ok {
+		if len(values) < 1 {
+			return "", errors.New("format parameter not valid")
+		}
+		format := values[len(values)-1]
+		if !IsFormat(format) {
+			return "", errors.New("format parameter not valid")
+		}
+		return format, nil
+	}
+
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if format, ok := formatMediaTypes[mediaType]; ok {
+			return format, nil
+		}
+	}
+
+	return FormatJSON, nil
+}
+
+// IsFormat reports whether format is a supported format
+func IsFormat(format string) bool {
+	for _, supported := range formatMediaTypes {
+		if format == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStreaming reports whether the format is flushed as each datum is written
+func IsStreaming(format string) bool {
+	return format == FormatNDJSON
+}
+
+// ContentDisposition returns the Content-Disposition header of the format, which downloads the CSV
+// formats as attachments, or "" if the format is displayed inline
+func ContentDisposition(format string) string {
+	switch format {
+	case FormatCSV:
+		return `attachment; filename="data.csv"`
+	case FormatCSVZip:
+		return `attachment; filename="data.zip"`
+	}
+	return ""
+}
+
+// NewWriter returns a Writer for the format that writes to w
+func NewWriter(format string, w io.Writer, options Options) Writer {
+	switch format {
+	case FormatNDJSON:
+		return &ndjsonWriter{w: w}
+	case FormatCSV:
+		return newCSVWriter(w, csvColumns(options.Types, options.RangeIndex))
+	case FormatCSVZip:
+		return newCSVZipWriter(w, options.RangeIndex)
+	case FormatFHIR:
+		return newFHIRWriter(w, options)
+	default:
+		return &jsonWriter{w: w}
+	}
+}
@@ -0,0 +1,76 @@
+package export_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/tidepool-org/tide-whisperer/export"
+)
+
+func testRequest(url string, accept string) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	return req
+}
+
+func Test_RequestedFormat(t *testing.T) {
+	tests := []struct {
+		url            string
+		accept         string
+		expectedFormat string
+	}{
+		{"http://localhost/data/abc", "", export.FormatJSON},
+		{"http://localhost/data/abc", "*/*", export.FormatJSON},
+		{"http://localhost/data/abc", "application/json", export.FormatJSON},
+		{"http://localhost/data/abc", "application/x-ndjson", export.FormatNDJSON},
+		{"http://localhost/data/abc", "text/html, application/x-ndjson;q=0.9", export.FormatNDJSON},
+		{"http://localhost/data/abc?format=ndjson", "", export.FormatNDJSON},
+		{"http://localhost/data/abc?format=json", "application/x-ndjson", export.FormatJSON},
+		{"http://localhost/data/abc?format=csv", "", export.FormatCSV},
+		{"http://localhost/data/abc", "text/csv", export.FormatCSV},
+		{"http://localhost/data/abc?format=zip", "", export.FormatCSVZip},
+		{"http://localhost/data/abc", "application/fhir+json", export.FormatFHIR},
+	}
+
+	for _, test := range tests {
+		format, err := export.RequestedFormat(testRequest(test.url, test.accept))
+		if err != nil {
+			t.Errorf("RequestedFormat returned error %s for %s", err, test.url)
+		}
+		if format != test.expectedFormat {
+			t.Errorf("RequestedFormat returned %q for %s with Accept %q, expected %q", format, test.url, test.accept, test.expectedFormat)
+		}
+	}
+}
+
+func Test_RequestedFormat_Invalid(t *testing.T) {
+	if _, err := export.RequestedFormat(testRequest("http://localhost/data/abc?format=xml", "")); err == nil {
+		t.Error("RequestedFormat fails to return error for unsupported format")
+	}
+	if _, err := export.RequestedFormat(testRequest("http://localhost/data/abc?format=fhir&fields=value", "")); err == nil || err.Error() != "fields parameter not valid with fhir format" {
+		t.Errorf("RequestedFormat returned error %v for fields with fhir format", err)
+	}
+	if _, err := export.RequestedFormat(testRequest("http://localhost/data/abc?fields=value", "application/fhir+json")); err == nil {
+		t.Error("RequestedFormat fails to return error for fields with fhir Accept header")
+	}
+	if format, err := export.RequestedFormat(testRequest("http://localhost/data/abc?format=csv&fields=value", "")); err != nil || format != export.FormatCSV {
+		t.Errorf("RequestedFormat returned %q, %v for fields with csv format", format, err)
+	}
+}
+
+func Test_ContentDisposition(t *testing.T) {
+	expected := map[string]string{
+		export.FormatJSON:   "",
+		export.FormatNDJSON: "",
+		export.FormatCSV:    `attachment; filename="data.csv"`,
+		export.FormatCSVZip: `attachment; filename="data.zip"`,
+		export.FormatFHIR:   "",
+	}
+	for format, disposition := range expected {
+		if value := export.ContentDisposition(format); value != disposition {
+			t.Errorf("ContentDisposition(%s) returned %q, expected %q", format, value, disposition)
+		}
+	}
+}
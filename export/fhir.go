@@ -0,0 +1,321 @@
+package export
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tidepool-org/tide-whisperer/datum"
+)
+
+const (
+	loincSystem  = "http://loinc.org"
+	snomedSystem = "http://snomed.info/sct"
+	ucumSystem   = "http://unitsofmeasure.org"
+
+	// tidepoolUserSystem is the identifier system of the Tidepool user ID of the subject of the resources
+	tidepoolUserSystem = "https://tidepool.org/users"
+)
+
+type (
+	// fhirWriter writes cbg and smbg data as FHIR R4 Observation resources, and bolus, insulin and basal
+	// data as MedicationAdministration resources, in a searchset Bundle. Other types are not written.
+	fhirWriter struct {
+		w          io.Writer
+		options    Options
+		started    bool
+		writeCount int
+	}
+
+	fhirCoding struct {
+		System  string `json:"system"`
+		Code    string `json:"code"`
+		Display string `json:"display,omitempty"`
+	}
+
+	fhirCodeableConcept struct {
+		Coding []fhirCoding `json:"coding"`
+		Text   string       `json:"text,omitempty"`
+	}
+
+	fhirQuantity struct {
+		Value  float64 `json:"value"`
+		Unit   string  `json:"unit"`
+		System string  `json:"system"`
+		Code   string  `json:"code"`
+	}
+
+	fhirIdentifier struct {
+		System string `json:"system"`
+		Value  string `json:"value"`
+	}
+
+	fhirReference struct {
+		Identifier *fhirIdentifier `json:"identifier,omitempty"`
+		Display    string          `json:"display,omitempty"`
+	}
+
+	fhirPeriod struct {
+		Start string `json:"start"`
+		End   string `json:"end"`
+	}
+
+	fhirObservation struct {
+		ResourceType      string                `json:"resourceType"`
+		ID                string                `json:"id,omitempty"`
+		Status            string                `json:"status"`
+		Category          []fhirCodeableConcept `json:"category"`
+		Code              fhirCodeableConcept   `json:"code"`
+		Subject           fhirReference         `json:"subject"`
+		EffectiveDateTime string                `json:"effectiveDateTime"`
+		ValueQuantity     fhirQuantity          `json:"valueQuantity"`
+		Device            *fhirReference        `json:"device,omitempty"`
+	}
+
+	fhirDosage struct {
+		Dose         *fhirQuantity `json:"dose,omitempty"`
+		RateQuantity *fhirQuantity `json:"rateQuantity,omitempty"`
+	}
+
+	fhirMedicationAdministration struct {
+		ResourceType              string              `json:"resourceType"`
+		ID                        string              `json:"id,omitempty"`
+		Status                    string              `json:"status"`
+		MedicationCodeableConcept fhirCodeableConcept `json:"medicationCodeableConcept"`
+		Subject                   fhirReference       `json:"subject"`
+		EffectiveDateTime         string              `json:"effectiveDateTime,omitempty"`
+		EffectivePeriod           *fhirPeriod         `json:"effectivePeriod,omitempty"`
+		Dosage                    fhirDosage          `json:"dosage"`
+	}
+
+	fhirBundleEntry struct {
+		FullURL  string      `json:"fullUrl"`
+		Resource interface{} `json:"resource"`
+		Search   struct {
+			Mode string `json:"mode"`
+		} `json:"search"`
+	}
+
+	fhirBundleLink struct {
+		Relation string `json:"relation"`
+		URL      string `json:"url"`
+	}
+)
+
+var (
+	insulinMedication = fhirCodeableConcept{
+		Coding: []fhirCoding{{System: snomedSystem, Code: "67866001", Display: "Insulin"}},
+		Text:   "Insulin",
+	}
+
+	cbgCode = fhirCodeableConcept{
+		Coding: []fhirCoding{{System: loincSystem, Code: "99504-3", Display: "Glucose [Mass/volume] in Interstitial fluid"}},
+	}
+
+	smbgCode = fhirCodeableConcept{
+		Coding: []fhirCoding{{System: loincSystem, Code: "41653-7", Display: "Glucose [Mass/volume] in Capillary blood by Glucometer"}},
+	}
+
+	vitalSignsCategory = fhirCodeableConcept{
+		Coding: []fhirCoding{{System: "http://terminology.hl7.org/CodeSystem/observation-category", Code: "vital-signs", Display: "Vital Signs"}},
+	}
+)
+
+func newFHIRWriter(w io.Writer, options Options) *fhirWriter {
+	return &fhirWriter{w: w, options: options}
+}
+
+func (f *fhirWriter) ContentType() string {
+	return "application/fhir+json"
+}
+
+func (f *fhirWriter) WriteDatum(d map[string]interface{}) error {
+	resource := f.resource(d)
+	if resource == nil {
+		return nil
+	}
+
+	id, _ := d["id"].(string)
+	entry := fhirBundleEntry{FullURL: "urn:uuid:" + entryUUID(id).String(), Resource: resource}
+	entry.Search.Mode = "match"
+
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err = f.start(); err != nil {
+		return err
+	}
+	if f.writeCount > 0 {
+		if _, err = f.w.Write([]byte(",")); err != nil {
+			return err
+		}
+	}
+	if _, err = f.w.Write([]byte("\n")); err != nil {
+		return err
+	}
+	if _, err = f.w.Write(bytes); err != nil {
+		return err
+	}
+	f.writeCount++
+	return nil
+}
+
+func (f *fhirWriter) Close() error {
+	if err := f.start(); err != nil {
+		return err
+	}
+
+	links := []fhirBundleLink{}
+	if f.options.SelfURL != "" {
+		links = append(links, fhirBundleLink{Relation: "self", URL: f.options.SelfURL})
+	}
+	if f.options.NextURL != "" {
+		links = append(links, fhirBundleLink{Relation: "next", URL: f.options.NextURL})
+	}
+	bytes, err := json.Marshal(links)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.w.Write([]byte("\n],\"link\":")); err != nil {
+		return err
+	}
+	if _, err = f.w.Write(bytes); err != nil {
+		return err
+	}
+	_, err = f.w.Write([]byte("}"))
+	return err
+}
+
+func (f *fhirWriter) start() error {
+	if f.started {
+		return nil
+	}
+	f.started = true
+	_, err := f.w.Write([]byte(`{"resourceType":"Bundle","type":"searchset","entry":[`))
+	return err
+}
+
+// resource returns the FHIR resource for the datum, or nil if the datum has no FHIR representation
+func (f *fhirWriter) resource(d map[string]interface{}) interface{} {
+	typ, _ := d["type"].(string)
+	effectiveTime, ok := datum.Time(d)
+	if !ok {
+		return nil
+	}
+
+	switch typ {
+	case "cbg", "smbg":
+		// Rounded to the nearest whole mg/dL, as it is displayed
+		value, ok := datum.BloodGlucoseMgdL(d, "value")
+		if !ok {
+			return nil
+		}
+		value = math.Round(value)
+		observation := &fhirObservation{
+			ResourceType:      "Observation",
+			ID:                datumID(d),
+			Status:            "final",
+			Category:          []fhirCodeableConcept{vitalSignsCategory},
+			Code:              smbgCode,
+			Subject:           f.subject(),
+			EffectiveDateTime: formatFHIRTime(effectiveTime),
+			ValueQuantity:     fhirQuantity{Value: value, Unit: "mg/dL", System: ucumSystem, Code: "mg/dL"},
+		}
+		if typ == "cbg" {
+			observation.Code = cbgCode
+		}
+		if deviceID, ok := d["deviceId"].(string); ok {
+			observation.Device = &fhirReference{Display: deviceID}
+		}
+		return observation
+
+	case "bolus", "insulin":
+		var dose float64
+		var hasDose bool
+		if typ == "bolus" {
+			for _, field := range []string{"normal", "extended"} {
+				if value, ok := datum.Float(d[field]); ok {
+					dose += value
+					hasDose = true
+				}
+			}
+		} else {
+			dose, hasDose = datum.Float(datum.Lookup(d, "dose.total"))
+		}
+		if !hasDose {
+			return nil
+		}
+		administration := f.medicationAdministration(d, effectiveTime)
+		administration.Dosage.Dose = &fhirQuantity{Value: dose, Unit: "U", System: ucumSystem, Code: "[iU]"}
+		return administration
+
+	case "basal":
+		rate, ok := datum.Float(d["rate"])
+		if !ok {
+			return nil
+		}
+		administration := f.medicationAdministration(d, effectiveTime)
+		administration.Dosage.RateQuantity = &fhirQuantity{Value: rate, Unit: "U/h", System: ucumSystem, Code: "[iU]/h"}
+		return administration
+	}
+
+	return nil
+}
+
+// medicationAdministration returns an insulin MedicationAdministration for the datum. It covers the
+// datum's duration as a period if it has one, e.g. for extended boluses and basals.
+func (f *fhirWriter) medicationAdministration(d map[string]interface{}, effectiveTime time.Time) *fhirMedicationAdministration {
+	administration := &fhirMedicationAdministration{
+		ResourceType:              "MedicationAdministration",
+		ID:                        datumID(d),
+		Status:                    "completed",
+		MedicationCodeableConcept: insulinMedication,
+		Subject:                   f.subject(),
+	}
+	if duration, ok := datum.Float(d["duration"]); ok && duration > 0 {
+		administration.EffectivePeriod = &fhirPeriod{
+			Start: formatFHIRTime(effectiveTime),
+			End:   formatFHIRTime(effectiveTime.Add(time.Duration(duration) * time.Millisecond)),
+		}
+	} else {
+		administration.EffectiveDateTime = formatFHIRTime(effectiveTime)
+	}
+	return administration
+}
+
+func (f *fhirWriter) subject() fhirReference {
+	return fhirReference{Identifier: &fhirIdentifier{System: tidepoolUserSystem, Value: f.options.UserID}}
+}
+
+// datumID returns the datum's id if it is a valid FHIR id
+func datumID(d map[string]interface{}) string {
+	id, _ := d["id"].(string)
+	if len(id) == 0 || len(id) > 64 {
+		return ""
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.') {
+			return ""
+		}
+	}
+	return id
+}
+
+// entryUUID returns a UUID for the bundle entry, derived from the datum's id so that it is stable
+// across requests
+func entryUUID(id string) uuid.UUID {
+	if id == "" {
+		return uuid.New()
+	}
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(tidepoolUserSystem+"/data/"+id))
+}
+
+func formatFHIRTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,133 @@
+package export_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/tidepool-org/tide-whisperer/export"
+)
+
+func writeFHIRBundle(t *testing.T, options export.Options, data ...map[string]interface{}) map[string]interface{} {
+	var buffer bytes.Buffer
+	writer := export.NewWriter(export.FormatFHIR, &buffer, options)
+	writeData(t, writer, data...)
+
+	if writer.ContentType() != "application/fhir+json" {
+		t.Errorf("FHIR writer has content type %q", writer.ContentType())
+	}
+
+	var bundle map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &bundle); err != nil {
+		t.Fatalf("FHIR writer wrote invalid JSON %q: %s", buffer.String(), err)
+	}
+	return bundle
+}
+
+func bundleResources(bundle map[string]interface{}) []map[string]interface{} {
+	resources := []map[string]interface{}{}
+	for _, entry := range bundle["entry"].([]interface{}) {
+		resources = append(resources, entry.(map[string]interface{})["resource"].(map[string]interface{}))
+	}
+	return resources
+}
+
+func Test_FHIRWriter_Empty(t *testing.T) {
+	bundle := writeFHIRBundle(t, export.Options{SelfURL: "http://localhost/data/abc?format=fhir"})
+
+	if bundle["resourceType"] != "Bundle" || bundle["type"] != "searchset" {
+		t.Errorf("FHIR writer wrote %v, expected a searchset Bundle", bundle)
+	}
+	if len(bundle["entry"].([]interface{})) != 0 {
+		t.Errorf("FHIR writer wrote entries for no data")
+	}
+	links := bundle["link"].([]interface{})
+	if len(links) != 1 || links[0].(map[string]interface{})["relation"] != "self" {
+		t.Errorf("FHIR writer wrote links %v, expected only self", links)
+	}
+}
+
+func Test_FHIRWriter_Observations(t *testing.T) {
+	cbgTime, _ := time.Parse(time.RFC3339, "2019-03-15T01:24:28Z")
+
+	bundle := writeFHIRBundle(t,
+		export.Options{UserID: "abc123", SelfURL: "http://localhost/data/abc123?format=fhir&limit=2", NextURL: "http://localhost/data/abc123?cursor=xyz&format=fhir&limit=2"},
+		map[string]interface{}{"time": primitive.NewDateTimeFromTime(cbgTime), "type": "cbg", "value": 5.5, "units": "mmol/L", "id": "cbg1", "deviceId": "dev123"},
+		map[string]interface{}{"time": primitive.NewDateTimeFromTime(cbgTime), "type": "smbg", "value": int32(120), "units": "mg/dL"},
+		map[string]interface{}{"time": primitive.NewDateTimeFromTime(cbgTime), "type": "food"},
+	)
+
+	resources := bundleResources(bundle)
+	if len(resources) != 2 {
+		t.Fatalf("FHIR writer wrote %d resources, expected 2", len(resources))
+	}
+
+	cbg := resources[0]
+	if cbg["resourceType"] != "Observation" || cbg["id"] != "cbg1" || cbg["effectiveDateTime"] != "2019-03-15T01:24:28Z" {
+		t.Errorf("FHIR writer wrote unexpected cbg Observation %v", cbg)
+	}
+	if code := cbg["code"].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{}); code["code"] != "99504-3" || code["system"] != "http://loinc.org" {
+		t.Errorf("FHIR writer wrote unexpected cbg code %v", code)
+	}
+	if quantity := cbg["valueQuantity"].(map[string]interface{}); quantity["value"] != float64(99) || quantity["code"] != "mg/dL" || quantity["system"] != "http://unitsofmeasure.org" {
+		t.Errorf("FHIR writer wrote unexpected cbg value %v", quantity)
+	}
+	if subject := cbg["subject"].(map[string]interface{})["identifier"].(map[string]interface{}); subject["value"] != "abc123" {
+		t.Errorf("FHIR writer wrote unexpected subject %v", subject)
+	}
+
+	smbg := resources[1]
+	if code := smbg["code"].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{}); code["code"] != "41653-7" {
+		t.Errorf("FHIR writer wrote unexpected smbg code %v", code)
+	}
+	if quantity := smbg["valueQuantity"].(map[string]interface{}); quantity["value"] != float64(120) {
+		t.Errorf("FHIR writer wrote unexpected smbg value %v", quantity)
+	}
+
+	links := bundle["link"].([]interface{})
+	if len(links) != 2 || links[1].(map[string]interface{})["relation"] != "next" || links[1].(map[string]interface{})["url"] != "http://localhost/data/abc123?cursor=xyz&format=fhir&limit=2" {
+		t.Errorf("FHIR writer wrote unexpected links %v", links)
+	}
+}
+
+func Test_FHIRWriter_MedicationAdministrations(t *testing.T) {
+	bolusTime, _ := time.Parse(time.RFC3339, "2019-03-15T01:00:00Z")
+
+	bundle := writeFHIRBundle(t, export.Options{UserID: "abc123"},
+		map[string]interface{}{"time": primitive.NewDateTimeFromTime(bolusTime), "type": "bolus", "subType": "dual/square", "normal": 1.5, "extended": 2.0, "duration": int32(3600000)},
+		map[string]interface{}{"time": primitive.NewDateTimeFromTime(bolusTime), "type": "insulin", "dose": map[string]interface{}{"total": 3.0, "units": "Units"}},
+		map[string]interface{}{"time": primitive.NewDateTimeFromTime(bolusTime), "type": "basal", "rate": 0.8, "duration": int32(1800000)},
+	)
+
+	resources := bundleResources(bundle)
+	if len(resources) != 3 {
+		t.Fatalf("FHIR writer wrote %d resources, expected 3", len(resources))
+	}
+
+	bolus := resources[0]
+	if bolus["resourceType"] != "MedicationAdministration" || bolus["status"] != "completed" {
+		t.Errorf("FHIR writer wrote unexpected bolus %v", bolus)
+	}
+	if dose := bolus["dosage"].(map[string]interface{})["dose"].(map[string]interface{}); dose["value"] != 3.5 || dose["code"] != "[iU]" {
+		t.Errorf("FHIR writer wrote unexpected bolus dose %v", dose)
+	}
+	if period := bolus["effectivePeriod"].(map[string]interface{}); period["start"] != "2019-03-15T01:00:00Z" || period["end"] != "2019-03-15T02:00:00Z" {
+		t.Errorf("FHIR writer wrote unexpected bolus period %v", period)
+	}
+
+	insulin := resources[1]
+	if dose := insulin["dosage"].(map[string]interface{})["dose"].(map[string]interface{}); dose["value"] != 3.0 {
+		t.Errorf("FHIR writer wrote unexpected insulin dose %v", dose)
+	}
+	if insulin["effectiveDateTime"] != "2019-03-15T01:00:00Z" {
+		t.Errorf("FHIR writer wrote unexpected insulin time %v", insulin["effectiveDateTime"])
+	}
+
+	basal := resources[2]
+	if rate := basal["dosage"].(map[string]interface{})["rateQuantity"].(map[string]interface{}); rate["value"] != 0.8 || rate["code"] != "[iU]/h" {
+		t.Errorf("FHIR writer wrote unexpected basal rate %v", rate)
+	}
+}
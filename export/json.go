@@ -0,0 +1,92 @@
+package export
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// jsonWriter writes the data as a JSON array with one datum per line
+type jsonWriter struct {
+	w          io.Writer
+	started    bool
+	writeCount int
+}
+
+// ndjsonWriter writes each datum as a JSON object on its own line, flushing after each one so that
+// clients can process the data as it arrives
+type ndjsonWriter struct {
+	w io.Writer
+}
+
+func (j *jsonWriter) ContentType() string {
+	return "application/json"
+}
+
+func (j *jsonWriter) WriteDatum(datum map[string]interface{}) error {
+	bytes, err := json.Marshal(datum)
+	if err != nil {
+		return err
+	}
+
+	if err = j.start(); err != nil {
+		return err
+	}
+	if j.writeCount > 0 {
+		if _, err = j.w.Write([]byte(",")); err != nil {
+			return err
+		}
+	}
+	if _, err = j.w.Write([]byte("\n")); err != nil {
+		return err
+	}
+	if _, err = j.w.Write(bytes); err != nil {
+		return err
+	}
+	j.writeCount++
+	return nil
+}
+
+func (j *jsonWriter) Close() error {
+	if err := j.start(); err != nil {
+		return err
+	}
+	if j.writeCount > 0 {
+		if _, err := j.w.Write([]byte("\n")); err != nil {
+			return err
+		}
+	}
+	_, err := j.w.Write([]byte("]"))
+	return err
+}
+
+func (j *jsonWriter) start() error {
+	if j.started {
+		return nil
+	}
+	j.started = true
+	_, err := j.w.Write([]byte("["))
+	return err
+}
+
+func (n *ndjsonWriter) ContentType() string {
+	return "application/x-ndjson"
+}
+
+func (n *ndjsonWriter) WriteDatum(datum map[string]interface{}) error {
+	bytes, err := json.Marshal(datum)
+	if err != nil {
+		return err
+	}
+
+	if _, err = n.w.Write(append(bytes, '\n')); err != nil {
+		return err
+	}
+	if f, ok := n.w.(flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,64 @@
+package export_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tidepool-org/tide-whisperer/export"
+)
+
+func writeData(t *testing.T, writer export.Writer, data ...map[string]interface{}) {
+	for _, datum := range data {
+		if err := writer.WriteDatum(datum); err != nil {
+			t.Errorf("WriteDatum returned error %s", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Errorf("Close returned error %s", err)
+	}
+}
+
+func Test_JSONWriter_Empty(t *testing.T) {
+	var buffer bytes.Buffer
+	writeData(t, export.NewWriter(export.FormatJSON, &buffer, export.Options{}))
+
+	if buffer.String() != "[]" {
+		t.Errorf("JSON writer wrote %q for no data", buffer.String())
+	}
+}
+
+func Test_JSONWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := export.NewWriter(export.FormatJSON, &buffer, export.Options{})
+	writeData(t, writer, map[string]interface{}{"type": "cbg", "value": 5.5}, map[string]interface{}{"type": "smbg"})
+
+	expected := "[\n{\"type\":\"cbg\",\"value\":5.5},\n{\"type\":\"smbg\"}\n]"
+	if buffer.String() != expected {
+		t.Errorf("JSON writer wrote %q, expected %q", buffer.String(), expected)
+	}
+	if writer.ContentType() != "application/json" {
+		t.Errorf("JSON writer has content type %q", writer.ContentType())
+	}
+}
+
+func Test_NDJSONWriter(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writer := export.NewWriter(export.FormatNDJSON, recorder, export.Options{})
+
+	if err := writer.WriteDatum(map[string]interface{}{"type": "cbg", "value": 5.5}); err != nil {
+		t.Errorf("WriteDatum returned error %s", err)
+	}
+	if !recorder.Flushed {
+		t.Error("NDJSON writer fails to flush after writing datum")
+	}
+	writeData(t, writer, map[string]interface{}{"type": "smbg"})
+
+	expected := "{\"type\":\"cbg\",\"value\":5.5}\n{\"type\":\"smbg\"}\n"
+	if recorder.Body.String() != expected {
+		t.Errorf("NDJSON writer wrote %q, expected %q", recorder.Body.String(), expected)
+	}
+	if writer.ContentType() != "application/x-ndjson" {
+		t.Errorf("NDJSON writer has content type %q", writer.ContentType())
+	}
+}
@@ -0,0 +1,266 @@
+// Package nightscout translates between the Nightscout read API and the data API, so that tools
+// built for Nightscout (followers, watchfaces) can read a user's data
+package nightscout
+
+import (
+	"errors"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidepool-org/tide-whisperer/datum"
+)
+
+// SourceParameters are the data API parameters that select the data sources, which are passed through
+var SourceParameters = []string{"carelink", "medtronic", "cbgFilter"}
+
+const (
+	// Entries is the Nightscout collection of blood glucose readings
+	Entries = "entries"
+	// Treatments is the Nightscout collection of insulin and carbohydrate events
+	Treatments = "treatments"
+
+	// DefaultCount is the number of records returned when `count` is not set, as in Nightscout
+	DefaultCount = 10
+
+	enteredBy = "tidepool"
+)
+
+var (
+	// collectionTypes are the data types read for each Nightscout collection
+	collectionTypes = map[string][]string{
+		Entries:    {"cbg", "smbg"},
+		Treatments: {"bolus", "food", "wizard"},
+	}
+
+	// entryTypes maps Nightscout entry types to data types
+	entryTypes = map[string]string{
+		"sgv": "cbg",
+		"mbg": "smbg",
+	}
+
+	// directions maps cbg trends to Nightscout directions
+	directions = map[string]string{
+		"constant":     "Flat",
+		"slowRise":     "FortyFiveUp",
+		"moderateRise": "SingleUp",
+		"rapidRise":    "DoubleUp",
+		"slowFall":     "FortyFiveDown",
+		"moderateFall": "SingleDown",
+		"rapidFall":    "DoubleDown",
+	}
+)
+
+// Query translates the Nightscout query parameters of a request for the collection into data API
+// query parameters. It supports `count` and `find` on `date` (epoch milliseconds), `dateString` and
+// `created_at` (ISO dates) with the $gte, $gt, $lte and $lt operators, and `find[type]` for entries.
+// The results are the most recent first, as in Nightscout.
+func Query(collection string, userID string, values url.Values) (url.Values, error) {
+	types, ok := collectionTypes[collection]
+	if !ok {
+		return nil, errors.New("collection not valid")
+	}
+
+	count := DefaultCount
+	if value := values.Get("count"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return nil, errors.New("count parameter not valid")
+		}
+		count = parsed
+	}
+
+	query := url.Values{
+		":userID": []string{userID},
+		"sort":    []string{"-time"},
+		"limit":   []string{strconv.Itoa(count)},
+	}
+
+	if value := values.Get("find[type]"); value != "" {
+		if collection != Entries {
+			return nil, errors.New("find[type] parameter not valid")
+		}
+		typ, ok := entryTypes[value]
+		if !ok {
+			return nil, errors.New("find[type] parameter not valid")
+		}
+		types = []string{typ}
+	}
+	query.Set("type", strings.Join(types, ","))
+
+	for _, field := range []string{"date", "dateString", "created_at"} {
+		for _, operator := range []string{"$gte", "$gt", "$lte", "$lt"} {
+			value := values.Get("find[" + field + "][" + operator + "]")
+			if value == "" {
+				continue
+			}
+			date, err := parseDate(field, value)
+			if err != nil {
+				return nil, errors.New("find[" + field + "] parameter not valid")
+			}
+			switch operator {
+			case "$gt":
+				date = date.Add(time.Millisecond)
+			case "$lt":
+				date = date.Add(-time.Millisecond)
+			}
+			if operator == "$gte" || operator == "$gt" {
+				query.Set("startDate", date.Format(time.RFC3339Nano))
+			} else {
+				query.Set("endDate", date.Format(time.RFC3339Nano))
+			}
+		}
+	}
+
+	// Explicit data source selections are passed through, as for the data API
+	for _, key := range SourceParameters {
+		if value, ok := values[key]; ok {
+			query[key] = value
+		}
+	}
+
+	return query, nil
+}
+
+func parseDate(field string, value string) (time.Time, error) {
+	if field == "date" {
+		millis, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.UnixMilli(millis).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// Record returns the Nightscout record of the collection for the datum, or false if the datum has
+// no representation in the collection
+func Record(collection string, d map[string]interface{}) (map[string]interface{}, bool) {
+	switch collection {
+	case Entries:
+		return Entry(d)
+	case Treatments:
+		return Treatment(d)
+	}
+	return nil, false
+}
+
+// Entry returns the Nightscout entry for a cbg (sgv) or smbg (mbg) datum
+func Entry(d map[string]interface{}) (map[string]interface{}, bool) {
+	datumTime, ok := datum.Time(d)
+	if !ok {
+		return nil, false
+	}
+	value, ok := roundedBloodGlucose(d, "value")
+	if !ok {
+		return nil, false
+	}
+
+	entry := record(d, datumTime)
+	entry["date"] = datumTime.UnixMilli()
+	entry["dateString"] = datumTime.Format(time.RFC3339Nano)
+
+	switch d["type"] {
+	case "cbg":
+		entry["type"] = "sgv"
+		entry["sgv"] = value
+		if trend, ok := d["trend"].(string); ok {
+			if direction, ok := directions[trend]; ok {
+				entry["direction"] = direction
+			}
+		}
+	case "smbg":
+		entry["type"] = "mbg"
+		entry["mbg"] = value
+	default:
+		return nil, false
+	}
+	return entry, true
+}
+
+// Treatment returns the Nightscout treatment for a bolus, food or wizard datum
+func Treatment(d map[string]interface{}) (map[string]interface{}, bool) {
+	datumTime, ok := datum.Time(d)
+	if !ok {
+		return nil, false
+	}
+
+	treatment := record(d, datumTime)
+	treatment["created_at"] = datumTime.Format(time.RFC3339Nano)
+	treatment["enteredBy"] = enteredBy
+
+	switch d["type"] {
+	case "bolus":
+		normal, hasNormal := datum.Float(d["normal"])
+		extended, hasExtended := datum.Float(d["extended"])
+		if !hasNormal && !hasExtended {
+			return nil, false
+		}
+		treatment["insulin"] = normal + extended
+		if hasExtended {
+			treatment["eventType"] = "Combo Bolus"
+			treatment["enteredinsulin"] = normal + extended
+			treatment["splitNow"] = percentage(normal, normal+extended)
+			treatment["splitExt"] = percentage(extended, normal+extended)
+			if duration, ok := datum.Float(d["duration"]); ok {
+				treatment["duration"] = duration / float64(time.Minute/time.Millisecond)
+			}
+		} else {
+			treatment["eventType"] = "Correction Bolus"
+		}
+	case "food":
+		carbs, ok := datum.Float(datum.Lookup(d, "nutrition.carbohydrate.net"))
+		if !ok {
+			return nil, false
+		}
+		treatment["eventType"] = "Carb Correction"
+		treatment["carbs"] = carbs
+	case "wizard":
+		// The insulin is reported by the wizard's bolus, so only the carbs and glucose are reported here
+		treatment["eventType"] = "Bolus Wizard"
+		if carbs, ok := datum.Float(d["carbInput"]); ok {
+			treatment["carbs"] = carbs
+		}
+		if glucose, ok := roundedBloodGlucose(d, "bgInput"); ok {
+			treatment["glucose"] = glucose
+			treatment["glucoseType"] = "Finger"
+			treatment["units"] = "mg/dl"
+		}
+	default:
+		return nil, false
+	}
+	return treatment, true
+}
+
+// record returns the fields common to entries and treatments
+func record(d map[string]interface{}, datumTime time.Time) map[string]interface{} {
+	result := map[string]interface{}{
+		"mills": datumTime.UnixMilli(),
+	}
+	if id, ok := d["id"].(string); ok {
+		result["_id"] = id
+	}
+	if deviceID, ok := d["deviceId"].(string); ok {
+		result["device"] = deviceID
+	}
+	if offset, ok := datum.Float(d["timezoneOffset"]); ok {
+		result["utcOffset"] = offset
+	}
+	return result
+}
+
+// roundedBloodGlucose returns the blood glucose value of the field in mg/dL, rounded to the nearest
+// whole mg/dL as Nightscout expects
+func roundedBloodGlucose(d map[string]interface{}, field string) (float64, bool) {
+	value, ok := datum.BloodGlucoseMgdL(d, field)
+	return math.Round(value), ok
+}
+
+func percentage(part float64, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(part / total * 100)
+}
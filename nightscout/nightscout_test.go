@@ -0,0 +1,178 @@
+package nightscout_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/tidepool-org/tide-whisperer/nightscout"
+)
+
+func Test_Query(t *testing.T) {
+	values := url.Values{
+		"count":                 []string{"100"},
+		"find[type]":            []string{"sgv"},
+		"find[date][$gte]":      []string{"1577836800000"},
+		"find[dateString][$lt]": []string{"2020-01-02T00:00:00Z"},
+		"carelink":              []string{"true"},
+		"unrecognized":          []string{"ignored"},
+	}
+
+	query, err := nightscout.Query(nightscout.Entries, "abc123", values)
+	if err != nil {
+		t.Fatalf("Query returned error %s", err)
+	}
+
+	expected := map[string]string{
+		":userID":   "abc123",
+		"sort":      "-time",
+		"limit":     "100",
+		"type":      "cbg",
+		"startDate": "2020-01-01T00:00:00Z",
+		"endDate":   "2020-01-01T23:59:59.999Z",
+		"carelink":  "true",
+	}
+	for key, value := range expected {
+		if query.Get(key) != value {
+			t.Errorf("Query set %s to %q, expected %q", key, query.Get(key), value)
+		}
+	}
+	if _, ok := query["unrecognized"]; ok {
+		t.Errorf("Query passed through an unrecognized parameter")
+	}
+}
+
+func Test_Query_Defaults(t *testing.T) {
+	query, err := nightscout.Query(nightscout.Treatments, "abc123", url.Values{})
+	if err != nil {
+		t.Fatalf("Query returned error %s", err)
+	}
+	if query.Get("limit") != "10" {
+		t.Errorf("Query set limit to %q, expected the default count", query.Get("limit"))
+	}
+	if query.Get("type") != "bolus,food,wizard" {
+		t.Errorf("Query set type to %q for treatments", query.Get("type"))
+	}
+}
+
+func Test_Query_Invalid(t *testing.T) {
+	tests := []struct {
+		collection string
+		values     url.Values
+	}{
+		{"profile", url.Values{}},
+		{nightscout.Entries, url.Values{"count": []string{"0"}}},
+		{nightscout.Entries, url.Values{"count": []string{"ten"}}},
+		{nightscout.Entries, url.Values{"find[type]": []string{"cal"}}},
+		{nightscout.Treatments, url.Values{"find[type]": []string{"sgv"}}},
+		{nightscout.Entries, url.Values{"find[date][$gte]": []string{"2020-01-01"}}},
+		{nightscout.Entries, url.Values{"find[created_at][$lte]": []string{"yesterday"}}},
+	}
+
+	for _, test := range tests {
+		if _, err := nightscout.Query(test.collection, "abc123", test.values); err == nil {
+			t.Errorf("Query of %s with %v did not return an error", test.collection, test.values)
+		}
+	}
+}
+
+func Test_Entry(t *testing.T) {
+	datumTime := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	entry, ok := nightscout.Entry(map[string]interface{}{
+		"id":             "abc",
+		"type":           "cbg",
+		"time":           primitive.NewDateTimeFromTime(datumTime),
+		"units":          "mmol/L",
+		"value":          5.5,
+		"trend":          "slowFall",
+		"deviceId":       "Dexcom-123",
+		"timezoneOffset": int32(-300),
+	})
+	if !ok {
+		t.Fatalf("Entry returned no entry for cbg")
+	}
+
+	expected := map[string]interface{}{
+		"_id":        "abc",
+		"type":       "sgv",
+		"sgv":        99.0,
+		"date":       datumTime.UnixMilli(),
+		"mills":      datumTime.UnixMilli(),
+		"dateString": "2020-01-01T12:00:00Z",
+		"direction":  "FortyFiveDown",
+		"device":     "Dexcom-123",
+		"utcOffset":  -300.0,
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("Entry set %s to %v, expected %v", key, entry[key], value)
+		}
+	}
+
+	entry, ok = nightscout.Entry(map[string]interface{}{"type": "smbg", "time": "2020-01-01T12:00:00Z", "units": "mg/dL", "value": 120.0})
+	if !ok || entry["type"] != "mbg" || entry["mbg"] != 120.0 {
+		t.Errorf("Entry returned %v for smbg", entry)
+	}
+
+	if _, ok = nightscout.Entry(map[string]interface{}{"type": "bolus", "time": "2020-01-01T12:00:00Z", "normal": 1.0}); ok {
+		t.Errorf("Entry returned an entry for bolus")
+	}
+}
+
+func Test_Treatment(t *testing.T) {
+	treatment, ok := nightscout.Treatment(map[string]interface{}{
+		"type":     "bolus",
+		"time":     "2020-01-01T12:00:00Z",
+		"normal":   1.5,
+		"extended": 0.5,
+		"duration": int32(1800000),
+	})
+	if !ok {
+		t.Fatalf("Treatment returned no treatment for bolus")
+	}
+	expected := map[string]interface{}{
+		"eventType":  "Combo Bolus",
+		"insulin":    2.0,
+		"splitNow":   75.0,
+		"splitExt":   25.0,
+		"duration":   30.0,
+		"created_at": "2020-01-01T12:00:00Z",
+		"enteredBy":  "tidepool",
+	}
+	for key, value := range expected {
+		if treatment[key] != value {
+			t.Errorf("Treatment set %s to %v, expected %v", key, treatment[key], value)
+		}
+	}
+
+	treatment, ok = nightscout.Treatment(map[string]interface{}{"type": "bolus", "time": "2020-01-01T12:00:00Z", "normal": 1.5})
+	if !ok || treatment["eventType"] != "Correction Bolus" || treatment["insulin"] != 1.5 {
+		t.Errorf("Treatment returned %v for normal bolus", treatment)
+	}
+
+	treatment, ok = nightscout.Treatment(map[string]interface{}{
+		"type":      "food",
+		"time":      "2020-01-01T12:00:00Z",
+		"nutrition": map[string]interface{}{"carbohydrate": map[string]interface{}{"net": 45.0}},
+	})
+	if !ok || treatment["eventType"] != "Carb Correction" || treatment["carbs"] != 45.0 {
+		t.Errorf("Treatment returned %v for food", treatment)
+	}
+
+	treatment, ok = nightscout.Treatment(map[string]interface{}{
+		"type":      "wizard",
+		"time":      "2020-01-01T12:00:00Z",
+		"carbInput": 30.0,
+		"bgInput":   8.0,
+		"units":     "mmol/L",
+	})
+	if !ok || treatment["eventType"] != "Bolus Wizard" || treatment["carbs"] != 30.0 || treatment["glucose"] != 144.0 {
+		t.Errorf("Treatment returned %v for wizard", treatment)
+	}
+
+	if _, ok = nightscout.Treatment(map[string]interface{}{"type": "cbg", "time": "2020-01-01T12:00:00Z", "value": 5.5}); ok {
+		t.Errorf("Treatment returned a treatment for cbg")
+	}
+}
@@ -0,0 +1,137 @@
+// Package report computes reports from the device data read from the store
+package report
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/tidepool-org/tide-whisperer/datum"
+)
+
+const minutesPerDay = 24 * 60
+
+// DataParameters are the data API parameters not valid for reports, as they would read a page or the
+// latest of the data, or change its order or the response, rather than filter the data reported
+var DataParameters = []string{"limit", "cursor", "latest", "latestBy", "sort", "explain", "format"}
+
+// ValidateQuery returns an error if the query of a report has any of the DataParameters
+func ValidateQuery(query url.Values) error {
+	for _, key := range DataParameters {
+		if _, ok := query[key]; ok {
+			return fmt.Errorf("%s parameter not valid for reports", key)
+		}
+	}
+	return nil
+}
+
+// AGPPercentiles are the percentiles of an Ambulatory Glucose Profile
+var AGPPercentiles = []float64{5, 25, 50, 75, 95}
+
+type (
+	// AGP accumulates cbg readings into time of day bins for an Ambulatory Glucose Profile
+	AGP struct {
+		binMinutes int
+		location   *time.Location
+		values     [][]float64
+	}
+
+	// AGPResult is an Ambulatory Glucose Profile. Blood glucose values are in Units.
+	AGPResult struct {
+		Units      string   `json:"units"`
+		BinMinutes int      `json:"binMinutes"`
+		Bins       []AGPBin `json:"bins"`
+	}
+
+	// AGPBin holds the percentiles of the readings in the time of day bin starting at Start (HH:MM),
+	// keyed by percentile. Percentiles is empty if there are no readings.
+	AGPBin struct {
+		Start       string             `json:"start"`
+		Count       int                `json:"count"`
+		Percentiles map[string]float64 `json:"percentiles"`
+	}
+)
+
+// NewAGP returns an AGP with bins of binMinutes, which must divide a day. Readings are placed in the
+// bins by their local time in the location, or by their timezoneOffset if location is nil.
+func NewAGP(binMinutes int, location *time.Location) (*AGP, error) {
+	if binMinutes < 5 || binMinutes > 240 || minutesPerDay%binMinutes != 0 {
+		return nil, errors.New("binMinutes parameter not valid")
+	}
+	return &AGP{
+		binMinutes: binMinutes,
+		location:   location,
+		values:     make([][]float64, minutesPerDay/binMinutes),
+	}, nil
+}
+
+// Add adds the cbg datum's reading to its bin. Other data is ignored.
+func (a *AGP) Add(d map[string]interface{}) {
+	if d["type"] != "cbg" {
+		return
+	}
+	value, ok := datum.BloodGlucoseMgdL(d, "value")
+	if !ok {
+		return
+	}
+	localTime, ok := LocalTime(d, a.location)
+	if !ok {
+		return
+	}
+
+	bin := (localTime.Hour()*60 + localTime.Minute()) / a.binMinutes
+	a.values[bin] = append(a.values[bin], value)
+}
+
+// Result returns the profile with blood glucose values in the units
+func (a *AGP) Result(units string) AGPResult {
+	result := AGPResult{Units: units, BinMinutes: a.binMinutes, Bins: make([]AGPBin, len(a.values))}
+	for idx, values := range a.values {
+		sort.Float64s(values)
+
+		minutes := idx * a.binMinutes
+		bin := AGPBin{
+			Start:       fmt.Sprintf("%02d:%02d", minutes/60, minutes%60),
+			Count:       len(values),
+			Percentiles: map[string]float64{},
+		}
+		if len(values) > 0 {
+			for _, p := range AGPPercentiles {
+				bin.Percentiles[fmt.Sprintf("p%g", p)] = datum.BloodGlucoseInUnits(Percentile(values, p), units)
+			}
+		}
+		result.Bins[idx] = bin
+	}
+	return result
+}
+
+// Percentile returns the pth percentile of the sorted values, interpolating linearly between the
+// closest ranks
+func Percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// LocalTime returns the local time of the datum in the location, or from its timezoneOffset if location
+// is nil. Data without a timezoneOffset is in UTC.
+func LocalTime(d map[string]interface{}, location *time.Location) (time.Time, bool) {
+	datumTime, ok := datum.Time(d)
+	if !ok {
+		return time.Time{}, false
+	}
+	if location != nil {
+		return datumTime.In(location), true
+	}
+	if offset, ok := datum.Float(d["timezoneOffset"]); ok {
+		return datumTime.In(time.FixedZone("", int(offset)*60)), true
+	}
+	return datumTime, true
+}
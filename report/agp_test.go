@@ -0,0 +1,103 @@
+package report_test
+
+import (
+	"math"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/tide-whisperer/report"
+	"github.com/tidepool-org/tide-whisperer/store"
+)
+
+func cbg(t time.Time, value float64, offset int) map[string]interface{} {
+	return map[string]interface{}{
+		"type":           "cbg",
+		"time":           t.Format(time.RFC3339Nano),
+		"units":          "mg/dL",
+		"value":          value,
+		"timezoneOffset": offset,
+	}
+}
+
+func Test_Percentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5}
+	tests := map[float64]float64{0: 1, 25: 2, 50: 3, 95: 4.8, 100: 5}
+	for p, expected := range tests {
+		if value := report.Percentile(sorted, p); math.Abs(value-expected) > 1e-9 {
+			t.Errorf("Percentile(%g) returned %g, expected %g", p, value, expected)
+		}
+	}
+	if !math.IsNaN(report.Percentile(nil, 50)) {
+		t.Error("Percentile of no values is not NaN")
+	}
+}
+
+func Test_NewAGP_Invalid(t *testing.T) {
+	for _, binMinutes := range []int{0, 1, 7, 1440} {
+		if _, err := report.NewAGP(binMinutes, nil); err == nil {
+			t.Errorf("NewAGP(%d) did not return an error", binMinutes)
+		}
+	}
+}
+
+func Test_AGP(t *testing.T) {
+	agp, err := report.NewAGP(60, nil)
+	if err != nil {
+		t.Fatalf("NewAGP returned error %s", err)
+	}
+
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// 13:xx UTC is 08:xx local at -300 minutes
+	for idx, value := range []float64{100, 120, 140, 160, 180} {
+		agp.Add(cbg(day.Add(time.Duration(idx)*24*time.Hour+13*time.Hour+10*time.Minute), value, -300))
+	}
+	agp.Add(cbg(day.Add(23*time.Hour+59*time.Minute), 90, 0))
+	agp.Add(map[string]interface{}{"type": "smbg", "time": day.Format(time.RFC3339), "units": "mg/dL", "value": 300.0})
+
+	result := agp.Result(store.UnitsMgdL)
+	if len(result.Bins) != 24 || result.BinMinutes != 60 {
+		t.Fatalf("AGP returned %d bins of %d minutes", len(result.Bins), result.BinMinutes)
+	}
+
+	bin := result.Bins[8]
+	if bin.Start != "08:00" || bin.Count != 5 {
+		t.Errorf("AGP returned bin %+v, expected 5 readings from 08:00", bin)
+	}
+	expected := map[string]float64{"p5": 104, "p25": 120, "p50": 140, "p75": 160, "p95": 176}
+	for key, value := range expected {
+		if math.Abs(bin.Percentiles[key]-value) > 1e-9 {
+			t.Errorf("AGP returned %s %g, expected %g", key, bin.Percentiles[key], value)
+		}
+	}
+
+	if result.Bins[23].Count != 1 || result.Bins[0].Count != 0 || len(result.Bins[0].Percentiles) != 0 {
+		t.Errorf("AGP returned bins %+v and %+v", result.Bins[0], result.Bins[23])
+	}
+
+	result = agp.Result(store.UnitsMmolL)
+	if math.Abs(result.Bins[8].Percentiles["p50"]-7.77) > 0.01 {
+		t.Errorf("AGP returned median %g mmol/L", result.Bins[8].Percentiles["p50"])
+	}
+}
+
+func Test_AGP_Location(t *testing.T) {
+	location := time.FixedZone("test", 2*60*60)
+	agp, _ := report.NewAGP(30, location)
+	agp.Add(cbg(time.Date(2020, 1, 1, 22, 45, 0, 0, time.UTC), 100, -300))
+
+	if bin := agp.Result(store.UnitsMgdL).Bins[1]; bin.Count != 1 || bin.Start != "00:30" {
+		t.Errorf("AGP returned bin %+v, expected the reading in the location's local time", bin)
+	}
+}
+
+func Test_ValidateQuery(t *testing.T) {
+	if err := report.ValidateQuery(url.Values{"startDate": []string{"-14d"}, "timezone": []string{"UTC"}}); err != nil {
+		t.Errorf("ValidateQuery returned error %s", err)
+	}
+	for _, key := range []string{"limit", "cursor", "latest", "sort", "explain"} {
+		if err := report.ValidateQuery(url.Values{key: []string{"1"}}); err == nil || err.Error() != key+" parameter not valid for reports" {
+			t.Errorf("ValidateQuery returned error %v for %s", err, key)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package report
+
+import (
+	"sort"
+	"time"
+
+	"github.com/tidepool-org/tide-whisperer/datum"
+)
+
+// dateFormat is the format of the local dates of the daily totals
+const dateFormat = "2006-01-02"
+
+// DailyTotalsTypes are the types of data read for DailyTotals
+var DailyTotalsTypes = []string{"basal", "bolus", "insulin", "wizard", "food"}
+
+type (
+	// DailyTotals accumulates insulin and carbohydrates into local days
+	DailyTotals struct {
+		location *time.Location
+		days     map[string]*DailyTotal
+	}
+
+	// DailyTotal is the insulin delivered, in units, and the carbohydrates entered, in grams, on a
+	// local day. Insulin is the insulin recorded without a pump, e.g. by an insulin pen.
+	DailyTotal struct {
+		Date            string  `json:"date"`
+		Basal           float64 `json:"basal"`
+		Bolus           float64 `json:"bolus"`
+		Insulin         float64 `json:"insulin"`
+		TotalInsulin    float64 `json:"totalInsulin"`
+		BasalPercentage float64 `json:"basalPercentage"`
+		Carbs           float64 `json:"carbs"`
+	}
+)
+
+// NewDailyTotals returns DailyTotals with days in the location, or in each datum's timezoneOffset if
+// location is nil
+func NewDailyTotals(location *time.Location) *DailyTotals {
+	return &DailyTotals{location: location, days: map[string]*DailyTotal{}}
+}
+
+// Add adds the datum's insulin or carbohydrates to its day. Basal delivery is the rate integrated
+// over the duration, split across the days it spans. Boluses, including the extended part of combo
+// boluses, count towards the day they started.
+func (dt *DailyTotals) Add(d map[string]interface{}) {
+	localTime, ok := LocalTime(d, dt.location)
+	if !ok {
+		return
+	}
+
+	switch d["type"] {
+	case "basal":
+		rate, hasRate := datum.Float(d["rate"])
+		duration, hasDuration := datum.Float(d["duration"])
+		if !hasRate || !hasDuration || rate <= 0 || duration <= 0 {
+			return
+		}
+		end := localTime.Add(time.Duration(duration) * time.Millisecond)
+		for segmentStart := localTime; segmentStart.Before(end); {
+			year, month, day := segmentStart.Date()
+			segmentEnd := time.Date(year, month, day+1, 0, 0, 0, 0, segmentStart.Location())
+			if segmentEnd.After(end) {
+				segmentEnd = end
+			}
+			dt.day(segmentStart).Basal += rate * segmentEnd.Sub(segmentStart).Hours()
+			segmentStart = segmentEnd
+		}
+	case "bolus":
+		for _, field := range []string{"normal", "extended"} {
+			if value, ok := datum.Float(d[field]); ok {
+				dt.day(localTime).Bolus += value
+			}
+		}
+	case "insulin":
+		if value, ok := datum.Float(datum.Lookup(d, "dose.total")); ok {
+			dt.day(localTime).Insulin += value
+		}
+	case "wizard":
+		if value, ok := datum.Float(d["carbInput"]); ok {
+			dt.day(localTime).Carbs += value
+		}
+	case "food":
+		if value, ok := datum.Float(datum.Lookup(d, "nutrition.carbohydrate.net")); ok {
+			dt.day(localTime).Carbs += value
+		}
+	}
+}
+
+// Result returns the totals of each day with data, in date order
+func (dt *DailyTotals) Result() []DailyTotal {
+	result := make([]DailyTotal, 0, len(dt.days))
+	for _, total := range dt.days {
+		total.TotalInsulin = total.Basal + total.Bolus + total.Insulin
+		if total.TotalInsulin > 0 {
+			total.BasalPercentage = total.Basal / total.TotalInsulin * 100
+		}
+		result = append(result, *total)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Date < result[j].Date })
+	return result
+}
+
+func (dt *DailyTotals) day(localTime time.Time) *DailyTotal {
+	date := localTime.Format(dateFormat)
+	total, ok := dt.days[date]
+	if !ok {
+		total = &DailyTotal{Date: date}
+		dt.days[date] = total
+	}
+	return total
+}
@@ -0,0 +1,58 @@
+package report_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/tide-whisperer/report"
+)
+
+func Test_DailyTotals(t *testing.T) {
+	totals := report.NewDailyTotals(nil)
+
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours float64) string {
+		return day.Add(time.Duration(hours * float64(time.Hour))).Format(time.RFC3339)
+	}
+
+	data := []map[string]interface{}{
+		// 1 U/h from 20:00 to 04:00 local, at UTC-5
+		{"type": "basal", "time": at(25), "timezoneOffset": -300, "rate": 1.0, "duration": int64(8 * time.Hour / time.Millisecond)},
+		{"type": "basal", "time": at(34), "timezoneOffset": -300, "deliveryType": "suspend", "duration": int64(time.Hour / time.Millisecond)},
+		{"type": "bolus", "time": at(17), "timezoneOffset": -300, "normal": 2.0, "extended": 1.5, "duration": int64(time.Hour / time.Millisecond)},
+		{"type": "bolus", "time": at(30), "timezoneOffset": -300, "normal": 3.0},
+		{"type": "insulin", "time": at(31), "timezoneOffset": -300, "dose": map[string]interface{}{"total": 10.0, "units": "Units"}},
+		{"type": "wizard", "time": at(17), "timezoneOffset": -300, "carbInput": 45.0},
+		{"type": "food", "time": at(30), "timezoneOffset": -300, "nutrition": map[string]interface{}{"carbohydrate": map[string]interface{}{"net": 20.0}}},
+		{"type": "cbg", "time": at(30), "timezoneOffset": -300, "value": 5.5, "units": "mmol/L"},
+	}
+	for _, d := range data {
+		totals.Add(d)
+	}
+
+	result := totals.Result()
+	if len(result) != 2 {
+		t.Fatalf("DailyTotals returned %d days, expected 2: %+v", len(result), result)
+	}
+
+	first, second := result[0], result[1]
+	if first.Date != "2020-01-01" || first.Basal != 4 || first.Bolus != 3.5 || first.Carbs != 45 || first.TotalInsulin != 7.5 {
+		t.Errorf("DailyTotals returned %+v for the first day", first)
+	}
+	if math.Abs(first.BasalPercentage-53.33) > 0.01 {
+		t.Errorf("DailyTotals returned basal percentage %f", first.BasalPercentage)
+	}
+	if second.Date != "2020-01-02" || second.Basal != 4 || second.Bolus != 3 || second.Insulin != 10 || second.Carbs != 20 || second.TotalInsulin != 17 {
+		t.Errorf("DailyTotals returned %+v for the second day", second)
+	}
+}
+
+func Test_DailyTotals_Location(t *testing.T) {
+	totals := report.NewDailyTotals(time.FixedZone("test", 10*60*60))
+	totals.Add(map[string]interface{}{"type": "bolus", "time": "2020-01-01T20:00:00Z", "timezoneOffset": 0, "normal": 1.0})
+
+	if result := totals.Result(); len(result) != 1 || result[0].Date != "2020-01-02" {
+		t.Errorf("DailyTotals returned %+v, expected the bolus on the day in the location", result)
+	}
+}
@@ -0,0 +1,201 @@
+package store
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/tidepool-org/tide-whisperer/datum"
+)
+
+// BucketSizes are the values of the `bucket` parameter. Buckets are aligned to UTC.
+var BucketSizes = map[string]time.Duration{
+	"15m": 15 * time.Minute,
+	"1h":  time.Hour,
+	"1d":  24 * time.Hour,
+}
+
+// BucketAggregations are the values of the `agg` parameter. All but count aggregate the blood glucose
+// `value` of cbg and smbg data.
+var BucketAggregations = []string{"mean", "min", "max", "median", "count"}
+
+// bucketValueTypes are the types whose `value` may be aggregated
+var bucketValueTypes = []string{"cbg", "smbg"}
+
+// bucketAccumulators are the accumulators of the aggregations calculated by the server
+var bucketAccumulators = map[string]string{"mean": "$avg", "min": "$min", "max": "$max"}
+
+type (
+	// BucketParams are the parameters of GetDataBuckets
+	BucketParams struct {
+		Size        time.Duration
+		Aggregation string
+		Units       string
+	}
+
+	// Bucket is the aggregated value and number of data of a type in the time bucket starting at Start.
+	// Value is not set for the count aggregation.
+	Bucket struct {
+		Type  string    `json:"type"`
+		Start time.Time `json:"start"`
+		Count int64     `json:"count"`
+		Value *float64  `json:"value,omitempty"`
+	}
+
+	// bucketGroup is the result of bucketPipeline for a bucket, in mg/dL
+	bucketGroup struct {
+		ID struct {
+			Type  string    `bson:"type"`
+			Start time.Time `bson:"start"`
+		} `bson:"_id"`
+		Count  int64     `bson:"count"`
+		Value  float64   `bson:"value"`
+		Values []float64 `bson:"values"`
+	}
+)
+
+// ParseBucketParams parses the `bucket`, `agg` and `units` parameters. The aggregation defaults to mean,
+// and all aggregations but count are only valid for the bucketValueTypes.
+func ParseBucketParams(q url.Values) (*BucketParams, error) {
+	size, ok := BucketSizes[q.Get("bucket")]
+	if !ok {
+		return nil, errors.New("bucket parameter not valid")
+	}
+
+	aggregation := "mean"
+	if value := q.Get("agg"); value != "" {
+		if !contains(value, BucketAggregations) {
+			return nil, errors.New("agg parameter not valid")
+		}
+		aggregation = value
+	}
+
+	if types := q.Get("type"); aggregation != "count" && types != "" {
+		for _, typ := range parseTypes(types) {
+			if !contains(typ, bucketValueTypes) {
+				return nil, errors.New("type parameter not valid for agg parameter")
+			}
+		}
+	}
+
+	units, err := ParseBloodGlucoseUnits(q.Get("units"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &BucketParams{Size: size, Aggregation: aggregation, Units: units}, nil
+}
+
+// bucketTypes returns the types to aggregate for the parameters. Values are aggregated for cbg unless
+// other types are requested.
+func bucketTypes(p *Params, b *BucketParams) []string {
+	types := p.Types
+	if len(types) == 0 || types[0] == "" {
+		if b.Aggregation == "count" {
+			return nil
+		}
+		types = []string{"cbg"}
+	}
+
+	included := []string{}
+	for _, typ := range types {
+		if !contains(typ, p.ExcludeTypes) {
+			included = append(included, typ)
+		}
+	}
+	return included
+}
+
+// bucketPipeline returns the aggregation pipeline grouping the data matching the query by type and
+// time bucket. Medians are calculated from the values pushed for each bucket, as the $median
+// accumulator needs a newer server.
+func bucketPipeline(query bson.M, b *BucketParams) []bson.M {
+	timeMillis := bson.M{"$toLong": "$time"}
+	group := bson.M{
+		"_id": bson.M{
+			"type":  "$type",
+			"start": bson.M{"$toDate": bson.M{"$subtract": bson.A{timeMillis, bson.M{"$mod": bson.A{timeMillis, int64(b.Size / time.Millisecond)}}}}},
+		},
+		"count": bson.M{"$sum": 1},
+	}
+
+	pipeline := []bson.M{{"$match": query}}
+	switch b.Aggregation {
+	case "count":
+	case "median":
+		group["values"] = bson.M{"$push": bloodGlucoseMgdLExpression("value")}
+	default:
+		group["value"] = bson.M{bucketAccumulators[b.Aggregation]: bloodGlucoseMgdLExpression("value")}
+	}
+	if b.Aggregation != "count" {
+		pipeline = append(pipeline, bson.M{"$match": bson.M{"value": bson.M{"$type": "number"}}})
+	}
+
+	return append(pipeline,
+		bson.M{"$group": group},
+		bson.M{"$sort": bson.D{{Key: "_id.type", Value: 1}, {Key: "_id.start", Value: 1}}},
+	)
+}
+
+// bucket returns the bucket of the group with its value in the units
+func (g bucketGroup) bucket(b *BucketParams) Bucket {
+	bucket := Bucket{Type: g.ID.Type, Start: g.ID.Start.UTC(), Count: g.Count}
+	switch b.Aggregation {
+	case "count":
+		return bucket
+	case "median":
+		sort.Float64s(g.Values)
+		if len(g.Values) == 0 {
+			return bucket
+		}
+		middle := len(g.Values) / 2
+		g.Value = g.Values[middle]
+		if len(g.Values)%2 == 0 {
+			g.Value = (g.Values[middle-1] + g.Values[middle]) / 2
+		}
+	}
+	value := datum.BloodGlucoseInUnits(g.Value, b.Units)
+	bucket.Value = &value
+	return bucket
+}
+
+// GetDataBuckets returns the user's data matching the parameters aggregated into time buckets, ordered
+// by type then time
+func (c *MongoStoreClient) GetDataBuckets(p *Params, b *BucketParams) ([]Bucket, error) {
+	types := bucketTypes(p, b)
+	if types != nil && len(types) == 0 {
+		return []Bucket{}, nil
+	}
+	query := generateMongoQuery(p)
+	if len(types) > 0 {
+		query["type"] = bson.M{"$in": types}
+	}
+
+	buckets := []Bucket{}
+	pipeline := bucketPipeline(query, b)
+	for _, collectionName := range collectionNamesForParams(&Params{Types: types, ExcludeTypes: p.ExcludeTypes}) {
+		cursor, err := c.collectionByName(collectionName).Aggregate(c.context, pipeline)
+		if err != nil {
+			return nil, err
+		}
+
+		var groups []bucketGroup
+		if err = cursor.All(c.context, &groups); err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			buckets = append(buckets, group.bucket(b))
+		}
+	}
+
+	sort.SliceStable(buckets, func(i, j int) bool {
+		if buckets[i].Type != buckets[j].Type {
+			return buckets[i].Type < buckets[j].Type
+		}
+		return buckets[i].Start.Before(buckets[j].Start)
+	})
+	return buckets, nil
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestStore_ParseBucketParams(t *testing.T) {
+	b, err := ParseBucketParams(url.Values{"bucket": []string{"1h"}, "type": []string{"cbg,smbg"}})
+	if err != nil {
+		t.Fatalf("ParseBucketParams returned error %s", err)
+	}
+	if expected := (BucketParams{Size: time.Hour, Aggregation: "mean", Units: UnitsMgdL}); *b != expected {
+		t.Errorf("ParseBucketParams returned %+v, expected %+v", *b, expected)
+	}
+
+	b, err = ParseBucketParams(url.Values{"bucket": []string{"1d"}, "agg": []string{"count"}, "type": []string{"bolus"}, "units": []string{"mmol/L"}})
+	if err != nil {
+		t.Fatalf("ParseBucketParams returned error %s", err)
+	}
+	if expected := (BucketParams{Size: 24 * time.Hour, Aggregation: "count", Units: UnitsMmolL}); *b != expected {
+		t.Errorf("ParseBucketParams returned %+v, expected %+v", *b, expected)
+	}
+}
+
+func TestStore_ParseBucketParams_Invalid(t *testing.T) {
+	tests := []url.Values{
+		{},
+		{"bucket": []string{"5m"}},
+		{"bucket": []string{"1h"}, "agg": []string{"sum"}},
+		{"bucket": []string{"1h"}, "agg": []string{"max"}, "type": []string{"cbg,bolus"}},
+		{"bucket": []string{"1h"}, "units": []string{"mg"}},
+	}
+	for _, test := range tests {
+		if _, err := ParseBucketParams(test); err == nil {
+			t.Errorf("ParseBucketParams(%v) did not return an error", test)
+		}
+	}
+}
+
+func TestStore_bucketTypes(t *testing.T) {
+	if types := bucketTypes(&Params{Types: []string{""}}, &BucketParams{Aggregation: "mean"}); !cmp.Equal(types, []string{"cbg"}) {
+		t.Errorf("bucketTypes returned %v for mean of no types", types)
+	}
+	if types := bucketTypes(&Params{Types: []string{""}}, &BucketParams{Aggregation: "count"}); types != nil {
+		t.Errorf("bucketTypes returned %v for count of no types", types)
+	}
+	if types := bucketTypes(&Params{Types: []string{"smbg"}}, &BucketParams{Aggregation: "median"}); !cmp.Equal(types, []string{"smbg"}) {
+		t.Errorf("bucketTypes returned %v for median of smbg", types)
+	}
+}
+
+func TestStore_bucketPipeline(t *testing.T) {
+	query := bson.M{"_userId": "abc123"}
+	timeMillis := bson.M{"$toLong": "$time"}
+	expectedID := bson.M{
+		"type":  "$type",
+		"start": bson.M{"$toDate": bson.M{"$subtract": bson.A{timeMillis, bson.M{"$mod": bson.A{timeMillis, int64(900000)}}}}},
+	}
+
+	pipeline := bucketPipeline(query, &BucketParams{Size: 15 * time.Minute, Aggregation: "max"})
+	if len(pipeline) != 4 {
+		t.Fatalf("bucketPipeline returned %d stages, expected 4", len(pipeline))
+	}
+	group := pipeline[2]["$group"].(bson.M)
+	if diff := cmp.Diff(expectedID, group["_id"]); diff != "" {
+		t.Errorf("bucketPipeline group _id mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(bson.M{"$max": bloodGlucoseMgdLExpression("value")}, group["value"]); diff != "" {
+		t.Errorf("bucketPipeline group value mismatch (-want +got):\n%s", diff)
+	}
+
+	pipeline = bucketPipeline(query, &BucketParams{Size: 15 * time.Minute, Aggregation: "count"})
+	if len(pipeline) != 3 {
+		t.Fatalf("bucketPipeline returned %d stages for count, expected 3", len(pipeline))
+	}
+	if _, ok := pipeline[1]["$group"].(bson.M)["value"]; ok {
+		t.Errorf("bucketPipeline aggregates values for count")
+	}
+}
+
+func TestStore_bucketGroup_bucket(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	group := bucketGroup{Count: 4, Values: []float64{180, 90, 270, 126}}
+	group.ID.Type = "cbg"
+	group.ID.Start = start
+
+	bucket := group.bucket(&BucketParams{Aggregation: "median", Units: UnitsMgdL})
+	if bucket.Type != "cbg" || !bucket.Start.Equal(start) || bucket.Count != 4 || bucket.Value == nil || *bucket.Value != 153 {
+		t.Errorf("bucket returned %+v for median", bucket)
+	}
+
+	group.Value = 180.1559
+	if bucket = group.bucket(&BucketParams{Aggregation: "mean", Units: UnitsMmolL}); bucket.Value == nil || *bucket.Value < 9.99 || *bucket.Value > 10.01 {
+		t.Errorf("bucket returned %+v for mean in mmol/L", bucket)
+	}
+	if bucket = group.bucket(&BucketParams{Aggregation: "count"}); bucket.Value != nil {
+		t.Errorf("bucket returned a value for count")
+	}
+}
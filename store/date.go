@@ -0,0 +1,104 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+const dateOnlyFormat = "2006-01-02"
+
+// minEpochMillisDigits is the fewest digits of an epoch milliseconds date, from 1973-03-03, so that
+// a year e.g. 2015, a compact date e.g. 20151010 or epoch seconds aren't read as milliseconds
+const minEpochMillisDigits = 12
+
+// relativeDateUnits are the units of relative dates e.g. `-14d`
+var relativeDateUnits = map[byte]time.Duration{
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// parseDate parses the value of a date parameter, which is one of
+//   - an RFC3339 date/time e.g. 2015-10-10T15:00:00.000Z
+//   - `now`, or a time relative to now in minutes, hours, days or weeks e.g. -14d or -6h
+//   - epoch milliseconds of at least minEpochMillisDigits digits e.g. 1444489200000
+//   - a date e.g. 2015-10-10, in the location or UTC if it is nil. The date is the start of the day,
+//     or the last millisecond of the day if end is set, so that a range of dates includes the whole
+//     of the last day.
+//
+// An empty value returns the zero time.
+func parseDate(value string, now time.Time, location *time.Location, end bool) (time.Time, error) {
+	if value == "now" {
+		return now.UTC(), nil
+	}
+	if duration, ok := parseRelativeDate(value); ok {
+		return now.Add(duration).UTC(), nil
+	}
+	if isDigits(value) {
+		if len(value) < minEpochMillisDigits {
+			return time.Time{}, errors.New("epoch milliseconds date is too short")
+		}
+		millis, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.UnixMilli(millis).UTC(), nil
+	}
+	if len(value) == len(dateOnlyFormat) {
+		if location == nil {
+			location = time.UTC
+		}
+		date, err := time.ParseInLocation(dateOnlyFormat, value, location)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if end {
+			date = date.AddDate(0, 0, 1).Add(-time.Millisecond)
+		}
+		return date.UTC(), nil
+	}
+	return cleanDateString(value)
+}
+
+// parseRelativeDate parses a signed number of relative date units e.g. -14d
+func parseRelativeDate(value string) (time.Duration, bool) {
+	if len(value) < 3 || (value[0] != '-' && value[0] != '+') {
+		return 0, false
+	}
+	unit, ok := relativeDateUnits[value[len(value)-1]]
+	if !ok || !isDigits(value[1:len(value)-1]) {
+		return 0, false
+	}
+	count, err := strconv.ParseInt(value[:len(value)-1], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(count) * unit, true
+}
+
+func isDigits(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDateRange parses the startDate and endDate parameters
+func parseDateRange(startValue string, endValue string, now time.Time, location *time.Location) (Date, error) {
+	start, err := parseDate(startValue, now, location, false)
+	if err != nil {
+		return Date{}, errors.New("startDate parameter not valid")
+	}
+	end, err := parseDate(endValue, now, location, true)
+	if err != nil {
+		return Date{}, errors.New("endDate parameter not valid")
+	}
+	return Date{start, end}, nil
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestStore_parseDate(t *testing.T) {
+	now := time.Date(2021, 3, 14, 15, 9, 26, 535000000, time.UTC)
+	losAngeles, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatalf("Unable to load location: %s", err)
+	}
+
+	tests := []struct {
+		value    string
+		location *time.Location
+		end      bool
+		expected time.Time
+	}{
+		{value: "", expected: time.Time{}},
+		{value: "2015-10-10T15:00:00.000Z", expected: time.Date(2015, 10, 10, 15, 0, 0, 0, time.UTC)},
+		{value: "2015-10-10T08:00:00-07:00", location: losAngeles, expected: time.Date(2015, 10, 10, 15, 0, 0, 0, time.UTC)},
+		{value: "now", expected: now},
+		{value: "-14d", expected: now.AddDate(0, 0, -14)},
+		{value: "-6h", expected: now.Add(-6 * time.Hour)},
+		{value: "+30m", expected: now.Add(30 * time.Minute)},
+		{value: "-2w", expected: now.AddDate(0, 0, -14)},
+		{value: "1444489200000", expected: time.Date(2015, 10, 10, 15, 0, 0, 0, time.UTC)},
+		{value: "100000000000", expected: time.Date(1973, 3, 3, 9, 46, 40, 0, time.UTC)},
+		{value: "2021-03-14", expected: time.Date(2021, 3, 14, 0, 0, 0, 0, time.UTC)},
+		{value: "2021-03-14", end: true, expected: time.Date(2021, 3, 14, 23, 59, 59, 999000000, time.UTC)},
+		// Daylight saving time starts in Los Angeles on 2021-03-14, so the day is 23 hours long
+		{value: "2021-03-14", location: losAngeles, expected: time.Date(2021, 3, 14, 8, 0, 0, 0, time.UTC)},
+		{value: "2021-03-14", location: losAngeles, end: true, expected: time.Date(2021, 3, 15, 6, 59, 59, 999000000, time.UTC)},
+	}
+	for _, test := range tests {
+		date, err := parseDate(test.value, now, test.location, test.end)
+		if err != nil {
+			t.Errorf("parseDate(%q) returned error %s", test.value, err)
+		} else if !date.Equal(test.expected) {
+			t.Errorf("parseDate(%q) returned %s, expected %s", test.value, date, test.expected)
+		}
+	}
+
+	for _, value := range []string{"blah", "-14", "-d", "-14y", "14d", "2021-13-01", "2021/03/14", "99999999999999999999", "2015", "20151010", "1444489200"} {
+		if _, err := parseDate(value, now, nil, false); err == nil {
+			t.Errorf("parseDate(%q) should have returned an error", value)
+		}
+	}
+}
+
+func TestStore_GetParams_DateRange(t *testing.T) {
+	query := url.Values{
+		":userID":   []string{"1122334455"},
+		"startDate": []string{"2021-03-01"},
+		"endDate":   []string{"2021-03-14"},
+		"timezone":  []string{"America/Los_Angeles"},
+	}
+
+	params, err := GetParams(query, &SchemaVersion{Minimum: 1, Maximum: 3})
+	if err != nil {
+		t.Fatalf("GetParams returned error %s", err)
+	}
+	if expected := time.Date(2021, 3, 1, 8, 0, 0, 0, time.UTC); !params.Date.Start.Equal(expected) {
+		t.Errorf("Unexpected start date %s, expected %s", params.Date.Start, expected)
+	}
+	if expected := time.Date(2021, 3, 15, 6, 59, 59, 999000000, time.UTC); !params.Date.End.Equal(expected) {
+		t.Errorf("Unexpected end date %s, expected %s", params.Date.End, expected)
+	}
+
+	before := time.Now()
+	params, err = GetParams(url.Values{":userID": []string{"1122334455"}, "startDate": []string{"-1d"}, "endDate": []string{"now"}}, &SchemaVersion{Minimum: 1, Maximum: 3})
+	if err != nil {
+		t.Fatalf("GetParams returned error %s", err)
+	}
+	if params.Date.End.Before(before) || params.Date.End.Sub(params.Date.Start) != 24*time.Hour {
+		t.Errorf("Unexpected relative date range %s to %s", params.Date.Start, params.Date.End)
+	}
+
+	for key, value := range map[string]string{"startDate": "yesterday", "endDate": "2021-03-32", "timezone": "Mars/Olympus_Mons"} {
+		if _, err := GetParams(url.Values{":userID": []string{"1122334455"}, key: []string{value}}, &SchemaVersion{Minimum: 1, Maximum: 3}); err == nil || err.Error() != key+" parameter not valid" {
+			t.Errorf("GetParams with %s=%s returned error %v", key, value, err)
+		}
+	}
+}
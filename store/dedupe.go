@@ -0,0 +1,417 @@
+package store
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaximumDedupeTolerance bounds the tolerance of the dedupe rules, as the data within the tolerance is
+// held in memory while it is read
+const MaximumDedupeTolerance = time.Hour
+
+//go:embed dedupe_rules.json
+var defaultDedupeRules []byte
+
+// DataDedupeRules are the rules that drop overlapping records of the same type from different uploads.
+// They default to dedupe_rules.json, and are replaced by the config if set.
+var DataDedupeRules = mustParseDedupeRules(defaultDedupeRules)
+
+type (
+	// DedupeRules are the dedupe rules, each of different types
+	DedupeRules []DedupeRule
+
+	// DedupeRule drops records of its Types that are within the tolerance of a record of the same type
+	// from a different upload, keeping the record of the source earliest in the Priority. Sources not
+	// in the Priority come last, and of records of equal priority the first read is kept.
+	DedupeRule struct {
+		Name             string         `json:"name"`
+		Description      string         `json:"description"`
+		Types            []string       `json:"types"`
+		ToleranceSeconds int            `json:"toleranceSeconds"`
+		Priority         []DedupeSource `json:"priority,omitempty"`
+	}
+
+	// DedupeSource matches the records of a source by a field, whose value starts with the Prefix, or
+	// which is not set if Missing
+	DedupeSource struct {
+		Field   string `json:"field"`
+		Prefix  string `json:"prefix,omitempty"`
+		Missing bool   `json:"missing,omitempty"`
+	}
+
+	// dedupeRecord is a record held by a dedupeIterator until no later record can overlap it
+	dedupeRecord struct {
+		raw        bson.Raw
+		collection string
+		time       time.Time
+		typ        string
+		uploadID   string
+		rule       *DedupeRule
+		priority   int
+		dropped    bool
+	}
+
+	// dedupeIterator is a StorageIterator over results sorted by `time` that drops the overlapping
+	// records of the dedupe rules. Records are held until a record beyond the largest tolerance is
+	// read, so only the data within the tolerance is held in memory. The fields read only to dedupe
+	// the records are stripped before they are returned.
+	dedupeIterator struct {
+		iter      *mergeIterator
+		rules     DedupeRules
+		tolerance time.Duration
+		strip     [][]string
+		held      []*dedupeRecord
+		last      time.Time
+		done      bool
+		current   *dedupeRecord
+		err       error
+	}
+)
+
+func mustParseDedupeRules(data []byte) DedupeRules {
+	rules := DedupeRules{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		panic(fmt.Sprintf("dedupe rules not valid: %s", err))
+	}
+	if err := rules.Validate(); err != nil {
+		panic(fmt.Sprintf("dedupe rules not valid: %s", err))
+	}
+	return rules
+}
+
+// Validate checks that the rules are named uniquely, that each type is deduped by one rule, and that
+// each tolerance is within MaximumDedupeTolerance
+func (r DedupeRules) Validate() error {
+	names := map[string]bool{}
+	types := map[string]bool{}
+	for _, rule := range r {
+		if rule.Name == "" {
+			return errors.New("dedupe rule name is missing")
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("dedupe rule %s is duplicated", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if len(rule.Types) == 0 {
+			return fmt.Errorf("dedupe rule %s types are missing", rule.Name)
+		}
+		for _, typ := range rule.Types {
+			if typ == "upload" {
+				return fmt.Errorf("dedupe rule %s type %s not valid", rule.Name, typ)
+			}
+			if types[typ] {
+				return fmt.Errorf("dedupe rule %s type %s is duplicated", rule.Name, typ)
+			}
+			types[typ] = true
+		}
+
+		if rule.ToleranceSeconds <= 0 || rule.tolerance() > MaximumDedupeTolerance {
+			return fmt.Errorf("dedupe rule %s tolerance not valid", rule.Name)
+		}
+		for _, source := range rule.Priority {
+			if source.Field == "" || strings.Contains(source.Field, "$") || strings.HasPrefix(source.Field, "_") {
+				return fmt.Errorf("dedupe rule %s priority field %q not valid", rule.Name, source.Field)
+			}
+		}
+	}
+	return nil
+}
+
+// tolerance returns the largest tolerance of the rules
+func (r DedupeRules) tolerance() time.Duration {
+	var tolerance time.Duration
+	for index := range r {
+		if ruleTolerance := r[index].tolerance(); ruleTolerance > tolerance {
+			tolerance = ruleTolerance
+		}
+	}
+	return tolerance
+}
+
+func (r *DedupeRule) tolerance() time.Duration {
+	return time.Duration(r.ToleranceSeconds) * time.Second
+}
+
+// priority returns the index of the first source of the priority that matches the record, or the
+// length of the priority if none do
+func (r *DedupeRule) priority(raw bson.Raw) int {
+	for index, source := range r.Priority {
+		value, err := raw.LookupErr(strings.Split(source.Field, ".")...)
+		if source.Missing {
+			if err != nil || value.Type == bsontype.Null {
+				return index
+			}
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if stringValue, ok := value.StringValueOK(); ok && strings.HasPrefix(stringValue, source.Prefix) {
+			return index
+		}
+	}
+	return len(r.Priority)
+}
+
+// parseDedupe parses the `dedupe` parameter, which defaults to true
+func parseDedupe(q url.Values) (bool, error) {
+	values, ok := q["dedupe"]
+	if !ok {
+		return true, nil
+	}
+	if len(values) < 1 {
+		return false, errors.New("dedupe parameter not valid")
+	}
+	dedupe, err := strconv.ParseBool(values[len(values)-1])
+	if err != nil {
+		return false, errors.New("dedupe parameter not valid")
+	}
+	return dedupe, nil
+}
+
+// dedupeRulesForParams returns the dedupe rules of any of the types read by the parameters. The latest
+// results are not deduped.
+func dedupeRulesForParams(p *Params) DedupeRules {
+	if !p.Dedupe || p.Latest {
+		return nil
+	}
+	var rules DedupeRules
+	for _, rule := range DataDedupeRules {
+		for _, typ := range rule.Types {
+			if typeRequested(p, typ) {
+				rules = append(rules, rule)
+				break
+			}
+		}
+	}
+	return rules
+}
+
+// dedupeProjection adds the fields needed to dedupe the records to a projection of requested fields,
+// and returns the paths of the added fields, which are stripped from the results
+func dedupeProjection(projection bson.M, p *Params, rules DedupeRules) (bson.M, [][]string) {
+	if len(p.Fields) == 0 {
+		return projection, nil
+	}
+
+	fields := []string{"uploadId"}
+	for _, rule := range rules {
+		for _, source := range rule.Priority {
+			fields = append(fields, source.Field)
+		}
+	}
+
+	dedupe := bson.M{}
+	for field, value := range projection {
+		dedupe[field] = value
+	}
+	var strip [][]string
+	for _, field := range fields {
+		if _, ok := dedupe[field]; ok {
+			continue
+		}
+		// Requesting both a path and one of its parents or children is a path collision in MongoDB
+		collides := false
+		for other := range dedupe {
+			if strings.HasPrefix(field, other+".") || strings.HasPrefix(other, field+".") {
+				collides = true
+				break
+			}
+		}
+		if collides {
+			continue
+		}
+		dedupe[field] = 1
+		strip = append(strip, strings.Split(field, "."))
+	}
+	return dedupe, strip
+}
+
+// findDedupeChainStart returns the time from which the page after p.Cursor is read, so that its records
+// are deduped as they are in an unpaged read. Records overlap those of the same type within a tolerance,
+// and a record dropped by an earlier one doesn't drop later records, so the drops chain back from the
+// cursor. The records of the deduped types are read back from the cursor until one is beyond the largest
+// tolerance of the next, as no record before that gap can affect the records after it. Uploads are not
+// deduped, so only the data collection is read.
+func (c *MongoStoreClient) findDedupeChainStart(p *Params, sort int, rules DedupeRules) (time.Time, error) {
+	types := []string{}
+	for _, rule := range rules {
+		types = append(types, rule.Types...)
+	}
+	query := generateMongoQuery(p)
+	appendAndQuery(query, bson.M{"type": bson.M{"$in": types}})
+	if sort == SortDescending {
+		appendAndQuery(query, bson.M{"time": bson.M{"$gte": p.Cursor.Time}})
+	} else {
+		appendAndQuery(query, bson.M{"time": bson.M{"$lte": p.Cursor.Time}})
+	}
+
+	opts := options.Find().
+		SetProjection(bson.M{"_id": 0, "time": 1}).
+		SetSort(bson.D{{Key: "time", Value: -sort}})
+	cursor, err := dataCollection(c).Find(c.context, query, opts)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer cursor.Close(c.context)
+
+	return dedupeChainStart(c.context, cursor, p.Cursor.Time, rules.tolerance())
+}
+
+// dedupeChainStart reads the records of the cursor, sorted back from the time from, until one is beyond
+// the tolerance of the record after it, and returns the time of the earliest record within the chain
+func dedupeChainStart(ctx context.Context, cursor *mongo.Cursor, from time.Time, tolerance time.Duration) (time.Time, error) {
+	start := from
+	for cursor.Next(ctx) {
+		recordTime := documentTime(cursor.Current)
+		if timeDifference(start, recordTime) > tolerance {
+			break
+		}
+		start = recordTime
+	}
+	return start, cursor.Err()
+}
+
+func newDedupeIterator(iter *mergeIterator, rules DedupeRules, strip [][]string) *dedupeIterator {
+	return &dedupeIterator{iter: iter, rules: rules, tolerance: rules.tolerance(), strip: strip}
+}
+
+func (l *dedupeIterator) Next(ctx context.Context) bool {
+	for {
+		// The first held record is returned once no later record can overlap it
+		if len(l.held) > 0 && (l.done || timeDifference(l.held[0].time, l.last) > l.tolerance) {
+			record := l.held[0]
+			l.held = l.held[1:]
+			if record.dropped {
+				continue
+			}
+			raw, err := stripPaths(record.raw, l.strip)
+			if err != nil {
+				l.err = err
+				l.done = true
+				l.held = nil
+				return false
+			}
+			record.raw = raw
+			l.current = record
+			return true
+		}
+		if l.done {
+			return false
+		}
+		if !l.iter.Next(ctx) {
+			l.done = true
+			continue
+		}
+		raw, collection := l.iter.currentRaw()
+		l.hold(append(bson.Raw(nil), raw...), collection)
+	}
+}
+
+// hold adds the record to the held records, dropping either it or the held records it overlaps
+func (l *dedupeIterator) hold(raw bson.Raw, collection string) {
+	record := &dedupeRecord{raw: raw, collection: collection, time: documentTime(raw)}
+	record.typ, _ = raw.Lookup("type").StringValueOK()
+	record.uploadID, _ = raw.Lookup("uploadId").StringValueOK()
+	l.last = record.time
+	l.held = append(l.held, record)
+
+	for index := range l.rules {
+		if contains(record.typ, l.rules[index].Types) {
+			record.rule = &l.rules[index]
+			record.priority = record.rule.priority(raw)
+			break
+		}
+	}
+	if record.rule == nil || record.time.IsZero() || record.uploadID == "" {
+		return
+	}
+
+	for _, other := range l.held[:len(l.held)-1] {
+		if other.dropped || other.typ != record.typ || other.uploadID == "" || other.uploadID == record.uploadID ||
+			timeDifference(other.time, record.time) > record.rule.tolerance() {
+			continue
+		}
+		if record.priority < other.priority {
+			other.dropped = true
+		} else {
+			record.dropped = true
+			return
+		}
+	}
+}
+
+func (l *dedupeIterator) Decode(result interface{}) error {
+	return bson.Unmarshal(l.current.raw, result)
+}
+
+func (l *dedupeIterator) Close(ctx context.Context) error {
+	return l.iter.Close(ctx)
+}
+
+// Err returns the first error encountered by the deduped cursors
+func (l *dedupeIterator) Err() error {
+	if l.err != nil {
+		return l.err
+	}
+	return l.iter.Err()
+}
+
+// currentRaw returns the current document and the name of the collection it was read from
+func (l *dedupeIterator) currentRaw() (bson.Raw, string) {
+	return l.current.raw, l.current.collection
+}
+
+func timeDifference(a time.Time, b time.Time) time.Duration {
+	if a.After(b) {
+		return a.Sub(b)
+	}
+	return b.Sub(a)
+}
+
+// stripPaths removes the paths from the document, along with any parents left empty
+func stripPaths(raw bson.Raw, paths [][]string) (bson.Raw, error) {
+	if len(paths) == 0 {
+		return raw, nil
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		doc = stripPath(doc, path)
+	}
+	return bson.Marshal(doc)
+}
+
+func stripPath(doc bson.D, path []string) bson.D {
+	stripped := make(bson.D, 0, len(doc))
+	for _, elem := range doc {
+		if elem.Key == path[0] {
+			if len(path) == 1 {
+				continue
+			}
+			if child, ok := elem.Value.(bson.D); ok {
+				if child = stripPath(child, path[1:]); len(child) == 0 {
+					continue
+				}
+				elem.Value = child
+			}
+		}
+		stripped = append(stripped, elem)
+	}
+	return stripped
+}
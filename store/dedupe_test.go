@@ -0,0 +1,193 @@
+package store
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func dedupedValues(t *testing.T, sort int, rules DedupeRules, strip [][]string, data []interface{}) []bson.M {
+	iter := newDedupeIterator(newMergeIterator([]*mongo.Cursor{newTestCursor(t, data...)}, []string{dataCollectionName}, sort), rules, strip)
+	defer iter.Close(context.Background())
+
+	results := []bson.M{}
+	for iter.Next(context.Background()) {
+		var result bson.M
+		if err := iter.Decode(&result); err != nil {
+			t.Error("Decode error")
+		}
+		delete(result, "time")
+		results = append(results, result)
+	}
+	if err := iter.Err(); err != nil {
+		t.Errorf("Unexpected error %s", err)
+	}
+	return results
+}
+
+func TestStore_DataDedupeRules_default(t *testing.T) {
+	names := []string{}
+	for _, rule := range DataDedupeRules {
+		names = append(names, rule.Name)
+	}
+	if diff := cmp.Diff([]string{"smbg", "insulin"}, names); diff != "" {
+		t.Errorf("Unexpected default rules (-want +have):\n%s", diff)
+	}
+}
+
+func TestStore_DedupeRules_Validate(t *testing.T) {
+	valid := func() DedupeRule {
+		return DedupeRule{Name: "smbg", Types: []string{"smbg"}, ToleranceSeconds: 60, Priority: []DedupeSource{{Field: "origin", Missing: true}}}
+	}
+	if err := (DedupeRules{valid()}).Validate(); err != nil {
+		t.Errorf("Validate returned error %s", err)
+	}
+
+	invalid := map[string]func(rule *DedupeRule){
+		"dedupe rule name is missing":                  func(rule *DedupeRule) { rule.Name = "" },
+		"dedupe rule smbg types are missing":           func(rule *DedupeRule) { rule.Types = nil },
+		"dedupe rule smbg type upload not valid":       func(rule *DedupeRule) { rule.Types = []string{"upload"} },
+		"dedupe rule smbg type cbg is duplicated":      func(rule *DedupeRule) { rule.Types = []string{"cbg", "cbg"} },
+		"dedupe rule smbg tolerance not valid":         func(rule *DedupeRule) { rule.ToleranceSeconds = 0 },
+		`dedupe rule smbg priority field "" not valid`: func(rule *DedupeRule) { rule.Priority = []DedupeSource{{}} },
+	}
+	for expected, modify := range invalid {
+		rule := valid()
+		modify(&rule)
+		if err := (DedupeRules{rule}).Validate(); err == nil || err.Error() != expected {
+			t.Errorf("Validate returned error %v, expected %s", err, expected)
+		}
+	}
+
+	tooLong := valid()
+	tooLong.ToleranceSeconds = int(MaximumDedupeTolerance/time.Second) + 1
+	if err := (DedupeRules{tooLong}).Validate(); err == nil {
+		t.Error("Validate returned no error for a tolerance beyond the maximum")
+	}
+	if err := (DedupeRules{valid(), valid()}).Validate(); err == nil || err.Error() != "dedupe rule smbg is duplicated" {
+		t.Errorf("Validate returned error %v for duplicated rules", err)
+	}
+}
+
+func TestStore_GetParams_Dedupe(t *testing.T) {
+	schema := &SchemaVersion{Minimum: 1, Maximum: 3}
+	params, err := GetParams(url.Values{":userID": []string{"abc123"}}, schema)
+	if err != nil {
+		t.Fatalf("GetParams returned error %s", err)
+	}
+	if !params.Dedupe {
+		t.Error("Missing dedupe by default")
+	}
+
+	if params, _ = GetParams(url.Values{":userID": []string{"abc123"}, "dedupe": []string{"false"}}, schema); params.Dedupe {
+		t.Error("Unexpected dedupe with dedupe=false")
+	}
+
+	if _, err := GetParams(url.Values{":userID": []string{"abc123"}, "dedupe": []string{"blah"}}, schema); err == nil || err.Error() != "dedupe parameter not valid" {
+		t.Errorf("GetParams returned error %v for an invalid dedupe", err)
+	}
+}
+
+func TestStore_dedupeRulesForParams(t *testing.T) {
+	ruleNames := func(p *Params) []string {
+		names := []string{}
+		for _, rule := range dedupeRulesForParams(p) {
+			names = append(names, rule.Name)
+		}
+		return names
+	}
+
+	if diff := cmp.Diff([]string{"smbg", "insulin"}, ruleNames(&Params{Dedupe: true, Types: []string{""}})); diff != "" {
+		t.Errorf("Unexpected rules for all types (-want +have):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"insulin"}, ruleNames(&Params{Dedupe: true, Types: []string{"cbg", "bolus"}})); diff != "" {
+		t.Errorf("Unexpected rules for types (-want +have):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"smbg"}, ruleNames(&Params{Dedupe: true, ExcludeTypes: []string{"basal", "bolus", "insulin"}})); diff != "" {
+		t.Errorf("Unexpected rules for excluded types (-want +have):\n%s", diff)
+	}
+	if rules := dedupeRulesForParams(&Params{Types: []string{"smbg"}}); rules != nil {
+		t.Errorf("Unexpected rules %v without dedupe", rules)
+	}
+	if rules := dedupeRulesForParams(&Params{Dedupe: true, Latest: true}); rules != nil {
+		t.Errorf("Unexpected rules %v for latest", rules)
+	}
+}
+
+func TestStore_dedupeProjection(t *testing.T) {
+	rules := DedupeRules{{Name: "insulin", Types: []string{"bolus"}, ToleranceSeconds: 60, Priority: []DedupeSource{{Field: "origin.name", Prefix: "com.loopkit"}}}}
+
+	exclusions := bson.M{"_id": 0, "_userId": 0}
+	if projection, strip := dedupeProjection(exclusions, &Params{}, rules); !cmp.Equal(exclusions, projection) || strip != nil {
+		t.Errorf("Unexpected projection %v, strip %v without fields", projection, strip)
+	}
+
+	projection, strip := dedupeProjection(bson.M{"time": 1, "type": 1, "normal": 1}, &Params{Fields: []string{"normal"}}, rules)
+	if diff := cmp.Diff(bson.M{"time": 1, "type": 1, "normal": 1, "uploadId": 1, "origin.name": 1}, projection); diff != "" {
+		t.Errorf("Unexpected projection (-want +have):\n%s", diff)
+	}
+	if diff := cmp.Diff([][]string{{"uploadId"}, {"origin", "name"}}, strip); diff != "" {
+		t.Errorf("Unexpected strip (-want +have):\n%s", diff)
+	}
+
+	// Requested fields, or their parents, are not stripped
+	projection, strip = dedupeProjection(bson.M{"time": 1, "type": 1, "uploadId": 1, "origin": 1}, &Params{Fields: []string{"uploadId", "origin"}}, rules)
+	if diff := cmp.Diff(bson.M{"time": 1, "type": 1, "uploadId": 1, "origin": 1}, projection); diff != "" || strip != nil {
+		t.Errorf("Unexpected projection (-want +have):\n%s, strip %v", diff, strip)
+	}
+}
+
+func TestStore_dedupeIterator(t *testing.T) {
+	baseTime, _ := time.Parse(time.RFC3339, "2021-03-15T00:00:00.000Z")
+	rules := DedupeRules{
+		{Name: "smbg", Types: []string{"smbg"}, ToleranceSeconds: 60, Priority: []DedupeSource{{Field: "origin", Missing: true}}},
+		{Name: "insulin", Types: []string{"bolus"}, ToleranceSeconds: 120, Priority: []DedupeSource{{Field: "origin.name", Prefix: "com.loopkit"}}},
+	}
+	app := bson.M{"name": "com.example.app"}
+	loop := bson.M{"name": "com.loopkit.Loop"}
+
+	data := []interface{}{
+		// The meter reading replaces the app reading read before it
+		bson.M{"time": baseTime, "type": "smbg", "uploadId": "app", "origin": app, "value": "smbg1"},
+		bson.M{"time": baseTime.Add(30 * time.Second), "type": "smbg", "uploadId": "meter", "value": "smbg2"},
+		// Records of the same upload, or of other types, are not duplicates
+		bson.M{"time": baseTime.Add(40 * time.Second), "type": "smbg", "uploadId": "meter", "value": "smbg3"},
+		bson.M{"time": baseTime.Add(50 * time.Second), "type": "cbg", "uploadId": "app", "value": "cbg1"},
+		// Beyond the tolerance
+		bson.M{"time": baseTime.Add(5 * time.Minute), "type": "smbg", "uploadId": "app", "origin": app, "value": "smbg4"},
+		// The Loop bolus replaces the pump bolus read after it, within the insulin tolerance
+		bson.M{"time": baseTime.Add(10 * time.Minute), "type": "bolus", "uploadId": "loop", "origin": loop, "value": "bolus1"},
+		bson.M{"time": baseTime.Add(11 * time.Minute), "type": "bolus", "uploadId": "pump", "value": "bolus2"},
+		// Of equal priority, the first read is kept
+		bson.M{"time": baseTime.Add(20 * time.Minute), "type": "bolus", "uploadId": "pump", "value": "bolus3"},
+		bson.M{"time": baseTime.Add(20 * time.Minute), "type": "bolus", "uploadId": "pump2", "value": "bolus4"},
+	}
+
+	values := []string{}
+	for _, result := range dedupedValues(t, SortAscending, rules, nil, data) {
+		values = append(values, result["value"].(string))
+	}
+	if diff := cmp.Diff([]string{"smbg2", "smbg3", "cbg1", "smbg4", "bolus1", "bolus3"}, values); diff != "" {
+		t.Errorf("Unexpected deduped values (-want +have):\n%s", diff)
+	}
+}
+
+func TestStore_dedupeIterator_strip(t *testing.T) {
+	baseTime, _ := time.Parse(time.RFC3339, "2021-03-15T00:00:00.000Z")
+	rules := DedupeRules{{Name: "insulin", Types: []string{"bolus"}, ToleranceSeconds: 60, Priority: []DedupeSource{{Field: "origin.name", Prefix: "com.loopkit"}}}}
+
+	data := []interface{}{
+		bson.M{"time": baseTime, "type": "bolus", "uploadId": "pump", "normal": 1.5},
+		bson.M{"time": baseTime.Add(time.Second), "type": "bolus", "uploadId": "loop", "origin": bson.M{"name": "com.loopkit.Loop"}, "normal": 1.4},
+	}
+
+	expected := []bson.M{{"type": "bolus", "normal": 1.4}}
+	if diff := cmp.Diff(expected, dedupedValues(t, SortAscending, rules, [][]string{{"uploadId"}, {"origin", "name"}}, data)); diff != "" {
+		t.Errorf("Unexpected deduped results (-want +have):\n%s", diff)
+	}
+}
@@ -0,0 +1,220 @@
+package store
+
+import (
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	// Device is a device that contributed data to a user's account, with its most recent upload's
+	// manufacturers, model and serial number, when its data was first and last seen, and the types of
+	// its data. DataSources are the cloud data sources that imported data from the device.
+	Device struct {
+		DeviceID      string             `json:"deviceId"`
+		Manufacturers []string           `json:"manufacturers,omitempty"`
+		Model         string             `json:"model,omitempty"`
+		SerialNumber  string             `json:"serialNumber,omitempty"`
+		FirstSeen     time.Time          `json:"firstSeen"`
+		LastSeen      time.Time          `json:"lastSeen"`
+		Count         int64              `json:"count"`
+		Types         []string           `json:"types"`
+		DataSources   []DeviceDataSource `json:"dataSources,omitempty"`
+	}
+
+	// DeviceDataSource is a cloud data source of a device, from the data_sources collection
+	DeviceDataSource struct {
+		ID             string     `json:"id,omitempty"`
+		ProviderType   string     `json:"providerType,omitempty"`
+		ProviderName   string     `json:"providerName,omitempty"`
+		State          string     `json:"state,omitempty"`
+		LastImportTime *time.Time `json:"lastImportTime,omitempty"`
+	}
+
+	// deviceGroup is the data of a device in a collection
+	deviceGroup struct {
+		DeviceID  string    `bson:"_id"`
+		Count     int64     `bson:"count"`
+		FirstSeen time.Time `bson:"firstSeen"`
+		LastSeen  time.Time `bson:"lastSeen"`
+		Types     []string  `bson:"types"`
+		UploadIDs []string  `bson:"uploadIds"`
+	}
+
+	// deviceUpload is the device metadata of the most recent upload of a device
+	deviceUpload struct {
+		DeviceID      string   `bson:"_id"`
+		Manufacturers []string `bson:"manufacturers"`
+		Model         string   `bson:"model"`
+		SerialNumber  string   `bson:"serialNumber"`
+	}
+)
+
+// devicePipeline returns the aggregation pipeline grouping the data matching the query by deviceId.
+// Data without a deviceId is not grouped.
+func devicePipeline(query bson.M) []bson.M {
+	return []bson.M{
+		{"$match": query},
+		{"$match": bson.M{"deviceId": bson.M{"$type": "string"}}},
+		{"$group": bson.M{
+			"_id":       "$deviceId",
+			"count":     bson.M{"$sum": 1},
+			"firstSeen": bson.M{"$min": "$time"},
+			"lastSeen":  bson.M{"$max": "$time"},
+			"types":     bson.M{"$addToSet": "$type"},
+			"uploadIds": bson.M{"$addToSet": "$uploadId"},
+		}},
+	}
+}
+
+// deviceUploadPipeline returns the aggregation pipeline reading the device metadata of the most
+// recent upload of each of the devices, regardless of when it was uploaded
+func deviceUploadPipeline(userID string, deviceIDs []string) []bson.M {
+	return []bson.M{
+		{"$match": bson.M{
+			"_userId":  userID,
+			"_active":  true,
+			"type":     "upload",
+			"deviceId": bson.M{"$in": deviceIDs},
+		}},
+		{"$sort": bson.M{"time": -1}},
+		{"$group": bson.M{
+			"_id":           "$deviceId",
+			"manufacturers": bson.M{"$first": "$deviceManufacturers"},
+			"model":         bson.M{"$first": "$deviceModel"},
+			"serialNumber":  bson.M{"$first": "$deviceSerialNumber"},
+		}},
+	}
+}
+
+// mergeDeviceGroups adds the device groups of a collection to the groups, combining the groups of
+// the same device
+func mergeDeviceGroups(groups map[string]*deviceGroup, other []deviceGroup) {
+	for idx := range other {
+		group, ok := groups[other[idx].DeviceID]
+		if !ok {
+			groups[other[idx].DeviceID] = &other[idx]
+			continue
+		}
+		group.Count += other[idx].Count
+		if other[idx].FirstSeen.Before(group.FirstSeen) {
+			group.FirstSeen = other[idx].FirstSeen
+		}
+		if other[idx].LastSeen.After(group.LastSeen) {
+			group.LastSeen = other[idx].LastSeen
+		}
+		for _, typ := range other[idx].Types {
+			if !contains(typ, group.Types) {
+				group.Types = append(group.Types, typ)
+			}
+		}
+		for _, uploadID := range other[idx].UploadIDs {
+			if !contains(uploadID, group.UploadIDs) {
+				group.UploadIDs = append(group.UploadIDs, uploadID)
+			}
+		}
+	}
+}
+
+// deviceDataSources returns the data sources, as read by GetCBGCloudDataSources, that imported any
+// of the uploads
+func deviceDataSources(dataSources []bson.M, uploadIDs []string) []DeviceDataSource {
+	var deviceDataSources []DeviceDataSource
+	for _, dataSource := range dataSources {
+		dataSetIds, _ := dataSource["dataSetIds"].(primitive.A)
+		imported := false
+		for _, dataSetID := range dataSetIds {
+			if id, ok := dataSetID.(string); ok && contains(id, uploadIDs) {
+				imported = true
+				break
+			}
+		}
+		if !imported {
+			continue
+		}
+
+		deviceDataSource := DeviceDataSource{}
+		deviceDataSource.ID, _ = dataSource["id"].(string)
+		deviceDataSource.ProviderType, _ = dataSource["providerType"].(string)
+		deviceDataSource.ProviderName, _ = dataSource["providerName"].(string)
+		deviceDataSource.State, _ = dataSource["state"].(string)
+		if lastImportTime, ok := dataSource["lastImportTime"].(primitive.DateTime); ok {
+			t := lastImportTime.Time().UTC()
+			deviceDataSource.LastImportTime = &t
+		}
+		deviceDataSources = append(deviceDataSources, deviceDataSource)
+	}
+	return deviceDataSources
+}
+
+// GetDevices returns the devices that contributed the user's data matching the parameters, across
+// both the deviceData and deviceDataSets collections, most recently seen first
+func (c *MongoStoreClient) GetDevices(p *Params) ([]Device, error) {
+	groups := map[string]*deviceGroup{}
+	pipeline := devicePipeline(generateMongoQuery(p))
+	for _, collectionName := range collectionNamesForParams(p) {
+		cursor, err := c.collectionByName(collectionName).Aggregate(c.context, pipeline)
+		if err != nil {
+			return nil, err
+		}
+		var results []deviceGroup
+		if err = cursor.All(c.context, &results); err != nil {
+			return nil, err
+		}
+		mergeDeviceGroups(groups, results)
+	}
+
+	devices := []Device{}
+	if len(groups) == 0 {
+		return devices, nil
+	}
+
+	deviceIDs := make([]string, 0, len(groups))
+	for deviceID := range groups {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	cursor, err := dataSetsCollection(c).Aggregate(c.context, deviceUploadPipeline(p.UserID, deviceIDs))
+	if err != nil {
+		return nil, err
+	}
+	var uploads []deviceUpload
+	if err = cursor.All(c.context, &uploads); err != nil {
+		return nil, err
+	}
+
+	dataSources, err := c.GetCBGCloudDataSources(p.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		sort.Strings(group.Types)
+		device := Device{
+			DeviceID:    group.DeviceID,
+			FirstSeen:   group.FirstSeen,
+			LastSeen:    group.LastSeen,
+			Count:       group.Count,
+			Types:       group.Types,
+			DataSources: deviceDataSources(dataSources, group.UploadIDs),
+		}
+		for _, upload := range uploads {
+			if upload.DeviceID == group.DeviceID {
+				device.Manufacturers = upload.Manufacturers
+				device.Model = upload.Model
+				device.SerialNumber = upload.SerialNumber
+				break
+			}
+		}
+		devices = append(devices, device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		if !devices[i].LastSeen.Equal(devices[j].LastSeen) {
+			return devices[i].LastSeen.After(devices[j].LastSeen)
+		}
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+	return devices, nil
+}
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestStore_devicePipeline(t *testing.T) {
+	query := bson.M{"_userId": "abc123", "_active": true}
+	expected := []bson.M{
+		{"$match": query},
+		{"$match": bson.M{"deviceId": bson.M{"$type": "string"}}},
+		{"$group": bson.M{
+			"_id":       "$deviceId",
+			"count":     bson.M{"$sum": 1},
+			"firstSeen": bson.M{"$min": "$time"},
+			"lastSeen":  bson.M{"$max": "$time"},
+			"types":     bson.M{"$addToSet": "$type"},
+			"uploadIds": bson.M{"$addToSet": "$uploadId"},
+		}},
+	}
+	if diff := cmp.Diff(expected, devicePipeline(query)); diff != "" {
+		t.Errorf("Unexpected device pipeline (-want +have):\n%s", diff)
+	}
+}
+
+func TestStore_mergeDeviceGroups(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2021, 3, d, 0, 0, 0, 0, time.UTC) }
+
+	groups := map[string]*deviceGroup{}
+	mergeDeviceGroups(groups, []deviceGroup{
+		{DeviceID: "dev123", Count: 10, FirstSeen: day(2), LastSeen: day(5), Types: []string{"cbg"}, UploadIDs: []string{"upload1"}},
+		{DeviceID: "dev456", Count: 1, FirstSeen: day(1), LastSeen: day(1), Types: []string{"smbg"}},
+	})
+	mergeDeviceGroups(groups, []deviceGroup{
+		{DeviceID: "dev123", Count: 2, FirstSeen: day(1), LastSeen: day(3), Types: []string{"upload", "cbg"}, UploadIDs: []string{"upload1", "upload2"}},
+	})
+
+	expected := map[string]*deviceGroup{
+		"dev123": {DeviceID: "dev123", Count: 12, FirstSeen: day(1), LastSeen: day(5), Types: []string{"cbg", "upload"}, UploadIDs: []string{"upload1", "upload2"}},
+		"dev456": {DeviceID: "dev456", Count: 1, FirstSeen: day(1), LastSeen: day(1), Types: []string{"smbg"}},
+	}
+	if diff := cmp.Diff(expected, groups); diff != "" {
+		t.Errorf("Unexpected merged device groups (-want +have):\n%s", diff)
+	}
+}
+
+func TestStore_deviceDataSources(t *testing.T) {
+	lastImportTime := time.Date(2021, 3, 14, 12, 0, 0, 0, time.UTC)
+	dataSources := []bson.M{
+		{
+			"id":             "source1",
+			"providerType":   "oauth",
+			"providerName":   "dexcom",
+			"state":          "connected",
+			"dataSetIds":     primitive.A{"upload1", "upload2"},
+			"lastImportTime": primitive.NewDateTimeFromTime(lastImportTime),
+		},
+		{
+			"id":           "source2",
+			"providerType": "oauth",
+			"providerName": "abbott",
+			"dataSetIds":   primitive.A{"upload3"},
+		},
+	}
+
+	expected := []DeviceDataSource{
+		{ID: "source1", ProviderType: "oauth", ProviderName: "dexcom", State: "connected", LastImportTime: &lastImportTime},
+	}
+	if diff := cmp.Diff(expected, deviceDataSources(dataSources, []string{"upload2"})); diff != "" {
+		t.Errorf("Unexpected device data sources (-want +have):\n%s", diff)
+	}
+	if sources := deviceDataSources(dataSources, []string{"upload4"}); sources != nil {
+		t.Errorf("Unexpected device data sources %v", sources)
+	}
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ExplainSelection is the value of the `explain` parameter that explains the data source selection
+// of a query instead of returning its data
+const ExplainSelection = "selection"
+
+// SelectionRuleUploadID is the name of the rule of an explicit upload filter, which bypasses the data
+// source rules that don't apply to it
+const SelectionRuleUploadID = "uploadId"
+
+// DedupeScope is the scope of the `dedupe` parameter, which applies to the data read record by record, but
+// not to the aggregations computed by MongoDB
+const DedupeScope = "the data, agp and daily endpoints are deduped, except their latest results; " +
+	"the Nightscout, facets, devices, summary, buckets and uploads endpoints are not"
+
+type (
+	// Selection explains which data sources a query selects: the rules that were considered, the data
+	// they exclude, the resulting filter of the data, and the rules that dedupe the data read and the
+	// endpoints they apply to
+	Selection struct {
+		Rules       []SelectionRule      `json:"rules"`
+		Exclusions  []SelectionExclusion `json:"exclusions"`
+		Collections []string             `json:"collections"`
+		Filter      json.RawMessage      `json:"filter"`
+		Dedupe      DedupeRules          `json:"dedupe"`
+		DedupeScope string               `json:"dedupeScope"`
+	}
+
+	// SelectionRule is a data source selection rule, whether it fired for the query, and why
+	SelectionRule struct {
+		Name   string `json:"name"`
+		Fired  bool   `json:"fired"`
+		Reason string `json:"reason"`
+	}
+
+	// SelectionExclusion is data excluded by a rule. Data is excluded if it matches all of the set
+	// fields: one of its types, its match, one of its UploadIDs or none of its ExceptUploadIDs, and
+	// one of its TimeRanges.
+	SelectionExclusion struct {
+		Rule            string               `json:"rule"`
+		Reason          string               `json:"reason"`
+		Types           []string             `json:"types,omitempty"`
+		Match           bson.M               `json:"match,omitempty"`
+		UploadIDs       []string             `json:"uploadIds,omitempty"`
+		ExceptUploadIDs []string             `json:"exceptUploadIds,omitempty"`
+		TimeRanges      []SelectionTimeRange `json:"timeRanges,omitempty"`
+	}
+
+	// SelectionTimeRange is a range of time, open ended if the start or end is not set
+	SelectionTimeRange struct {
+		Start *time.Time `json:"start,omitempty"`
+		End   *time.Time `json:"end,omitempty"`
+	}
+)
+
+// parseExplain parses the `explain` parameter, which may only be ExplainSelection
+func parseExplain(value string) (string, error) {
+	if value != "" && value != ExplainSelection {
+		return "", errors.New("explain parameter not valid")
+	}
+	return value, nil
+}
+
+func selectionTimeRange(date Date) SelectionTimeRange {
+	timeRange := SelectionTimeRange{}
+	if !date.Start.IsZero() {
+		start := date.Start
+		timeRange.Start = &start
+	}
+	if !date.End.IsZero() {
+		end := date.End
+		timeRange.End = &end
+	}
+	return timeRange
+}
+
+// ExplainDataSelection explains the data source selection of the parameters, once the data sources
+// have been selected for the query
+func ExplainDataSelection(p *Params) (*Selection, error) {
+	filter, err := bson.MarshalExtJSON(generateMongoQuery(p), false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	selection := &Selection{
+		Rules:       []SelectionRule{},
+		Exclusions:  []SelectionExclusion{},
+		Collections: collectionNamesForParams(p),
+		Filter:      filter,
+		Dedupe:      dedupeRulesForParams(p),
+		DedupeScope: DedupeScope,
+	}
+	if selection.Dedupe == nil {
+		selection.Dedupe = DedupeRules{}
+	}
+
+	// An explicit upload filter bypasses the rules that don't apply to it
+	bypassed := []string{}
+	for _, sourceSelection := range p.SourceSelections {
+		if len(p.UploadIDs) > 0 && !sourceSelection.ApplyToUploadIDs {
+			bypassed = append(bypassed, sourceSelection.Rule)
+			continue
+		}
+		selection.Rules = append(selection.Rules, SelectionRule{Name: sourceSelection.Rule, Fired: sourceSelection.Fired, Reason: sourceSelection.Reason})
+		if exclusion := sourceSelection.Exclusion; exclusion != nil {
+			selectionExclusion := SelectionExclusion{
+				Rule:            sourceSelection.Rule,
+				Reason:          sourceSelection.Reason,
+				Types:           exclusion.Types,
+				Match:           exclusion.Match,
+				UploadIDs:       exclusion.UploadIDs,
+				ExceptUploadIDs: exclusion.ExceptUploadIDs,
+			}
+			for _, date := range exclusion.TimeRanges {
+				selectionExclusion.TimeRanges = append(selectionExclusion.TimeRanges, selectionTimeRange(date))
+			}
+			selection.Exclusions = append(selection.Exclusions, selectionExclusion)
+		}
+	}
+
+	switch {
+	case len(p.UploadIDs) == 0:
+		selection.Rules = append(selection.Rules, SelectionRule{Name: SelectionRuleUploadID, Fired: false, Reason: "uploadId parameter is not set"})
+	case len(bypassed) == 0:
+		selection.Rules = append(selection.Rules, SelectionRule{Name: SelectionRuleUploadID, Fired: true, Reason: "uploadId parameter is set"})
+	default:
+		selection.Rules = append(selection.Rules, SelectionRule{Name: SelectionRuleUploadID, Fired: true, Reason: "uploadId parameter is set, so the " + strings.Join(bypassed, " and ") + " rules are not applied"})
+	}
+
+	return selection, nil
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestStore_GetParams_Explain(t *testing.T) {
+	params, err := GetParams(url.Values{":userID": []string{"abc123"}, "explain": []string{"selection"}}, &SchemaVersion{Minimum: 1, Maximum: 3})
+	if err != nil {
+		t.Fatalf("GetParams returned error %s", err)
+	}
+	if params.Explain != ExplainSelection {
+		t.Errorf("Unexpected explain %q", params.Explain)
+	}
+
+	if _, err := GetParams(url.Values{":userID": []string{"abc123"}, "explain": []string{"query"}}, &SchemaVersion{Minimum: 1, Maximum: 3}); err == nil || err.Error() != "explain parameter not valid" {
+		t.Errorf("GetParams returned error %v for an unknown explain", err)
+	}
+}
+
+func TestStore_ExplainDataSelection(t *testing.T) {
+	earliestDataTime, _ := time.Parse(time.RFC3339, "2015-10-06T15:00:00Z")
+	latestDataTime, _ := time.Parse(time.RFC3339, "2016-12-12T02:00:00Z")
+	medtronicDate, _ := time.Parse(time.RFC3339, "2017-01-01T00:00:00Z")
+
+	params := allParams()
+	params.SourceSelections = append([]SourceSelection{carelinkSelection()}, params.SourceSelections...)
+	params.SourceSelections = append(params.SourceSelections, SourceSelection{Rule: "dexcom", Reason: "the user has no data from the winning source"})
+	for index, reason := range []string{"carelink reason", "cbgFilter reason", "medtronic reason"} {
+		params.SourceSelections[index].Reason = reason
+	}
+	selection, err := ExplainDataSelection(params)
+	if err != nil {
+		t.Fatalf("ExplainDataSelection returned error %s", err)
+	}
+
+	expectedRules := []SelectionRule{
+		{Name: "carelink", Fired: true, Reason: "carelink reason"},
+		{Name: "cbgFilter", Fired: true, Reason: "cbgFilter reason"},
+		{Name: "medtronic", Fired: true, Reason: "medtronic reason"},
+		{Name: "dexcom", Fired: false, Reason: "the user has no data from the winning source"},
+		{Name: SelectionRuleUploadID, Fired: false, Reason: "uploadId parameter is not set"},
+	}
+	if diff := cmp.Diff(expectedRules, selection.Rules); diff != "" {
+		t.Errorf("Unexpected rules (-want +have):\n%s", diff)
+	}
+
+	expectedExclusions := []SelectionExclusion{
+		{Rule: "carelink", Reason: "carelink reason", Match: bson.M{"source": "carelink"}},
+		{
+			Rule:            "cbgFilter",
+			Reason:          "cbgFilter reason",
+			Types:           []string{"cbg"},
+			ExceptUploadIDs: []string{"123", "456", "789", "ABC", "DEF", "GHI", "JKL"},
+			TimeRanges: []SelectionTimeRange{
+				{Start: &earliestDataTime, End: &latestDataTime},
+				{Start: ptr(earliestDataTime.Add(48 * time.Hour)), End: ptr(latestDataTime.Add(48 * time.Hour))},
+			},
+		},
+		{
+			Rule:       "medtronic",
+			Reason:     "medtronic reason",
+			Types:      []string{"basal", "bolus", "cbg"},
+			UploadIDs:  []string{"555666777", "888999000"},
+			TimeRanges: []SelectionTimeRange{{Start: &medtronicDate}},
+		},
+	}
+	if diff := cmp.Diff(expectedExclusions, selection.Exclusions); diff != "" {
+		t.Errorf("Unexpected exclusions (-want +have):\n%s", diff)
+	}
+
+	if diff := cmp.Diff([]string{dataCollectionName}, selection.Collections); diff != "" {
+		t.Errorf("Unexpected collections (-want +have):\n%s", diff)
+	}
+	var filter map[string]interface{}
+	if err := json.Unmarshal(selection.Filter, &filter); err != nil {
+		t.Fatalf("Filter is not valid JSON: %s", err)
+	}
+	if filter["_userId"] != "abc123" || filter["source"] == nil || filter["$and"] == nil {
+		t.Errorf("Unexpected filter %s", selection.Filter)
+	}
+	if len(selection.Dedupe) != 0 || selection.DedupeScope != DedupeScope {
+		t.Errorf("Unexpected dedupe %v, scope %q without the dedupe parameter", selection.Dedupe, selection.DedupeScope)
+	}
+}
+
+func TestStore_ExplainDataSelection_uploadId(t *testing.T) {
+	params := allParams()
+	params.UploadIDs = []string{"xyz123"}
+	params.SourceSelections = append([]SourceSelection{{Rule: "carelink", Reason: "carelink parameter is true", ApplyToUploadIDs: true}}, params.SourceSelections...)
+	selection, err := ExplainDataSelection(params)
+	if err != nil {
+		t.Fatalf("ExplainDataSelection returned error %s", err)
+	}
+
+	expectedRules := []SelectionRule{
+		{Name: "carelink", Fired: false, Reason: "carelink parameter is true"},
+		{Name: SelectionRuleUploadID, Fired: true, Reason: "uploadId parameter is set, so the cbgFilter and medtronic rules are not applied"},
+	}
+	if diff := cmp.Diff(expectedRules, selection.Rules); diff != "" {
+		t.Errorf("Unexpected rules (-want +have):\n%s", diff)
+	}
+	if len(selection.Exclusions) != 0 {
+		t.Errorf("Unexpected exclusions %v", selection.Exclusions)
+	}
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// FacetNames are the facets returned by GetDataFacets
+var FacetNames = []string{"type", "subType", "deviceId", "origin.name", "dosingDecision.reason"}
+
+// typeFacets are the facets that count a field of data of a single type, e.g. dosingDecision.reason
+// counts the `reason` of dosingDecision data
+var typeFacets = map[string]string{"dosingDecision.reason": "dosingDecision"}
+
+type (
+	// Facet is the number of records with a value of a field, and the range of their times
+	Facet struct {
+		Value    string    `bson:"_id" json:"value"`
+		Count    int64     `bson:"count" json:"count"`
+		Earliest time.Time `bson:"earliest" json:"earliest"`
+		Latest   time.Time `bson:"latest" json:"latest"`
+	}
+
+	// Facets are the facets of a user's data by facet name, each ordered by value
+	Facets map[string][]Facet
+)
+
+// facetPath returns the field path of the facet, and the type of data it is restricted to, if any
+func facetPath(name string) (string, string) {
+	if typ, ok := typeFacets[name]; ok {
+		return strings.TrimPrefix(name, typ+"."), typ
+	}
+	return name, ""
+}
+
+// facetOutputName returns the name of the facet in the $facet stage, which does not allow "."
+func facetOutputName(name string) string {
+	return strings.ReplaceAll(name, ".", "_")
+}
+
+// facetPipeline returns the aggregation pipeline counting each of the FacetNames for the data
+// matching the query, in a single document. Records without a string value for a facet's field
+// are not counted in that facet.
+func facetPipeline(query bson.M) []bson.M {
+	facets := bson.M{}
+	for _, name := range FacetNames {
+		path, typ := facetPath(name)
+		match := bson.M{path: bson.M{"$type": "string"}}
+		if typ != "" {
+			match["type"] = typ
+		}
+		facets[facetOutputName(name)] = []bson.M{
+			{"$match": match},
+			{"$group": bson.M{
+				"_id":      "$" + path,
+				"count":    bson.M{"$sum": 1},
+				"earliest": bson.M{"$min": "$time"},
+				"latest":   bson.M{"$max": "$time"},
+			}},
+		}
+	}
+
+	return []bson.M{
+		{"$match": query},
+		{"$facet": facets},
+	}
+}
+
+// mergeFacets adds the facets of another collection to the facets, combining the counts and
+// times of equal values
+func mergeFacets(facets Facets, other Facets) {
+	for name, otherFacets := range other {
+		for _, otherFacet := range otherFacets {
+			merged := false
+			for idx := range facets[name] {
+				facet := &facets[name][idx]
+				if facet.Value != otherFacet.Value {
+					continue
+				}
+				facet.Count += otherFacet.Count
+				if otherFacet.Earliest.Before(facet.Earliest) {
+					facet.Earliest = otherFacet.Earliest
+				}
+				if otherFacet.Latest.After(facet.Latest) {
+					facet.Latest = otherFacet.Latest
+				}
+				merged = true
+				break
+			}
+			if !merged {
+				facets[name] = append(facets[name], otherFacet)
+			}
+		}
+	}
+}
+
+// GetDataFacets returns the facets of the user's data matching the parameters, across both
+// the deviceData and deviceDataSets collections
+func (c *MongoStoreClient) GetDataFacets(p *Params) (Facets, error) {
+	facets := Facets{}
+	for _, name := range FacetNames {
+		facets[name] = []Facet{}
+	}
+
+	pipeline := facetPipeline(generateMongoQuery(p))
+	for _, collectionName := range collectionNamesForParams(p) {
+		cursor, err := c.collectionByName(collectionName).Aggregate(c.context, pipeline)
+		if err != nil {
+			return nil, err
+		}
+
+		var results []map[string][]Facet
+		if err = cursor.All(c.context, &results); err != nil {
+			return nil, err
+		}
+
+		for _, result := range results {
+			collectionFacets := Facets{}
+			for _, name := range FacetNames {
+				collectionFacets[name] = result[facetOutputName(name)]
+			}
+			mergeFacets(facets, collectionFacets)
+		}
+	}
+
+	for name := range facets {
+		sort.Slice(facets[name], func(i, j int) bool { return facets[name][i].Value < facets[name][j].Value })
+	}
+	return facets, nil
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestStore_facetPath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		typ  string
+	}{
+		{"type", "type", ""},
+		{"origin.name", "origin.name", ""},
+		{"dosingDecision.reason", "reason", "dosingDecision"},
+	}
+
+	for _, test := range tests {
+		path, typ := facetPath(test.name)
+		if path != test.path || typ != test.typ {
+			t.Errorf("facetPath(%q) returned %q, %q, expected %q, %q", test.name, path, typ, test.path, test.typ)
+		}
+	}
+}
+
+func TestStore_facetPipeline(t *testing.T) {
+	query := bson.M{"_userId": "abc123", "_active": true}
+	pipeline := facetPipeline(query)
+
+	if len(pipeline) != 2 {
+		t.Fatalf("facetPipeline returned %d stages, expected 2", len(pipeline))
+	}
+	if !cmp.Equal(pipeline[0], bson.M{"$match": query}) {
+		t.Errorf("facetPipeline first stage is %v, expected the query", pipeline[0])
+	}
+
+	facets := pipeline[1]["$facet"].(bson.M)
+	if len(facets) != len(FacetNames) {
+		t.Errorf("facetPipeline returned %d facets, expected %d", len(facets), len(FacetNames))
+	}
+
+	expected := []bson.M{
+		{"$match": bson.M{"reason": bson.M{"$type": "string"}, "type": "dosingDecision"}},
+		{"$group": bson.M{
+			"_id":      "$reason",
+			"count":    bson.M{"$sum": 1},
+			"earliest": bson.M{"$min": "$time"},
+			"latest":   bson.M{"$max": "$time"},
+		}},
+	}
+	if diff := cmp.Diff(expected, facets["dosingDecision_reason"]); diff != "" {
+		t.Errorf("facetPipeline dosingDecision.reason facet mismatch (-want +got):\n%s", diff)
+	}
+	if _, ok := facets["origin_name"]; !ok {
+		t.Errorf("facetPipeline returned no origin.name facet")
+	}
+}
+
+func TestStore_mergeFacets(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	facets := Facets{
+		"deviceId": {
+			{Value: "pump", Count: 2, Earliest: day(2), Latest: day(3)},
+		},
+	}
+	mergeFacets(facets, Facets{
+		"deviceId": {
+			{Value: "pump", Count: 1, Earliest: day(1), Latest: day(2)},
+			{Value: "meter", Count: 3, Earliest: day(4), Latest: day(5)},
+		},
+		"type": {
+			{Value: "upload", Count: 1, Earliest: day(1), Latest: day(1)},
+		},
+	})
+
+	expected := Facets{
+		"deviceId": {
+			{Value: "pump", Count: 3, Earliest: day(1), Latest: day(3)},
+			{Value: "meter", Count: 3, Earliest: day(4), Latest: day(5)},
+		},
+		"type": {
+			{Value: "upload", Count: 1, Earliest: day(1), Latest: day(1)},
+		},
+	}
+	if diff := cmp.Diff(expected, facets); diff != "" {
+		t.Errorf("mergeFacets mismatch (-want +got):\n%s", diff)
+	}
+}
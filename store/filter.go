@@ -0,0 +1,251 @@
+package store
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// FilterEq matches a field equal to the value
+	FilterEq = "eq"
+	// FilterIn matches a field equal to any of the comma separated values, and is the default operator
+	FilterIn = "in"
+	// FilterNin matches a field equal to none of the comma separated values
+	FilterNin = "nin"
+	// FilterGte matches a field greater than or equal to the value
+	FilterGte = "gte"
+	// FilterLte matches a field less than or equal to the value
+	FilterLte = "lte"
+	// FilterExists matches a field that exists, or doesn't exist, as the boolean value
+	FilterExists = "exists"
+
+	// ValueTypeString is the type of string field values
+	ValueTypeString = "string"
+	// ValueTypeNumber is the type of numeric field values
+	ValueTypeNumber = "number"
+	// ValueTypeBoolean is the type of boolean field values
+	ValueTypeBoolean = "boolean"
+	// ValueTypeDate is the type of date field values, in RFC 3339 format
+	ValueTypeDate = "date"
+)
+
+// FilterOperators are the operators of field filters
+var FilterOperators = []string{FilterEq, FilterIn, FilterNin, FilterGte, FilterLte, FilterExists}
+
+// filterValueTypes are the types of the values of field filters
+var filterValueTypes = []string{ValueTypeString, ValueTypeNumber, ValueTypeBoolean, ValueTypeDate}
+
+type (
+	// AllowedFieldFilter is a field that may be filtered on, with the type of its values and the operators
+	// that may be used. All operators may be used if Operators is empty.
+	AllowedFieldFilter struct {
+		ValueType string   `json:"valueType"`
+		Operators []string `json:"operators,omitempty"`
+	}
+
+	// AllowedTypeFieldFilters maps types to the paths of their fields that may be filtered on
+	AllowedTypeFieldFilters map[string]map[string]AllowedFieldFilter
+
+	// FieldCondition is a condition on a field, with values of the field's value type
+	FieldCondition struct {
+		Operator string
+		Values   []interface{}
+	}
+
+	// FieldFilter is a map with field paths and the conditions to filter them by
+	FieldFilter map[string][]FieldCondition
+
+	// TypeFieldFilter is a map with types to which to apply field filters
+	TypeFieldFilter map[string]FieldFilter
+)
+
+// AllowedFieldFilters are the fields that may be filtered on with `<type>.<path>[<operator>]=<values>`
+// parameters, e.g. "dosingDecision.reason=normalBolus,simpleBolus" or "cbg.value[gte]=10". They are
+// replaced by the fieldFilters service configuration, if set.
+var AllowedFieldFilters = AllowedTypeFieldFilters{
+	"dosingDecision": {
+		"reason": {ValueType: ValueTypeString},
+	},
+}
+
+// Validate returns an error if any of the allowed field filters is not valid
+func (a AllowedTypeFieldFilters) Validate() error {
+	for typ, fields := range a {
+		if !validFieldPath(typ) || strings.Contains(typ, ".") {
+			return errors.New("field filter type not valid")
+		}
+		for path, field := range fields {
+			if !validFieldPath(path) {
+				return errors.New("field filter path not valid")
+			}
+			if !contains(field.ValueType, filterValueTypes) {
+				return errors.New("field filter value type not valid")
+			}
+			for _, operator := range field.Operators {
+				if !contains(operator, FilterOperators) {
+					return errors.New("field filter operator not valid")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validFieldPath(path string) bool {
+	return path != "" && !strings.Contains(path, "$") && !strings.Contains(path, "..") &&
+		!strings.HasPrefix(path, ".") && !strings.HasSuffix(path, ".")
+}
+
+// parseTypeFieldFilter parses the field filter parameters of the allowed field filters. Other
+// parameters are ignored.
+func parseTypeFieldFilter(q url.Values) (TypeFieldFilter, error) {
+	keys := make([]string, 0, len(q))
+	for key := range q {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	typeFieldFilter := TypeFieldFilter{}
+	for _, key := range keys {
+		typ, path, operator, ok := splitFieldFilterKey(key)
+		if !ok {
+			continue
+		}
+		allowed, ok := AllowedFieldFilters[typ][path]
+		if !ok {
+			continue
+		}
+
+		value := q.Get(key)
+		if len(value) == 0 {
+			continue
+		}
+		if operator == "" {
+			operator = FilterIn
+		}
+		if !contains(operator, FilterOperators) || (len(allowed.Operators) > 0 && !contains(operator, allowed.Operators)) {
+			return nil, errors.New(key + " parameter not valid")
+		}
+
+		values, err := parseFieldFilterValues(allowed, operator, value)
+		if err != nil {
+			return nil, errors.New(key + " parameter not valid")
+		}
+
+		fieldFilter, ok := typeFieldFilter[typ]
+		if !ok {
+			fieldFilter = FieldFilter{}
+			typeFieldFilter[typ] = fieldFilter
+		}
+		fieldFilter[path] = append(fieldFilter[path], FieldCondition{Operator: operator, Values: values})
+	}
+	return typeFieldFilter, nil
+}
+
+// splitFieldFilterKey splits a `<type>.<path>[<operator>]` parameter name
+func splitFieldFilterKey(key string) (string, string, string, bool) {
+	var operator string
+	if strings.HasSuffix(key, "]") {
+		idx := strings.LastIndex(key, "[")
+		if idx < 0 {
+			return "", "", "", false
+		}
+		operator = key[idx+1 : len(key)-1]
+		key = key[:idx]
+	}
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], operator, true
+}
+
+// parseFieldFilterValues parses the value of a field filter parameter as the values of the operator
+func parseFieldFilterValues(allowed AllowedFieldFilter, operator string, value string) ([]interface{}, error) {
+	if operator == FilterExists {
+		exists, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{exists}, nil
+	}
+
+	rawValues := []string{value}
+	if operator == FilterIn || operator == FilterNin {
+		rawValues = strings.Split(value, ",")
+	}
+
+	values := make([]interface{}, len(rawValues))
+	for idx, rawValue := range rawValues {
+		var err error
+		switch allowed.ValueType {
+		case ValueTypeNumber:
+			values[idx], err = strconv.ParseFloat(rawValue, 64)
+		case ValueTypeBoolean:
+			values[idx], err = strconv.ParseBool(rawValue)
+		case ValueTypeDate:
+			values[idx], err = time.Parse(time.RFC3339Nano, rawValue)
+		default:
+			values[idx] = rawValue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// query returns the query of the condition on a field
+func (f FieldCondition) query() interface{} {
+	switch f.Operator {
+	case FilterEq:
+		return f.Values[0]
+	case FilterNin:
+		return bson.M{"$nin": f.Values}
+	case FilterGte:
+		return bson.M{"$gte": f.Values[0]}
+	case FilterLte:
+		return bson.M{"$lte": f.Values[0]}
+	case FilterExists:
+		return bson.M{"$exists": f.Values[0]}
+	}
+	return bson.M{"$in": f.Values}
+}
+
+// typeFieldFilterQueries returns a query for each condition of the type field filter, which only
+// restricts data of that type. The queries are ordered by type then field, so that the generated
+// query is the same on every request.
+func typeFieldFilterQueries(typeFieldFilter TypeFieldFilter) []bson.M {
+	types := make([]string, 0, len(typeFieldFilter))
+	for typ := range typeFieldFilter {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	var queries []bson.M
+	for _, typ := range types {
+		fields := make([]string, 0, len(typeFieldFilter[typ]))
+		for field := range typeFieldFilter[typ] {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			for _, condition := range typeFieldFilter[typ][field] {
+				queries = append(queries, bson.M{
+					"$or": []bson.M{
+						{"type": bson.M{"$ne": typ}},
+						{field: condition.query()},
+					},
+				})
+			}
+		}
+	}
+	return queries
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func withAllowedFieldFilters(t *testing.T, allowed AllowedTypeFieldFilters) {
+	previous := AllowedFieldFilters
+	AllowedFieldFilters = allowed
+	t.Cleanup(func() { AllowedFieldFilters = previous })
+}
+
+var testAllowedFieldFilters = AllowedTypeFieldFilters{
+	"cbg":            {"value": {ValueType: ValueTypeNumber}},
+	"food":           {"origin.name": {ValueType: ValueTypeString, Operators: []string{FilterEq, FilterIn}}},
+	"bolus":          {"suppressed": {ValueType: ValueTypeBoolean}, "modifiedTime": {ValueType: ValueTypeDate}},
+	"dosingDecision": {"reason": {ValueType: ValueTypeString}},
+}
+
+func TestStore_parseTypeFieldFilter(t *testing.T) {
+	withAllowedFieldFilters(t, testAllowedFieldFilters)
+
+	q := url.Values{
+		"cbg.value[gte]":             []string{"3.9"},
+		"cbg.value[lte]":             []string{"10"},
+		"cbg.sampleInterval":         []string{"100000"},
+		"food.origin.name[eq]":       []string{"Loop"},
+		"bolus.suppressed[exists]":   []string{"false"},
+		"bolus.modifiedTime[gte]":    []string{"2020-01-01T00:00:00Z"},
+		"dosingDecision.reason[nin]": []string{"simpleBolus,watchBolus"},
+		"upload.deviceModel":         []string{"ignored"},
+	}
+
+	typeFieldFilter, err := parseTypeFieldFilter(q)
+	if err != nil {
+		t.Fatalf("parseTypeFieldFilter returned error %s", err)
+	}
+
+	expected := TypeFieldFilter{
+		"cbg":  {"value": {{Operator: FilterGte, Values: []interface{}{3.9}}, {Operator: FilterLte, Values: []interface{}{10.0}}}},
+		"food": {"origin.name": {{Operator: FilterEq, Values: []interface{}{"Loop"}}}},
+		"bolus": {
+			"suppressed":   {{Operator: FilterExists, Values: []interface{}{false}}},
+			"modifiedTime": {{Operator: FilterGte, Values: []interface{}{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}}},
+		},
+		"dosingDecision": {"reason": {{Operator: FilterNin, Values: []interface{}{"simpleBolus", "watchBolus"}}}},
+	}
+	if diff := cmp.Diff(expected, typeFieldFilter); diff != "" {
+		t.Errorf("parseTypeFieldFilter mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestStore_parseTypeFieldFilter_Invalid(t *testing.T) {
+	withAllowedFieldFilters(t, testAllowedFieldFilters)
+
+	tests := []url.Values{
+		{"cbg.value[gte]": []string{"high"}},
+		{"cbg.value[gt]": []string{"10"}},
+		{"food.origin.name[nin]": []string{"Loop"}},
+		{"bolus.suppressed": []string{"maybe"}},
+		{"bolus.modifiedTime[lte]": []string{"2020-01-01"}},
+		{"bolus.suppressed[exists]": []string{"sometimes"}},
+	}
+	for _, test := range tests {
+		if _, err := parseTypeFieldFilter(test); err == nil {
+			t.Errorf("parseTypeFieldFilter(%v) did not return an error", test)
+		}
+	}
+}
+
+func TestStore_AllowedTypeFieldFilters_Validate(t *testing.T) {
+	if err := testAllowedFieldFilters.Validate(); err != nil {
+		t.Errorf("Validate returned error %s", err)
+	}
+
+	tests := []AllowedTypeFieldFilters{
+		{"cbg": {"value": {ValueType: "float"}}},
+		{"cbg": {"value": {ValueType: ValueTypeNumber, Operators: []string{"regex"}}}},
+		{"cbg": {"$where": {ValueType: ValueTypeString}}},
+		{"cbg": {"origin..name": {ValueType: ValueTypeString}}},
+		{"cbg.value": {"units": {ValueType: ValueTypeString}}},
+	}
+	for _, test := range tests {
+		if err := test.Validate(); err == nil {
+			t.Errorf("Validate of %v did not return an error", test)
+		}
+	}
+}
+
+func TestStore_typeFieldFilterQueries(t *testing.T) {
+	queries := typeFieldFilterQueries(TypeFieldFilter{
+		"food": {"origin.name": {{Operator: FilterEq, Values: []interface{}{"Loop"}}}},
+		"cbg":  {"value": {{Operator: FilterGte, Values: []interface{}{3.9}}, {Operator: FilterExists, Values: []interface{}{true}}}},
+	})
+
+	expected := []bson.M{
+		{"$or": []bson.M{{"type": bson.M{"$ne": "cbg"}}, {"value": bson.M{"$gte": 3.9}}}},
+		{"$or": []bson.M{{"type": bson.M{"$ne": "cbg"}}, {"value": bson.M{"$exists": true}}}},
+		{"$or": []bson.M{{"type": bson.M{"$ne": "food"}}, {"origin.name": "Loop"}}},
+	}
+	if diff := cmp.Diff(expected, queries); diff != "" {
+		t.Errorf("typeFieldFilterQueries mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/tidepool-org/tide-whisperer/datum"
+)
+
+const (
+	// UnitsMgdL is mg/dL, the default units of blood glucose in aggregated results
+	UnitsMgdL = datum.UnitsMgdL
+	// UnitsMmolL is mmol/L, the units in which blood glucose is stored
+	UnitsMmolL = datum.UnitsMmolL
+)
+
+// GlucoseThresholds are the bounds of the glucose ranges, in mg/dL. Values below VeryLow are very low,
+// below Low are low, up to High are in the target range, up to VeryHigh are high and above are very high.
+type GlucoseThresholds struct {
+	VeryLow  float64 `json:"veryLow"`
+	Low      float64 `json:"low"`
+	High     float64 `json:"high"`
+	VeryHigh float64 `json:"veryHigh"`
+}
+
+// DefaultGlucoseThresholds are the ranges of the international consensus on time in range
+var DefaultGlucoseThresholds = GlucoseThresholds{VeryLow: 54, Low: 70, High: 180, VeryHigh: 250}
+
+// Validate returns an error if the thresholds are not positive and ascending
+func (g GlucoseThresholds) Validate() error {
+	if g.VeryLow <= 0 || g.Low <= g.VeryLow || g.High <= g.Low || g.VeryHigh <= g.High {
+		return errors.New("glucose thresholds not valid")
+	}
+	return nil
+}
+
+// InUnits returns the thresholds converted to the units
+func (g GlucoseThresholds) InUnits(units string) GlucoseThresholds {
+	return GlucoseThresholds{
+		VeryLow:  datum.BloodGlucoseInUnits(g.VeryLow, units),
+		Low:      datum.BloodGlucoseInUnits(g.Low, units),
+		High:     datum.BloodGlucoseInUnits(g.High, units),
+		VeryHigh: datum.BloodGlucoseInUnits(g.VeryHigh, units),
+	}
+}
+
+// ParseBloodGlucoseUnits parses the `units` parameter of the aggregated endpoints, which defaults to mg/dL
+func ParseBloodGlucoseUnits(value string) (string, error) {
+	switch value {
+	case "", "mg/dL", "mg/dl":
+		return UnitsMgdL, nil
+	case "mmol/L", "mmol/l":
+		return UnitsMmolL, nil
+	}
+	return "", errors.New("units parameter not valid")
+}
+
+// bloodGlucoseMgdLExpression returns the aggregation expression converting the blood glucose field to
+// mg/dL according to the datum's `units`
+func bloodGlucoseMgdLExpression(field string) bson.M {
+	return bson.M{
+		"$cond": bson.A{
+			bson.M{"$in": bson.A{"$units", bson.A{"mmol/L", "mmol/l"}}},
+			bson.M{"$multiply": bson.A{"$" + field, datum.MgdLPerMmolL}},
+			"$" + field,
+		},
+	}
+}
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStore_ParseBloodGlucoseUnits(t *testing.T) {
+	tests := map[string]string{"": UnitsMgdL, "mg/dl": UnitsMgdL, "mg/dL": UnitsMgdL, "mmol/l": UnitsMmolL, "mmol/L": UnitsMmolL}
+	for value, expected := range tests {
+		if units, err := ParseBloodGlucoseUnits(value); err != nil || units != expected {
+			t.Errorf("ParseBloodGlucoseUnits(%q) returned %q, %v, expected %q", value, units, err, expected)
+		}
+	}
+	if _, err := ParseBloodGlucoseUnits("mg"); err == nil {
+		t.Error("ParseBloodGlucoseUnits did not return an error for invalid units")
+	}
+}
+
+func TestStore_GlucoseThresholds(t *testing.T) {
+	if err := DefaultGlucoseThresholds.Validate(); err != nil {
+		t.Errorf("DefaultGlucoseThresholds are not valid: %s", err)
+	}
+	if err := (GlucoseThresholds{VeryLow: 54, Low: 70, High: 60, VeryHigh: 250}).Validate(); err == nil {
+		t.Error("Validate did not return an error for thresholds out of order")
+	}
+
+	thresholds := DefaultGlucoseThresholds.InUnits(UnitsMmolL)
+	if math.Abs(thresholds.Low-3.9) > 0.05 || math.Abs(thresholds.High-10.0) > 0.05 {
+		t.Errorf("InUnits returned %v for mmol/L", thresholds)
+	}
+	if DefaultGlucoseThresholds.InUnits(UnitsMgdL) != DefaultGlucoseThresholds {
+		t.Error("InUnits changed the thresholds for mg/dL")
+	}
+}
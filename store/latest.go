@@ -0,0 +1,133 @@
+package store
+
+import (
+	"errors"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// MaximumLatestCount is the largest number of results per group that may be requested with `latest`
+	MaximumLatestCount = 100
+
+	// LatestByType groups latest results by `type`, the default
+	LatestByType = "type"
+	// LatestByDeviceID groups latest results by `deviceId`
+	LatestByDeviceID = "deviceId"
+	// LatestByUploadID groups latest results by `uploadId`
+	LatestByUploadID = "uploadId"
+)
+
+// parseLatestBy parses the `latestBy` parameter
+func parseLatestBy(value string) (string, error) {
+	switch value {
+	case LatestByType, LatestByDeviceID, LatestByUploadID:
+		return value, nil
+	}
+	return "", errors.New("latestBy parameter not valid")
+}
+
+// latestPipeline returns the aggregation pipeline for the count most recent results of the query for
+// each value of the field, ordered by value then most recent first. The values, e.g. the types, are
+// discovered by the $group stage rather than queried one at a time, so each collection is read in a
+// single round trip. For types, the $match and $sort on the user, type and time use the LatestByType
+// index, so the results are read in index order rather than sorted in memory. The $group still reads
+// every matching result, unless the query has only the user and types, when the server may answer
+// $first with a scan of the distinct index keys. For other fields the sort is done in memory.
+func latestPipeline(query bson.M, field string, count int, projection bson.M) []bson.M {
+	sortStage := bson.M{"$sort": bson.D{{Key: field, Value: 1}, {Key: "time", Value: -1}}}
+
+	latest := bson.M{"$first": "$$ROOT"}
+	if count > 1 {
+		latest = bson.M{"$topN": bson.M{"n": count, "sortBy": bson.M{"time": -1}, "output": "$$ROOT"}}
+	}
+
+	match := query
+	if field != LatestByType {
+		match = bson.M{"$and": []bson.M{query, {field: bson.M{"$exists": true}}}}
+	}
+
+	return []bson.M{
+		{"$match": match},
+		sortStage,
+		{"$group": bson.M{"_id": "$" + field, "latest": latest}},
+		{"$unwind": "$latest"},
+		{"$replaceRoot": bson.M{"newRoot": "$latest"}},
+		sortStage,
+		{"$project": projection},
+	}
+}
+
+// latestProjection returns the projection of the latest results, which always include the field
+// they are grouped by
+func latestProjection(p *Params, projection bson.M, field string) bson.M {
+	if len(p.Fields) == 0 {
+		return projection
+	}
+	latest := bson.M{field: 1}
+	for key, value := range projection {
+		latest[key] = value
+	}
+	return latest
+}
+
+// getLatest returns the LatestCount most recent results for each value of the LatestBy field, with
+// one aggregation per collection
+func (c *MongoStoreClient) getLatest(p *Params, projection bson.M) (StorageIterator, error) {
+	latest := &latestIterator{pos: -1}
+
+	count := p.LatestCount
+	if count < 1 {
+		count = 1
+	}
+	field := p.LatestBy
+	if field == "" {
+		field = LatestByType
+	}
+
+	pipeline := latestPipeline(generateMongoQuery(p), field, count, latestProjection(p, projection, field))
+	for _, collectionName := range collectionNamesForParams(p) {
+		cursor, err := c.collectionByName(collectionName).Aggregate(c.context, pipeline)
+		if err != nil {
+			return latest, err
+		}
+		var results []bson.Raw
+		if err = cursor.All(c.context, &results); err != nil {
+			return latest, err
+		}
+		latest.results = append(latest.results, results...)
+	}
+
+	latest.results = limitLatest(latest.results, field, count)
+	return latest, nil
+}
+
+// limitLatest combines the latest results of the collections, in which the same value may appear,
+// ordered by value then most recent first, and limits them to count per value
+func limitLatest(results []bson.Raw, field string, count int) []bson.Raw {
+	value := func(raw bson.Raw) string {
+		return raw.Lookup(field).String()
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if vi, vj := value(results[i]), value(results[j]); vi != vj {
+			return vi < vj
+		}
+		return documentTime(results[i]).After(documentTime(results[j]))
+	})
+
+	limited := results[:0]
+	var previous string
+	var valueCount int
+	for idx, raw := range results {
+		if current := value(raw); idx == 0 || current != previous {
+			previous = current
+			valueCount = 0
+		}
+		if valueCount < count {
+			limited = append(limited, raw)
+		}
+		valueCount++
+	}
+	return limited
+}
@@ -0,0 +1,195 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestStore_GetParams_Latest(t *testing.T) {
+	tests := []struct {
+		values   url.Values
+		latest   bool
+		count    int
+		latestBy string
+	}{
+		{url.Values{"latest": []string{"true"}}, true, 1, ""},
+		{url.Values{"latest": []string{"false"}}, false, 0, ""},
+		{url.Values{"latest": []string{"5"}}, true, 5, ""},
+		{url.Values{"latest": []string{"0"}}, false, 0, ""},
+		{url.Values{"latest": []string{"3"}, "latestBy": []string{"deviceId"}}, true, 3, LatestByDeviceID},
+		{url.Values{"latest": []string{"true"}, "latestBy": []string{"type"}}, true, 1, LatestByType},
+	}
+
+	for _, test := range tests {
+		params, err := GetParams(test.values, &SchemaVersion{Minimum: 1, Maximum: 3})
+		if err != nil {
+			t.Errorf("GetParams(%v) returned error %s", test.values, err)
+			continue
+		}
+		if params.Latest != test.latest || params.LatestCount != test.count || params.LatestBy != test.latestBy {
+			t.Errorf("GetParams(%v) returned latest %v, %d, %q", test.values, params.Latest, params.LatestCount, params.LatestBy)
+		}
+	}
+}
+
+func TestStore_GetParams_LatestInvalid(t *testing.T) {
+	tests := []url.Values{
+		{"latest": []string{"-1"}},
+		{"latest": []string{"101"}},
+		{"latest": []string{"most"}},
+		{"latestBy": []string{"deviceId"}},
+		{"latest": []string{"true"}, "latestBy": []string{"subType"}},
+	}
+
+	for _, test := range tests {
+		if _, err := GetParams(test, &SchemaVersion{Minimum: 1, Maximum: 3}); err == nil {
+			t.Errorf("GetParams(%v) did not return an error", test)
+		}
+	}
+}
+
+func TestStore_LatestCount(t *testing.T) {
+	testData := testDataForLatestTests()
+	storeData := storeDataForLatestTests(testData)
+
+	store := before(t, storeData...)
+
+	qParams := &Params{
+		UserID:        "abc123",
+		SchemaVersion: &SchemaVersion{Maximum: 2, Minimum: 0},
+		Types:         []string{"cbg"},
+		Latest:        true,
+		LatestCount:   2,
+	}
+
+	iter, err := store.GetDeviceData(qParams)
+	if err != nil {
+		t.Fatal("Error querying Mongo")
+	}
+
+	var values []float64
+	for iter.Next(store.context) {
+		var result TestDataSchema
+		if err := iter.Decode(&result); err != nil {
+			t.Error("Mongo Decode error")
+		}
+		values = append(values, *result.Value)
+	}
+
+	if len(values) != 2 || values[0] != *testData["cbg1"].Value || values[1] != *testData["cbg2"].Value {
+		t.Errorf("Unexpected cbg values %v when requesting the latest 2", values)
+	}
+}
+
+func TestStore_LatestByDeviceID(t *testing.T) {
+	testData := testDataForLatestTests()
+	storeData := storeDataForLatestTests(testData)
+
+	store := before(t, storeData...)
+
+	qParams := &Params{
+		UserID:        "abc123",
+		SchemaVersion: &SchemaVersion{Maximum: 2, Minimum: 0},
+		Latest:        true,
+		LatestCount:   1,
+		LatestBy:      LatestByDeviceID,
+	}
+
+	iter, err := store.GetDeviceData(qParams)
+	if err != nil {
+		t.Fatal("Error querying Mongo")
+	}
+
+	results := map[string]string{}
+	for iter.Next(store.context) {
+		var result TestDataSchema
+		if err := iter.Decode(&result); err != nil {
+			t.Error("Mongo Decode error")
+		}
+		if _, ok := results[*result.DeviceId]; ok {
+			t.Errorf("More than one result for device %s", *result.DeviceId)
+		}
+		results[*result.DeviceId] = *result.Type
+	}
+
+	// The uploads are the most recent data of each device
+	if len(results) != 2 || results["dev123"] != "upload" || results["dev456"] != "upload" {
+		t.Errorf("Unexpected results %v when requesting latest by deviceId", results)
+	}
+}
+
+func TestStore_latestPipeline(t *testing.T) {
+	query := bson.M{"_userId": "abc123", "_active": true}
+	projection := bson.M{"_id": 0}
+	sortStage := bson.M{"$sort": bson.D{{Key: "type", Value: 1}, {Key: "time", Value: -1}}}
+
+	expected := []bson.M{
+		{"$match": query},
+		sortStage,
+		{"$group": bson.M{"_id": "$type", "latest": bson.M{"$first": "$$ROOT"}}},
+		{"$unwind": "$latest"},
+		{"$replaceRoot": bson.M{"newRoot": "$latest"}},
+		sortStage,
+		{"$project": projection},
+	}
+	if diff := cmp.Diff(expected, latestPipeline(query, LatestByType, 1, projection)); diff != "" {
+		t.Errorf("latestPipeline mismatch (-want +got):\n%s", diff)
+	}
+
+	pipeline := latestPipeline(query, LatestByDeviceID, 3, projection)
+	if diff := cmp.Diff(bson.M{"$match": bson.M{"$and": []bson.M{query, {"deviceId": bson.M{"$exists": true}}}}}, pipeline[0]); diff != "" {
+		t.Errorf("latestPipeline match mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(bson.M{"$group": bson.M{"_id": "$deviceId", "latest": bson.M{"$topN": bson.M{"n": 3, "sortBy": bson.M{"time": -1}, "output": "$$ROOT"}}}}, pipeline[2]); diff != "" {
+		t.Errorf("latestPipeline group mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestStore_latestProjection(t *testing.T) {
+	projection := bson.M{"_id": 0, "_userId": 0}
+	if diff := cmp.Diff(projection, latestProjection(&Params{}, projection, LatestByDeviceID)); diff != "" {
+		t.Errorf("latestProjection mismatch without fields (-want +got):\n%s", diff)
+	}
+
+	projection = bson.M{"_id": 0, "time": 1, "type": 1, "value": 1}
+	expected := bson.M{"_id": 0, "time": 1, "type": 1, "value": 1, "deviceId": 1}
+	if diff := cmp.Diff(expected, latestProjection(&Params{Fields: []string{"value"}}, projection, LatestByDeviceID)); diff != "" {
+		t.Errorf("latestProjection mismatch with fields (-want +got):\n%s", diff)
+	}
+}
+
+func TestStore_limitLatest(t *testing.T) {
+	raw := func(deviceID string, minutes int) bson.Raw {
+		doc := bson.M{"time": time.Date(2020, 1, 1, 0, minutes, 0, 0, time.UTC)}
+		if deviceID != "" {
+			doc["deviceId"] = deviceID
+		}
+		bytes, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatalf("Error %s marshaling document", err)
+		}
+		return bytes
+	}
+
+	// Two collections' results, each ordered by deviceId then most recent first
+	results := []bson.Raw{
+		raw("a", 30), raw("a", 20), raw("b", 10),
+		raw("a", 40), raw("b", 50), raw("b", 5), raw("", 1),
+	}
+
+	var got []string
+	for _, result := range limitLatest(results, LatestByDeviceID, 2) {
+		deviceID, _ := result.Lookup("deviceId").StringValueOK()
+		got = append(got, fmt.Sprintf("%s%d", deviceID, documentTime(result).Minute()))
+	}
+
+	expected := []string{"1", "a40", "a30", "b50", "b10"}
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Errorf("limitLatest mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const minutesPerDay = 24 * 60
+
+// TimeOfDay is a window of local time, in minutes since midnight. The start is inclusive and the end
+// exclusive. A window whose end is before its start wraps midnight, e.g. 22:00-06:00.
+type TimeOfDay struct {
+	Start int
+	End   int
+}
+
+// parseTimeOfDay parses a `HH:MM-HH:MM` window of local time. The end may be 24:00.
+func parseTimeOfDay(value string) (*TimeOfDay, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return nil, errors.New("timeOfDay parameter not valid")
+	}
+	start, err := parseMinutesOfDay(parts[0])
+	if err != nil || start == minutesPerDay {
+		return nil, errors.New("timeOfDay parameter not valid")
+	}
+	end, err := parseMinutesOfDay(parts[1])
+	if err != nil || end == start {
+		return nil, errors.New("timeOfDay parameter not valid")
+	}
+	return &TimeOfDay{Start: start, End: end}, nil
+}
+
+func parseMinutesOfDay(value string) (int, error) {
+	if len(value) != 5 || value[2] != ':' {
+		return 0, errors.New("time not valid")
+	}
+	hours, err := strconv.Atoi(value[:2])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, errors.New("time not valid")
+	}
+	minutes, err := strconv.Atoi(value[3:])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes > 0) {
+		return 0, errors.New("time not valid")
+	}
+	return hours*60 + minutes, nil
+}
+
+// parseDaysOfWeek parses a comma separated list of days, by their English names or the first three
+// letters of them, e.g. `saturday,sunday` or `Sat,Sun`
+func parseDaysOfWeek(value string) ([]time.Weekday, error) {
+	days := []time.Weekday{}
+	for _, name := range strings.Split(value, ",") {
+		day, ok := parseDayOfWeek(name)
+		if !ok {
+			return nil, errors.New("daysOfWeek parameter not valid")
+		}
+		if !containsWeekday(day, days) {
+			days = append(days, day)
+		}
+	}
+	return days, nil
+}
+
+func parseDayOfWeek(name string) (time.Weekday, bool) {
+	name = strings.ToLower(name)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		dayName := strings.ToLower(day.String())
+		if name == dayName || name == dayName[:3] {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+func containsWeekday(needle time.Weekday, haystack []time.Weekday) bool {
+	for _, day := range haystack {
+		if day == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// localTimeQuery returns the query of the time of day and days of week in the parameters, or nil if
+// neither is set. The local time of a datum is its `time` shifted by its `timezoneOffset`, or UTC if
+// it has no offset, and the day of a datum is the day of its own local time.
+func localTimeQuery(p *Params) bson.M {
+	if p.TimeOfDay == nil && len(p.DaysOfWeek) == 0 {
+		return nil
+	}
+
+	localTime := bson.M{"$add": bson.A{"$time", bson.M{"$multiply": bson.A{bson.M{"$ifNull": bson.A{"$timezoneOffset", 0}}, int64(time.Minute / time.Millisecond)}}}}
+
+	conditions := bson.A{}
+	if p.TimeOfDay != nil {
+		minutes := bson.M{"$add": bson.A{bson.M{"$multiply": bson.A{bson.M{"$hour": localTime}, 60}}, bson.M{"$minute": localTime}}}
+		start := bson.M{"$gte": bson.A{minutes, p.TimeOfDay.Start}}
+		end := bson.M{"$lt": bson.A{minutes, p.TimeOfDay.End}}
+		if p.TimeOfDay.Start < p.TimeOfDay.End {
+			conditions = append(conditions, bson.M{"$and": bson.A{start, end}})
+		} else {
+			conditions = append(conditions, bson.M{"$or": bson.A{start, end}})
+		}
+	}
+	if len(p.DaysOfWeek) > 0 {
+		// $dayOfWeek is 1 (Sunday) to 7 (Saturday)
+		days := bson.A{}
+		for _, day := range p.DaysOfWeek {
+			days = append(days, int(day)+1)
+		}
+		conditions = append(conditions, bson.M{"$in": bson.A{bson.M{"$dayOfWeek": localTime}, days}})
+	}
+
+	if len(conditions) == 1 {
+		return bson.M{"$expr": conditions[0]}
+	}
+	return bson.M{"$expr": bson.M{"$and": conditions}}
+}
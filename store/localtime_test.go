@@ -0,0 +1,107 @@
+package store
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestStore_parseTimeOfDay(t *testing.T) {
+	tests := map[string]*TimeOfDay{
+		"00:00-06:00": {Start: 0, End: 360},
+		"22:30-06:00": {Start: 1350, End: 360},
+		"18:00-24:00": {Start: 1080, End: 1440},
+	}
+	for value, expected := range tests {
+		timeOfDay, err := parseTimeOfDay(value)
+		if err != nil {
+			t.Errorf("parseTimeOfDay(%q) returned error %s", value, err)
+		} else if diff := cmp.Diff(expected, timeOfDay); diff != "" {
+			t.Errorf("parseTimeOfDay(%q) mismatch (-want +got):\n%s", value, diff)
+		}
+	}
+
+	for _, value := range []string{"00:00", "0:00-6:00", "06:00-06:00", "24:00-06:00", "00:00-25:00", "00:60-06:00", "24:30-06:00", "aa:bb-06:00"} {
+		if _, err := parseTimeOfDay(value); err == nil {
+			t.Errorf("parseTimeOfDay(%q) should have returned an error", value)
+		}
+	}
+}
+
+func TestStore_parseDaysOfWeek(t *testing.T) {
+	days, err := parseDaysOfWeek("saturday,Sun,SAT")
+	if err != nil {
+		t.Fatalf("parseDaysOfWeek returned error %s", err)
+	}
+	if diff := cmp.Diff([]time.Weekday{time.Saturday, time.Sunday}, days); diff != "" {
+		t.Errorf("parseDaysOfWeek mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, value := range []string{"", "weekend", "sa", "6"} {
+		if _, err := parseDaysOfWeek(value); err == nil {
+			t.Errorf("parseDaysOfWeek(%q) should have returned an error", value)
+		}
+	}
+}
+
+func TestStore_GetParams_TimeOfDay(t *testing.T) {
+	query := url.Values{
+		":userID":    []string{"1122334455"},
+		"timeOfDay":  []string{"22:00-06:00"},
+		"daysOfWeek": []string{"sat,sun"},
+	}
+
+	params, err := GetParams(query, &SchemaVersion{Minimum: 1, Maximum: 3})
+	if err != nil {
+		t.Fatalf("GetParams returned error %s", err)
+	}
+	if diff := cmp.Diff(&TimeOfDay{Start: 1320, End: 360}, params.TimeOfDay); diff != "" {
+		t.Errorf("Unexpected 'timeOfDay' result when getting query params (-want +have):\n%s", diff)
+	}
+	if diff := cmp.Diff([]time.Weekday{time.Saturday, time.Sunday}, params.DaysOfWeek); diff != "" {
+		t.Errorf("Unexpected 'daysOfWeek' result when getting query params (-want +have):\n%s", diff)
+	}
+
+	for key, value := range map[string]string{"timeOfDay": "22:00", "daysOfWeek": "weekend"} {
+		if _, err := GetParams(url.Values{":userID": []string{"1122334455"}, key: []string{value}}, &SchemaVersion{Minimum: 1, Maximum: 3}); err == nil {
+			t.Errorf("GetParams with %s=%s should have returned an error", key, value)
+		}
+	}
+}
+
+func TestStore_localTimeQuery(t *testing.T) {
+	localTime := bson.M{"$add": bson.A{"$time", bson.M{"$multiply": bson.A{bson.M{"$ifNull": bson.A{"$timezoneOffset", 0}}, int64(60000)}}}}
+	minutes := bson.M{"$add": bson.A{bson.M{"$multiply": bson.A{bson.M{"$hour": localTime}, 60}}, bson.M{"$minute": localTime}}}
+
+	if query := localTimeQuery(&Params{}); query != nil {
+		t.Errorf("localTimeQuery should be nil without timeOfDay or daysOfWeek, got %v", query)
+	}
+
+	query := localTimeQuery(&Params{TimeOfDay: &TimeOfDay{Start: 0, End: 360}})
+	expected := bson.M{"$expr": bson.M{"$and": bson.A{bson.M{"$gte": bson.A{minutes, 0}}, bson.M{"$lt": bson.A{minutes, 360}}}}}
+	if diff := cmp.Diff(expected, query); diff != "" {
+		t.Errorf("Unexpected time of day query (-want +have):\n%s", diff)
+	}
+
+	query = localTimeQuery(&Params{TimeOfDay: &TimeOfDay{Start: 1320, End: 360}, DaysOfWeek: []time.Weekday{time.Saturday, time.Sunday}})
+	expected = bson.M{"$expr": bson.M{"$and": bson.A{
+		bson.M{"$or": bson.A{bson.M{"$gte": bson.A{minutes, 1320}}, bson.M{"$lt": bson.A{minutes, 360}}}},
+		bson.M{"$in": bson.A{bson.M{"$dayOfWeek": localTime}, bson.A{7, 1}}},
+	}}}
+	if diff := cmp.Diff(expected, query); diff != "" {
+		t.Errorf("Unexpected time of day and days of week query (-want +have):\n%s", diff)
+	}
+
+	mongoQuery := generateMongoQuery(&Params{UserID: "abc123", DaysOfWeek: []time.Weekday{time.Monday}})
+	expectedQuery := bson.M{
+		"_userId": "abc123",
+		"_active": true,
+		"$and":    []bson.M{{"$expr": bson.M{"$in": bson.A{bson.M{"$dayOfWeek": localTime}, bson.A{2}}}}},
+	}
+	if diff := cmp.Diff(expectedQuery, mongoQuery); diff != "" {
+		t.Errorf("Unexpected days of week mongo query (-want +have):\n%s", diff)
+	}
+}
@@ -0,0 +1,176 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// SortAscending orders results by ascending `time`
+	SortAscending = 1
+	// SortDescending orders results by descending `time`
+	SortDescending = -1
+)
+
+// sortedIterator is a StorageIterator over results sorted by `time`, read from one or more collections
+type sortedIterator interface {
+	StorageIterator
+	currentRaw() (bson.Raw, string)
+}
+
+// mergeIterator is a StorageIterator that merges multiple cursors, each already sorted by `time`,
+// into a single stream sorted by `time`. Results with equal times are ordered by the position of
+// their cursor (reversed when descending), so that the order is the same on every read. There are
+// only ever a couple of cursors, so the next result is found with a linear scan rather than a heap.
+type mergeIterator struct {
+	cursors     []*mongo.Cursor
+	collections []string
+	descending  bool
+	hasCurrent  []bool
+	started     bool
+	current     int
+}
+
+func newMergeIterator(cursors []*mongo.Cursor, collections []string, sort int) *mergeIterator {
+	return &mergeIterator{
+		cursors:     cursors,
+		collections: collections,
+		descending:  sort == SortDescending,
+		hasCurrent:  make([]bool, len(cursors)),
+		current:     -1,
+	}
+}
+
+func (l *mergeIterator) Next(ctx context.Context) bool {
+	if !l.started {
+		for idx, cursor := range l.cursors {
+			l.hasCurrent[idx] = cursor.Next(ctx)
+		}
+		l.started = true
+	} else if l.current >= 0 {
+		l.hasCurrent[l.current] = l.cursors[l.current].Next(ctx)
+	}
+
+	l.current = -1
+	var currentTime time.Time
+	for idx, cursor := range l.cursors {
+		if !l.hasCurrent[idx] {
+			continue
+		}
+		cursorTime := documentTime(cursor.Current)
+		if l.current < 0 ||
+			(!l.descending && cursorTime.Before(currentTime)) ||
+			(l.descending && !cursorTime.Before(currentTime)) {
+			l.current = idx
+			currentTime = cursorTime
+		}
+	}
+	return l.current >= 0
+}
+
+func (l *mergeIterator) Decode(result interface{}) error {
+	return bson.Unmarshal(l.cursors[l.current].Current, result)
+}
+
+func (l *mergeIterator) Close(ctx context.Context) error {
+	for _, cursor := range l.cursors {
+		if err := cursor.Close(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Err returns the first error encountered by any of the merged cursors
+func (l *mergeIterator) Err() error {
+	for _, cursor := range l.cursors {
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentRaw returns the current document and the name of the collection it was read from
+func (l *mergeIterator) currentRaw() (bson.Raw, string) {
+	return l.cursors[l.current].Current, l.collections[l.current]
+}
+
+// documentTime returns the `time` of the document, or the zero time if it has none
+func documentTime(raw bson.Raw) time.Time {
+	if value, err := raw.LookupErr("time"); err == nil && value.Type == bsontype.DateTime {
+		return value.Time().UTC()
+	}
+	return time.Time{}
+}
+
+// findSorted queries each collection needed by the parameters sorted by `time` and `_id` in the
+// direction of sort, and merges the results. If p.Cursor is set, only results after the cursor are
+// read, or if from is set, the results from that time on. A positive limit is applied to each
+// collection.
+func (c *MongoStoreClient) findSorted(p *Params, projection bson.M, sort int, limit int64, from *time.Time) (*mergeIterator, error) {
+	collectionNames := collectionNamesForParams(p)
+
+	cursorIdx := -1
+	if p.Cursor != nil {
+		if cursorIdx = indexOf(p.Cursor.Collection, collectionNames); cursorIdx < 0 {
+			return nil, errors.New("cursor not valid for query")
+		}
+	}
+
+	cursors := []*mongo.Cursor{}
+	for idx, collectionName := range collectionNames {
+		query := generateMongoQuery(p)
+		if from != nil {
+			appendAndQuery(query, fromQuery(*from, sort))
+		} else if p.Cursor != nil {
+			appendAndQuery(query, cursorQuery(p.Cursor, idx-cursorIdx, sort))
+		}
+
+		opts := options.Find().
+			SetProjection(projection).
+			SetSort(bson.D{{Key: "time", Value: sort}, {Key: "_id", Value: sort}})
+		if limit > 0 {
+			opts.SetLimit(limit)
+		}
+
+		cursor, err := c.collectionByName(collectionName).Find(c.context, query, opts)
+		if err != nil {
+			for _, opened := range cursors {
+				opened.Close(c.context)
+			}
+			return nil, err
+		}
+		cursors = append(cursors, cursor)
+	}
+
+	return newMergeIterator(cursors, collectionNames, sort), nil
+}
+
+// findDeduped queries as findSorted without a limit, as records may be dropped once they are read,
+// dropping the overlapping records of the dedupe rules. If p.Cursor is set, the records are read from
+// the start of the chain of overlaps that reaches the cursor, so that the records after the cursor are
+// dropped as they are in an unpaged read. The records up to the cursor must be skipped by the caller.
+func (c *MongoStoreClient) findDeduped(p *Params, projection bson.M, sort int, rules DedupeRules) (*dedupeIterator, error) {
+	var from *time.Time
+	if p.Cursor != nil {
+		start, err := c.findDedupeChainStart(p, sort, rules)
+		if err != nil {
+			return nil, err
+		}
+		from = &start
+	}
+
+	dedupeProjection, strip := dedupeProjection(projection, p, rules)
+	iter, err := c.findSorted(p, dedupeProjection, sort, 0, from)
+	if err != nil {
+		return nil, err
+	}
+	return newDedupeIterator(iter, rules, strip), nil
+}
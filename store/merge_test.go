@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func newTestCursor(t *testing.T, documents ...interface{}) *mongo.Cursor {
+	cursor, err := mongo.NewCursorFromDocuments(documents, nil, nil)
+	if err != nil {
+		t.Fatalf("Error %s creating cursor", err)
+	}
+	return cursor
+}
+
+func mergedValues(t *testing.T, sort int, data []interface{}, dataSets []interface{}) []string {
+	iter := newMergeIterator(
+		[]*mongo.Cursor{newTestCursor(t, data...), newTestCursor(t, dataSets...)},
+		[]string{dataCollectionName, dataSetsCollectionName},
+		sort,
+	)
+	defer iter.Close(context.Background())
+
+	values := []string{}
+	for iter.Next(context.Background()) {
+		var result bson.M
+		if err := iter.Decode(&result); err != nil {
+			t.Error("Decode error")
+		}
+		values = append(values, result["value"].(string))
+	}
+	if err := iter.Err(); err != nil {
+		t.Errorf("Unexpected error %s", err)
+	}
+	return values
+}
+
+func TestStore_mergeIterator_Ascending(t *testing.T) {
+	baseTime, _ := time.Parse(time.RFC3339, "2019-03-15T00:00:00.000Z")
+
+	data := []interface{}{
+		bson.M{"time": baseTime, "value": "data1"},
+		bson.M{"time": baseTime.Add(2 * time.Minute), "value": "data2"},
+		bson.M{"time": baseTime.Add(3 * time.Minute), "value": "data3"},
+	}
+	dataSets := []interface{}{
+		bson.M{"time": baseTime, "value": "dataSet1"},
+		bson.M{"time": baseTime.Add(time.Minute), "value": "dataSet2"},
+		bson.M{"time": baseTime.Add(4 * time.Minute), "value": "dataSet3"},
+	}
+
+	values := mergedValues(t, SortAscending, data, dataSets)
+
+	expectedValues := []string{"data1", "dataSet1", "dataSet2", "data2", "data3", "dataSet3"}
+	if diff := cmp.Diff(expectedValues, values); diff != "" {
+		t.Errorf("Unexpected merged order (-want +have):\n%s", diff)
+	}
+}
+
+func TestStore_mergeIterator_Descending(t *testing.T) {
+	baseTime, _ := time.Parse(time.RFC3339, "2019-03-15T00:00:00.000Z")
+
+	data := []interface{}{
+		bson.M{"time": baseTime.Add(3 * time.Minute), "value": "data1"},
+		bson.M{"time": baseTime, "value": "data2"},
+	}
+	dataSets := []interface{}{
+		bson.M{"time": baseTime.Add(4 * time.Minute), "value": "dataSet1"},
+		bson.M{"time": baseTime, "value": "dataSet2"},
+	}
+
+	values := mergedValues(t, SortDescending, data, dataSets)
+
+	expectedValues := []string{"dataSet1", "data1", "dataSet2", "data2"}
+	if diff := cmp.Diff(expectedValues, values); diff != "" {
+		t.Errorf("Unexpected merged order (-want +have):\n%s", diff)
+	}
+}
+
+func TestStore_mergeIterator_Empty(t *testing.T) {
+	baseTime, _ := time.Parse(time.RFC3339, "2019-03-15T00:00:00.000Z")
+
+	data := []interface{}{
+		bson.M{"time": baseTime, "value": "data1"},
+	}
+
+	values := mergedValues(t, SortAscending, data, nil)
+
+	if diff := cmp.Diff([]string{"data1"}, values); diff != "" {
+		t.Errorf("Unexpected merged order (-want +have):\n%s", diff)
+	}
+}
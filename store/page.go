@@ -0,0 +1,268 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MaximumLimit is the largest page size that may be requested with the `limit` parameter
+const MaximumLimit = 10000
+
+type (
+	// PagedStorageIterator is a StorageIterator over a single page of results
+	PagedStorageIterator interface {
+		StorageIterator
+		NextCursor() (string, error)
+	}
+
+	// Cursor identifies the last datum returned in a page of results. Paged results are ordered by
+	// `time`, then collection, then `_id`, so the cursor must record all three to resume
+	// deterministically.
+	Cursor struct {
+		Collection string      `bson:"c"`
+		Time       time.Time   `bson:"t"`
+		ID         interface{} `bson:"i"`
+	}
+
+	// pageIterator is a StorageIterator over a single page of results. The page is read in full
+	// when the iterator is created so that the cursor to the next page is known before any
+	// results are written.
+	pageIterator struct {
+		results    []bson.Raw
+		pos        int
+		nextCursor *Cursor
+	}
+)
+
+// Encode returns the opaque string representation of the cursor
+func (c *Cursor) Encode() (string, error) {
+	bytes, err := bson.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// DecodeCursor parses a cursor previously returned by Cursor.Encode
+func DecodeCursor(value string) (*Cursor, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.New("cursor parameter not valid")
+	}
+	cursor := &Cursor{}
+	if err = bson.Unmarshal(bytes, cursor); err != nil {
+		return nil, errors.New("cursor parameter not valid")
+	}
+	if cursor.Collection != dataCollectionName && cursor.Collection != dataSetsCollectionName {
+		return nil, errors.New("cursor parameter not valid")
+	}
+	if cursor.ID == nil {
+		return nil, errors.New("cursor parameter not valid")
+	}
+	return cursor, nil
+}
+
+// NextCursor returns the encoded cursor to the next page of results, or an empty string if this
+// is the last page
+func (l *pageIterator) NextCursor() (string, error) {
+	if l.nextCursor == nil {
+		return "", nil
+	}
+	return l.nextCursor.Encode()
+}
+
+func (l *pageIterator) Next(context.Context) bool {
+	l.pos++
+	return l.pos < len(l.results)
+}
+
+func (l *pageIterator) Decode(result interface{}) error {
+	return bson.Unmarshal(l.results[l.pos], result)
+}
+
+func (l *pageIterator) Close(context.Context) error {
+	return nil
+}
+
+// Err returns nil, as the page is read in full before it is returned
+func (l *pageIterator) Err() error {
+	return nil
+}
+
+// cursorQuery returns the query that matches the data in a collection that is sorted after the
+// cursor. position is the position of the collection relative to the cursor's collection, which
+// decides the order of data with the same time as the cursor.
+func cursorQuery(cursor *Cursor, position int, sort int) bson.M {
+	strictOperator, inclusiveOperator := "$gt", "$gte"
+	if sort == SortDescending {
+		strictOperator, inclusiveOperator = "$lt", "$lte"
+	}
+
+	switch {
+	case position == 0:
+		return bson.M{
+			"$or": []bson.M{
+				{"time": bson.M{strictOperator: cursor.Time}},
+				{"time": cursor.Time, "_id": bson.M{strictOperator: cursor.ID}},
+			},
+		}
+	case (position < 0) == (sort != SortDescending):
+		// Data with the same time as the cursor in this collection was returned before the cursor
+		return bson.M{"time": bson.M{strictOperator: cursor.Time}}
+	default:
+		return bson.M{"time": bson.M{inclusiveOperator: cursor.Time}}
+	}
+}
+
+// fromQuery returns the query that matches the data from the time on, in the order of sort
+func fromQuery(from time.Time, sort int) bson.M {
+	if sort == SortDescending {
+		return bson.M{"time": bson.M{"$lte": from}}
+	}
+	return bson.M{"time": bson.M{"$gte": from}}
+}
+
+// after reports whether the datum of the other cursor is sorted after the datum of the cursor, in the
+// results of the collections sorted by sort. As for cursorQuery, data with the same time is ordered
+// by collection, then `_id`.
+func (c *Cursor) after(other *Cursor, collections []string, sort int) bool {
+	if !other.Time.Equal(c.Time) {
+		return other.Time.After(c.Time) == (sort != SortDescending)
+	}
+	if position, cursorPosition := indexOf(other.Collection, collections), indexOf(c.Collection, collections); position != cursorPosition {
+		return (position > cursorPosition) == (sort != SortDescending)
+	}
+	comparison := compareIDs(other.ID, c.ID)
+	if sort == SortDescending {
+		return comparison < 0
+	}
+	return comparison > 0
+}
+
+// compareIDs compares the `_id`s of two data, which are ObjectIDs or strings, returning -1, 0 or 1.
+// IDs of other types are only compared for equality, and are otherwise sorted after.
+func compareIDs(a interface{}, b interface{}) int {
+	switch typedA := a.(type) {
+	case primitive.ObjectID:
+		if typedB, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(typedA[:], typedB[:])
+		}
+	case string:
+		if typedB, ok := b.(string); ok {
+			return strings.Compare(typedA, typedB)
+		}
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0
+	}
+	return 1
+}
+
+// getDeviceDataPage reads a single page of up to p.Limit results, starting after p.Cursor if set.
+// Pages are sorted by p.Sort, or ascending `time` if not set. Overlapping records are deduped across
+// pages: the records of the overlaps that reach back before the cursor are read again, so that the
+// records after the cursor that lose to them are dropped, and are then skipped.
+func (c *MongoStoreClient) getDeviceDataPage(p *Params, projection bson.M) (StorageIterator, error) {
+	sort := p.Sort
+	if sort == 0 {
+		sort = SortAscending
+	}
+
+	// The _id is needed to build the cursor, but is removed from the results before they are returned
+	pageProjection := bson.M{}
+	for field, value := range projection {
+		if field != "_id" {
+			pageProjection[field] = value
+		}
+	}
+
+	var iter sortedIterator
+	var err error
+	rules := dedupeRulesForParams(p)
+	if len(rules) > 0 {
+		iter, err = c.findDeduped(p, pageProjection, sort, rules)
+	} else {
+		iter, err = c.findSorted(p, pageProjection, sort, int64(p.Limit+1), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(c.context)
+
+	var skipTo *Cursor
+	if len(rules) > 0 {
+		skipTo = p.Cursor
+	}
+	return readPage(c.context, iter, p.Limit, skipTo, collectionNamesForParams(p), sort)
+}
+
+// readPage reads up to limit results of the iterator into a page, first skipping the results up to and
+// including the skipTo cursor if set. The cursor to the next page is set if there are more results.
+func readPage(ctx context.Context, iter sortedIterator, limit int, skipTo *Cursor, collectionNames []string, sort int) (*pageIterator, error) {
+	page := &pageIterator{pos: -1}
+	var last *Cursor
+
+	for iter.Next(ctx) {
+		if len(page.results) == limit {
+			page.nextCursor = last
+			break
+		}
+		raw, collectionName := iter.currentRaw()
+		cursor, result, err := cursorAndResult(collectionName, raw)
+		if err != nil {
+			return nil, err
+		}
+		if skipTo != nil {
+			if !skipTo.after(cursor, collectionNames, sort) {
+				continue
+			}
+			skipTo = nil
+		}
+		page.results = append(page.results, result)
+		last = cursor
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// cursorAndResult returns the cursor pointing at the raw document read from the named collection,
+// along with the document stripped of its _id
+func cursorAndResult(collectionName string, raw bson.Raw) (*Cursor, bson.Raw, error) {
+	cursor := &Cursor{Collection: collectionName, Time: documentTime(raw)}
+
+	id, err := raw.LookupErr("_id")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = id.Unmarshal(&cursor.ID); err != nil {
+		return nil, nil, err
+	}
+
+	var doc bson.D
+	if err = bson.Unmarshal(raw, &doc); err != nil {
+		return nil, nil, err
+	}
+	filtered := make(bson.D, 0, len(doc))
+	for _, elem := range doc {
+		if elem.Key != "_id" {
+			filtered = append(filtered, elem)
+		}
+	}
+	result, err := bson.Marshal(filtered)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cursor, result, nil
+}
@@ -0,0 +1,365 @@
+package store
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestStore_Cursor_EncodeDecode(t *testing.T) {
+	cursorTime, _ := time.Parse(time.RFC3339, "2019-03-15T01:24:28.000Z")
+	cursor := &Cursor{
+		Collection: dataSetsCollectionName,
+		Time:       cursorTime,
+		ID:         primitive.NewObjectID(),
+	}
+
+	encoded, err := cursor.Encode()
+	if err != nil {
+		t.Fatalf("should not have received error, but got %s", err)
+	}
+
+	decoded, err := DecodeCursor(encoded)
+	if err != nil {
+		t.Fatalf("should not have received error, but got %s", err)
+	}
+	if !reflect.DeepEqual(decoded, cursor) {
+		t.Errorf("decoded cursor %#v does not equal cursor %#v", decoded, cursor)
+	}
+}
+
+func TestStore_Cursor_DecodeInvalid(t *testing.T) {
+	invalidCollection, _ := (&Cursor{Collection: "data_sources", ID: "abc"}).Encode()
+	missingID, _ := (&Cursor{Collection: dataCollectionName}).Encode()
+
+	for _, value := range []string{"blah!", "YWJj", invalidCollection, missingID} {
+		if _, err := DecodeCursor(value); err == nil {
+			t.Errorf("should have received error decoding %q, but got nil", value)
+		}
+	}
+}
+
+func TestStore_cursorQuery(t *testing.T) {
+	cursorTime, _ := time.Parse(time.RFC3339, "2019-03-15T01:24:28.000Z")
+	cursor := &Cursor{Collection: dataCollectionName, Time: cursorTime, ID: "abc"}
+
+	tests := []struct {
+		position      int
+		sort          int
+		expectedQuery bson.M
+	}{
+		{0, SortAscending, bson.M{"$or": []bson.M{
+			{"time": bson.M{"$gt": cursorTime}},
+			{"time": cursorTime, "_id": bson.M{"$gt": "abc"}},
+		}}},
+		{-1, SortAscending, bson.M{"time": bson.M{"$gt": cursorTime}}},
+		{1, SortAscending, bson.M{"time": bson.M{"$gte": cursorTime}}},
+		{0, SortDescending, bson.M{"$or": []bson.M{
+			{"time": bson.M{"$lt": cursorTime}},
+			{"time": cursorTime, "_id": bson.M{"$lt": "abc"}},
+		}}},
+		{-1, SortDescending, bson.M{"time": bson.M{"$lte": cursorTime}}},
+		{1, SortDescending, bson.M{"time": bson.M{"$lt": cursorTime}}},
+	}
+
+	for _, test := range tests {
+		query := cursorQuery(cursor, test.position, test.sort)
+		if !reflect.DeepEqual(query, test.expectedQuery) {
+			t.Errorf("position %d sort %d: %s", test.position, test.sort, getErrString(query, test.expectedQuery))
+		}
+	}
+}
+
+func TestStore_fromQuery(t *testing.T) {
+	from, _ := time.Parse(time.RFC3339, "2019-03-15T01:24:28.000Z")
+
+	if query, expected := fromQuery(from, SortAscending), (bson.M{"time": bson.M{"$gte": from}}); !reflect.DeepEqual(query, expected) {
+		t.Error(getErrString(query, expected))
+	}
+	if query, expected := fromQuery(from, SortDescending), (bson.M{"time": bson.M{"$lte": from}}); !reflect.DeepEqual(query, expected) {
+		t.Error(getErrString(query, expected))
+	}
+}
+
+func TestStore_Cursor_after(t *testing.T) {
+	cursorTime, _ := time.Parse(time.RFC3339, "2019-03-15T01:24:28.000Z")
+	collections := []string{dataCollectionName, dataSetsCollectionName}
+	cursor := &Cursor{Collection: dataCollectionName, Time: cursorTime, ID: "def"}
+
+	tests := []struct {
+		other    *Cursor
+		sort     int
+		expected bool
+	}{
+		{&Cursor{Collection: dataCollectionName, Time: cursorTime.Add(time.Second), ID: "abc"}, SortAscending, true},
+		{&Cursor{Collection: dataCollectionName, Time: cursorTime.Add(-time.Second), ID: "xyz"}, SortAscending, false},
+		{&Cursor{Collection: dataCollectionName, Time: cursorTime, ID: "xyz"}, SortAscending, true},
+		{&Cursor{Collection: dataCollectionName, Time: cursorTime, ID: "def"}, SortAscending, false},
+		{&Cursor{Collection: dataSetsCollectionName, Time: cursorTime, ID: "abc"}, SortAscending, true},
+		{&Cursor{Collection: dataCollectionName, Time: cursorTime.Add(-time.Second), ID: "xyz"}, SortDescending, true},
+		{&Cursor{Collection: dataCollectionName, Time: cursorTime, ID: "abc"}, SortDescending, true},
+		{&Cursor{Collection: dataCollectionName, Time: cursorTime, ID: "xyz"}, SortDescending, false},
+		{&Cursor{Collection: dataSetsCollectionName, Time: cursorTime, ID: "abc"}, SortDescending, false},
+	}
+	for _, test := range tests {
+		if after := cursor.after(test.other, collections, test.sort); after != test.expected {
+			t.Errorf("after(%v) sort %d returned %v", test.other, test.sort, after)
+		}
+	}
+}
+
+func TestStore_readPage_dedupe(t *testing.T) {
+	baseTime, _ := time.Parse(time.RFC3339, "2021-03-15T00:00:00.000Z")
+	rules := DedupeRules{{Name: "smbg", Types: []string{"smbg"}, ToleranceSeconds: 60, Priority: []DedupeSource{
+		{Field: "origin.name", Prefix: "first"},
+		{Field: "origin.name", Prefix: "second"},
+	}}}
+	collections := []string{dataCollectionName}
+	smbg := func(id primitive.ObjectID, offset time.Duration, uploadID string, value string) bson.M {
+		return bson.M{"_id": id, "time": baseTime.Add(offset), "type": "smbg", "uploadId": uploadID, "origin": bson.M{"name": uploadID}, "value": value}
+	}
+
+	// The first reading drops the second, which would otherwise drop the third. The second is within the
+	// tolerance before the cursor, but the first is not, so the overlaps chain across the page boundary.
+	data := []interface{}{
+		smbg(primitive.NewObjectID(), 0, "first", "smbg1"),
+		smbg(primitive.NewObjectID(), 50*time.Second, "second", "smbg2"),
+		bson.M{"_id": primitive.NewObjectID(), "time": baseTime.Add(100 * time.Second), "type": "cbg", "uploadId": "cgm", "value": "cbg1"},
+		smbg(primitive.NewObjectID(), 105*time.Second, "third", "smbg3"),
+		smbg(primitive.NewObjectID(), 10*time.Minute, "third", "smbg4"),
+	}
+
+	readValues := func(limit int, skipTo *Cursor, data []interface{}) ([]string, *Cursor) {
+		iter := newDedupeIterator(newMergeIterator([]*mongo.Cursor{newTestCursor(t, data...)}, collections, SortAscending), rules, nil)
+		defer iter.Close(context.Background())
+		page, err := readPage(context.Background(), iter, limit, skipTo, collections, SortAscending)
+		if err != nil {
+			t.Fatalf("readPage returned error %s", err)
+		}
+		values := []string{}
+		for page.Next(context.Background()) {
+			var result bson.M
+			if err := page.Decode(&result); err != nil {
+				t.Fatalf("Decode returned error %s", err)
+			}
+			values = append(values, result["value"].(string))
+		}
+		return values, page.nextCursor
+	}
+
+	unpaged, _ := readValues(len(data), nil, data)
+	if diff := cmp.Diff([]string{"smbg1", "cbg1", "smbg3", "smbg4"}, unpaged); diff != "" {
+		t.Errorf("Unexpected unpaged values (-want +have):\n%s", diff)
+	}
+
+	paged, nextCursor := readValues(2, nil, data)
+	for nextCursor != nil {
+		// The records of the deduped types are read back from the cursor to find the start of the chain
+		before := []interface{}{}
+		for index := len(data) - 1; index >= 0; index-- {
+			if record := data[index].(bson.M); record["type"] == "smbg" && !record["time"].(time.Time).After(nextCursor.Time) {
+				before = append(before, record)
+			}
+		}
+		start, err := dedupeChainStart(context.Background(), newTestCursor(t, before...), nextCursor.Time, rules.tolerance())
+		if err != nil {
+			t.Fatalf("dedupeChainStart returned error %s", err)
+		}
+		from := []interface{}{}
+		for _, record := range data {
+			if !record.(bson.M)["time"].(time.Time).Before(start) {
+				from = append(from, record)
+			}
+		}
+
+		var values []string
+		values, nextCursor = readValues(2, nextCursor, from)
+		paged = append(paged, values...)
+	}
+	if diff := cmp.Diff(unpaged, paged); diff != "" {
+		t.Errorf("Unexpected paged values (-unpaged +paged):\n%s", diff)
+	}
+}
+
+func TestStore_dedupeChainStart(t *testing.T) {
+	baseTime, _ := time.Parse(time.RFC3339, "2021-03-15T00:00:00.000Z")
+	at := func(offset time.Duration) bson.M {
+		return bson.M{"time": baseTime.Add(offset)}
+	}
+
+	// Read back from the cursor, the chain ends at the gap between 3 and 1 minutes
+	cursor := newTestCursor(t, at(4*time.Minute), at(3*time.Minute+30*time.Second), at(3*time.Minute), at(time.Minute), at(0))
+	start, err := dedupeChainStart(context.Background(), cursor, baseTime.Add(4*time.Minute+10*time.Second), time.Minute)
+	if err != nil || !start.Equal(baseTime.Add(3*time.Minute)) {
+		t.Errorf("dedupeChainStart returned %v, %v", start, err)
+	}
+
+	// Without records within the tolerance, the chain starts at the cursor
+	from := baseTime.Add(10 * time.Minute)
+	if start, _ := dedupeChainStart(context.Background(), newTestCursor(t, at(0)), from, time.Minute); !start.Equal(from) {
+		t.Errorf("dedupeChainStart returned %v without records within the tolerance", start)
+	}
+}
+
+func TestStore_GetParams_Limit(t *testing.T) {
+	cursor := &Cursor{Collection: dataCollectionName, ID: "abc"}
+	encoded, _ := cursor.Encode()
+
+	query := url.Values{
+		":userID": []string{"1122334455"},
+		"limit":   []string{"100"},
+		"cursor":  []string{encoded},
+	}
+	schema := &SchemaVersion{Minimum: 1, Maximum: 3}
+
+	params, err := GetParams(query, schema)
+	if err != nil {
+		t.Fatalf("should not have received error, but got %s", err)
+	}
+
+	if diff := cmp.Diff(100, params.Limit); diff != "" {
+		t.Errorf("Unexpected 'limit' result when getting query params (-want +have):\n%s", diff)
+	}
+	if !reflect.DeepEqual(params.Cursor, cursor) {
+		t.Errorf("cursor %#v does not equal expected cursor %#v", params.Cursor, cursor)
+	}
+}
+
+func TestStore_GetParams_LimitInvalid(t *testing.T) {
+	cursor, _ := (&Cursor{Collection: dataCollectionName, ID: "abc"}).Encode()
+
+	invalidQueries := []url.Values{
+		{"limit": []string{"0"}},
+		{"limit": []string{"-1"}},
+		{"limit": []string{"10001"}},
+		{"limit": []string{"blah"}},
+		{"limit": []string{"10"}, "latest": []string{"true"}},
+		{"cursor": []string{cursor}},
+		{"limit": []string{"10"}, "cursor": []string{"blah"}},
+	}
+
+	for _, query := range invalidQueries {
+		query.Set(":userID", "1122334455")
+		if _, err := GetParams(query, &SchemaVersion{Minimum: 1, Maximum: 3}); err == nil {
+			t.Errorf("should have received error for %v, but got nil", query)
+		}
+	}
+}
+
+func testDataForPageTests() []interface{} {
+	baseTime, _ := time.Parse(time.RFC3339, "2019-03-15T00:00:00.000Z")
+
+	storeData := []interface{}{}
+	for idx := 0; idx < 5; idx++ {
+		storeData = append(storeData, TestDataSchema{
+			Active:   ptr(true),
+			UserId:   ptr("abc123"),
+			Time:     ptr(baseTime.Add(time.Duration(idx) * time.Minute)),
+			Type:     ptr("cbg"),
+			Units:    ptr("mmol/L"),
+			Value:    ptr(float64(idx)),
+			UploadId: ptr("9244bb16e27c4973c2f37af81784a05d"),
+		})
+	}
+	for idx := 0; idx < 2; idx++ {
+		storeData = append(storeData, TestDataSchema{
+			Active:   ptr(true),
+			UserId:   ptr("abc123"),
+			Time:     ptr(baseTime.Add(time.Duration(idx) * time.Hour)),
+			Type:     ptr("upload"),
+			UploadId: ptr("9244bb16e27c4973c2f37af81784a05d"),
+		})
+	}
+	// Same time as the first cbg, so only the _id orders them
+	storeData = append(storeData, TestDataSchema{
+		Active:   ptr(true),
+		UserId:   ptr("abc123"),
+		Time:     ptr(baseTime),
+		Type:     ptr("smbg"),
+		Units:    ptr("mmol/L"),
+		Value:    ptr(5.5),
+		UploadId: ptr("9244bb16e27c4973c2f37af81784a05d"),
+	})
+	return storeData
+}
+
+func readAllPages(t *testing.T, store *MongoStoreClient, qParams *Params) (int, []string) {
+	pages := 0
+	types := []string{}
+	for {
+		iter, err := store.GetDeviceData(qParams)
+		if err != nil {
+			t.Fatalf("Error %s querying Mongo", err)
+		}
+		for iter.Next(store.context) {
+			var result bson.M
+			if err := iter.Decode(&result); err != nil {
+				t.Error("Mongo Decode error")
+			}
+			if _, ok := result["_id"]; ok {
+				t.Error("Expected _id to be removed from result")
+			}
+			types = append(types, result["type"].(string))
+		}
+		pages++
+
+		nextCursor, err := iter.(PagedStorageIterator).NextCursor()
+		if err != nil {
+			t.Fatalf("Error %s getting next cursor", err)
+		}
+		if nextCursor == "" {
+			return pages, types
+		}
+		if qParams.Cursor, err = DecodeCursor(nextCursor); err != nil {
+			t.Fatalf("Error %s decoding next cursor", err)
+		}
+	}
+}
+
+func TestStore_GetDeviceData_Paged(t *testing.T) {
+	store := before(t, testDataForPageTests()...)
+
+	qParams := &Params{
+		UserID:        "abc123",
+		SchemaVersion: &SchemaVersion{Maximum: 2, Minimum: 0},
+		Limit:         3,
+	}
+
+	pages, types := readAllPages(t, store, qParams)
+
+	if pages != 3 {
+		t.Errorf("Expected 3 pages but got %d", pages)
+	}
+	expectedTypes := []string{"cbg", "smbg", "upload", "cbg", "cbg", "cbg", "cbg", "upload"}
+	if diff := cmp.Diff(expectedTypes, types); diff != "" {
+		t.Errorf("Unexpected order of paged results (-want +have):\n%s", diff)
+	}
+}
+
+func TestStore_GetDeviceData_PagedDescending(t *testing.T) {
+	store := before(t, testDataForPageTests()...)
+
+	qParams := &Params{
+		UserID:        "abc123",
+		SchemaVersion: &SchemaVersion{Maximum: 2, Minimum: 0},
+		Limit:         5,
+		Sort:          SortDescending,
+	}
+
+	pages, types := readAllPages(t, store, qParams)
+
+	if pages != 2 {
+		t.Errorf("Expected 2 pages but got %d", pages)
+	}
+	expectedTypes := []string{"upload", "cbg", "cbg", "cbg", "cbg", "upload", "smbg", "cbg"}
+	if diff := cmp.Diff(expectedTypes, types); diff != "" {
+		t.Errorf("Unexpected order of paged results (-want +have):\n%s", diff)
+	}
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// AllowedReturnFields are the top level datum fields that may be requested with the `fields` parameter.
+// Nested paths (e.g. "nutrition.carbohydrate.net") are allowed below any of these.
+var AllowedReturnFields = []string{
+	"id", "type", "subType", "time", "deviceTime", "timezoneOffset", "clockDriftOffset", "conversionOffset",
+	"deviceId", "uploadId", "guid", "annotations", "origin", "payload", "notes", "tags",
+	"value", "units", "sampleInterval", "trend", "trendRate",
+	"normal", "expectedNormal", "extended", "expectedExtended", "duration", "expectedDuration",
+	"deliveryType", "rate", "percent", "scheduleName", "suppressed", "insulinFormulation",
+	"carbInput", "insulinCarbRatio", "insulinSensitivity", "insulinOnBoard", "bgInput", "bgTarget",
+	"recommended", "bolus", "nutrition", "name", "reason", "dose", "formulation",
+	"distance", "energy", "amount", "status", "alarmType", "primeTarget", "volume", "states",
+}
+
+// parseFields parses the comma separated `fields` parameter, rejecting any field not below one of
+// the AllowedReturnFields
+func parseFields(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	fields := strings.Split(value, ",")
+	for _, field := range fields {
+		if field == "" || strings.Contains(field, "$") || strings.Contains(field, "..") || strings.HasSuffix(field, ".") {
+			return nil, errors.New("fields parameter not valid")
+		}
+		if !contains(strings.SplitN(field, ".", 2)[0], AllowedReturnFields) {
+			return nil, errors.New("fields parameter not valid")
+		}
+	}
+	return fields, nil
+}
+
+// projectionForParams returns the projection for the fields requested in the parameters, or the
+// mandatory exclusions if no fields were requested. MongoDB does not allow inclusions and exclusions
+// to be mixed other than for _id, so the other mandatory exclusions are enforced by the fields
+// allowlist. `time` and `type` are always included, as the results can't be ordered or told apart
+// without them.
+func projectionForParams(p *Params, exclusions bson.M) bson.M {
+	if len(p.Fields) == 0 {
+		return exclusions
+	}
+
+	fields := append([]string{"time", "type"}, p.Fields...)
+
+	projection := bson.M{}
+	if value, ok := exclusions["_id"]; ok {
+		projection["_id"] = value
+	}
+	for _, field := range fields {
+		// Requesting both a path and one of its parents is a path collision in MongoDB
+		if hasParentField(field, fields) {
+			continue
+		}
+		projection[field] = 1
+	}
+	return projection
+}
+
+func hasParentField(field string, fields []string) bool {
+	for _, other := range fields {
+		if strings.HasPrefix(field, other+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestStore_GetParams_Fields(t *testing.T) {
+	query := url.Values{
+		":userID": []string{"1122334455"},
+		"fields":  []string{"value,units,nutrition.carbohydrate.net"},
+	}
+
+	params, err := GetParams(query, &SchemaVersion{Minimum: 1, Maximum: 3})
+	if err != nil {
+		t.Fatalf("should not have received error, but got %s", err)
+	}
+
+	if diff := cmp.Diff([]string{"value", "units", "nutrition.carbohydrate.net"}, params.Fields); diff != "" {
+		t.Errorf("Unexpected 'fields' result when getting query params (-want +have):\n%s", diff)
+	}
+}
+
+func TestStore_GetParams_FieldsInvalid(t *testing.T) {
+	for _, fields := range []string{"value,", "_userId", "provenance", "createdTime", "value.$", "origin..name", "origin."} {
+		query := url.Values{
+			":userID": []string{"1122334455"},
+			"fields":  []string{fields},
+		}
+		if _, err := GetParams(query, &SchemaVersion{Minimum: 1, Maximum: 3}); err == nil {
+			t.Errorf("should have received error for fields %q, but got nil", fields)
+		}
+	}
+}
+
+func TestStore_projectionForParams_NoFields(t *testing.T) {
+	exclusions := bson.M{"_id": 0, "_userId": 0, "provenance": 0}
+
+	projection := projectionForParams(&Params{}, exclusions)
+
+	if !reflect.DeepEqual(projection, exclusions) {
+		t.Error(getErrString(projection, exclusions))
+	}
+}
+
+func TestStore_projectionForParams_Fields(t *testing.T) {
+	exclusions := bson.M{"_id": 0, "_userId": 0, "provenance": 0}
+
+	projection := projectionForParams(&Params{Fields: []string{"value", "nutrition.carbohydrate.net", "nutrition"}}, exclusions)
+
+	expectedProjection := bson.M{"_id": 0, "time": 1, "type": 1, "value": 1, "nutrition": 1}
+	if !reflect.DeepEqual(projection, expectedProjection) {
+		t.Error(getErrString(projection, expectedProjection))
+	}
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/tidepool-org/tide-whisperer/datum"
+)
+
+const (
+	// MaximumDateRanges is the maximum number of `range` parameters in a query
+	MaximumDateRanges = 10
+
+	// RangeIndexField is the field added to each datum read with date ranges, holding the index of
+	// the first range that includes it
+	RangeIndexField = "rangeIndex"
+)
+
+// parseDateRanges parses the `start/end` values of the repeated `range` parameter. The start and end
+// are in any of the formats of startDate and endDate, and either may be empty for an open range.
+func parseDateRanges(values []string, now time.Time, location *time.Location) ([]Date, error) {
+	if len(values) > MaximumDateRanges {
+		return nil, errors.New("range parameter not valid")
+	}
+
+	var ranges []Date
+	for _, value := range values {
+		parts := strings.Split(value, "/")
+		if len(parts) != 2 || (parts[0] == "" && parts[1] == "") {
+			return nil, errors.New("range parameter not valid")
+		}
+		start, err := parseDate(parts[0], now, location, false)
+		if err != nil {
+			return nil, errors.New("range parameter not valid")
+		}
+		end, err := parseDate(parts[1], now, location, true)
+		if err != nil || (!end.IsZero() && end.Before(start)) {
+			return nil, errors.New("range parameter not valid")
+		}
+		ranges = append(ranges, Date{start, end})
+	}
+	return ranges, nil
+}
+
+// query returns the query of the time within the date, or nil if neither the start nor end is set
+func (d Date) query() bson.M {
+	if !d.Start.IsZero() && !d.End.IsZero() {
+		return bson.M{"$gte": d.Start, "$lte": d.End}
+	} else if !d.Start.IsZero() {
+		return bson.M{"$gte": d.Start}
+	} else if !d.End.IsZero() {
+		return bson.M{"$lte": d.End}
+	}
+	return nil
+}
+
+// includes returns true if the time is within the date
+func (d Date) includes(t time.Time) bool {
+	return (d.Start.IsZero() || !t.Before(d.Start)) && (d.End.IsZero() || !t.After(d.End))
+}
+
+// dateRangesQuery returns the query of the time within any of the ranges, or nil if there are none
+func dateRangesQuery(ranges []Date) bson.M {
+	if len(ranges) == 0 {
+		return nil
+	}
+	rangeQueries := []bson.M{}
+	for _, dateRange := range ranges {
+		rangeQueries = append(rangeQueries, bson.M{"time": dateRange.query()})
+	}
+	return bson.M{"$or": rangeQueries}
+}
+
+// TagDateRange sets the RangeIndexField of the datum to the index of the first of the parameters'
+// date ranges that includes its time. It does nothing if the parameters have no date ranges.
+func TagDateRange(p *Params, d map[string]interface{}) {
+	if len(p.DateRanges) == 0 {
+		return
+	}
+	t, ok := datum.Time(d)
+	if !ok {
+		return
+	}
+	for index, dateRange := range p.DateRanges {
+		if dateRange.includes(t) {
+			d[RangeIndexField] = index
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestStore_parseDateRanges(t *testing.T) {
+	now := time.Date(2021, 3, 14, 12, 0, 0, 0, time.UTC)
+
+	ranges, err := parseDateRanges([]string{"-14d/now", "2021-02-01/2021-02-14", "2021-01-01T00:00:00Z/"}, now, nil)
+	if err != nil {
+		t.Fatalf("parseDateRanges returned error %s", err)
+	}
+	expected := []Date{
+		{Start: now.AddDate(0, 0, -14), End: now},
+		{Start: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2021, 2, 14, 23, 59, 59, 999000000, time.UTC)},
+		{Start: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	if diff := cmp.Diff(expected, ranges); diff != "" {
+		t.Errorf("parseDateRanges mismatch (-want +got):\n%s", diff)
+	}
+
+	if ranges, err := parseDateRanges(nil, now, nil); err != nil || ranges != nil {
+		t.Errorf("parseDateRanges returned %v, %v without ranges", ranges, err)
+	}
+
+	tooMany := make([]string, MaximumDateRanges+1)
+	for index := range tooMany {
+		tooMany[index] = "-1d/now"
+	}
+	for _, values := range [][]string{{"/"}, {"now"}, {"-1d/now/+1d"}, {"now/-1d"}, {"blah/now"}, {"-1d/blah"}, tooMany} {
+		if _, err := parseDateRanges(values, now, nil); err == nil || err.Error() != "range parameter not valid" {
+			t.Errorf("parseDateRanges(%v) returned error %v", values, err)
+		}
+	}
+}
+
+func TestStore_GetParams_DateRanges(t *testing.T) {
+	query := url.Values{
+		":userID": []string{"1122334455"},
+		"range":   []string{"2021-03-01/2021-03-07", "2021-03-08/2021-03-14"},
+	}
+
+	params, err := GetParams(query, &SchemaVersion{Minimum: 1, Maximum: 3})
+	if err != nil {
+		t.Fatalf("GetParams returned error %s", err)
+	}
+	if len(params.DateRanges) != 2 {
+		t.Fatalf("Unexpected date ranges %v", params.DateRanges)
+	}
+
+	mongoQuery := generateMongoQuery(params)
+	expected := []bson.M{{"$or": []bson.M{
+		{"time": bson.M{"$gte": params.DateRanges[0].Start, "$lte": params.DateRanges[0].End}},
+		{"time": bson.M{"$gte": params.DateRanges[1].Start, "$lte": params.DateRanges[1].End}},
+	}}}
+	if diff := cmp.Diff(expected, mongoQuery["$and"]); diff != "" {
+		t.Errorf("Unexpected date ranges query (-want +have):\n%s", diff)
+	}
+	if _, ok := mongoQuery["time"]; ok {
+		t.Errorf("Unexpected time query without startDate or endDate")
+	}
+}
+
+func TestStore_TagDateRange(t *testing.T) {
+	params := &Params{DateRanges: []Date{
+		{Start: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC)},
+		{Start: time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC)},
+	}}
+
+	tests := []struct {
+		time     time.Time
+		expected interface{}
+	}{
+		{time: time.Date(2021, 2, 28, 0, 0, 0, 0, time.UTC), expected: nil},
+		{time: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), expected: 0},
+		{time: time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC), expected: 0},
+		{time: time.Date(2021, 3, 9, 0, 0, 0, 0, time.UTC), expected: 1},
+	}
+	for _, test := range tests {
+		d := map[string]interface{}{"time": primitive.NewDateTimeFromTime(test.time)}
+		TagDateRange(params, d)
+		if d[RangeIndexField] != test.expected {
+			t.Errorf("TagDateRange of %s set %v, expected %v", test.time, d[RangeIndexField], test.expected)
+		}
+	}
+
+	d := map[string]interface{}{"time": primitive.NewDateTimeFromTime(time.Date(2021, 3, 9, 0, 0, 0, 0, time.UTC))}
+	TagDateRange(&Params{}, d)
+	if _, ok := d[RangeIndexField]; ok {
+		t.Errorf("TagDateRange set the range index without date ranges")
+	}
+}
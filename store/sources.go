@@ -0,0 +1,516 @@
+package store
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collections of the winning data source of a rule
+const (
+	SourceCollectionData        = "data"
+	SourceCollectionUploads     = "uploads"
+	SourceCollectionDataSources = "dataSources"
+)
+
+//go:embed source_rules.json
+var defaultSourceRules []byte
+
+// uploadsHintIndexDates are the dates from which the deviceDataSets indexes that may be hinted for the
+// losing uploads index them, as EnsureIndexes creates them. A hinted partial index only finds the
+// uploads it indexes, so a rule that hints one must not query uploads from before its date.
+var uploadsHintIndexDates = map[string]string{
+	"GetLoopableMedtronicDirectUploadIdsAfter_v2_DateTime": medtronicIndexDate,
+}
+
+// DataSourceRules are the rules that decide which of a user's overlapping data sources are returned.
+// They default to source_rules.json, and are replaced by the config if set.
+var DataSourceRules = mustParseSourceRules(defaultSourceRules)
+
+type (
+	// SourceRules are the data source rules, applied in order
+	SourceRules []SourceRule
+
+	// SourceRule excludes the data of a losing source once the user has data from the winning source.
+	// Only data of its Types is excluded, or all data if not set, and only data after After, if set.
+	SourceRule struct {
+		Name        string                `json:"name"`
+		Description string                `json:"description"`
+		Types       []string              `json:"types,omitempty"`
+		After       *time.Time            `json:"after,omitempty"`
+		Parameters  []SourceRuleParameter `json:"parameters,omitempty"`
+		// ApplyToUploadIDs applies the rule to queries for explicit upload IDs, which otherwise bypass it
+		ApplyToUploadIDs bool         `json:"applyToUploadIds,omitempty"`
+		Winner           SourceWinner `json:"winner"`
+		Loser            SourceLoser  `json:"loser"`
+	}
+
+	// SourceRuleParameter is a query parameter that decides whether a rule applies, whatever the user's
+	// data. Include is true if the parameter set to true includes the losing data e.g. carelink=true,
+	// or false if it applies the rule e.g. cbgFilter=true.
+	SourceRuleParameter struct {
+		Name    string `json:"name"`
+		Include bool   `json:"include"`
+	}
+
+	// SourceWinner matches the data, uploads or cloud data sources of the winning source
+	SourceWinner struct {
+		Collection string `json:"collection"`
+		Match      bson.M `json:"match,omitempty"`
+	}
+
+	// SourceLoser matches the losing data, by the data itself and/or by its uploads.
+	// ExceptWinnerUploads keeps the data of the winning uploads or data sources' data sets, and
+	// DuringWinnerData only excludes data while the winning source has data. UploadsHint names the
+	// deviceDataSets index with which the losing uploads are queried.
+	SourceLoser struct {
+		Match               bson.M `json:"match,omitempty"`
+		Uploads             bson.M `json:"uploads,omitempty"`
+		UploadsHint         string `json:"uploadsHint,omitempty"`
+		ExceptWinnerUploads bool   `json:"exceptWinnerUploads,omitempty"`
+		DuringWinnerData    bool   `json:"duringWinnerData,omitempty"`
+	}
+
+	// SourceSelection is the outcome of a rule for a query: whether it fired, why, and the data it excludes
+	SourceSelection struct {
+		Rule             string
+		Fired            bool
+		Reason           string
+		ApplyToUploadIDs bool
+		Exclusion        *SourceExclusion
+	}
+
+	// SourceExclusion is data excluded by a rule. Data is excluded if it matches all of the set fields:
+	// one of its Types, its Match, one of its UploadIDs or none of its ExceptUploadIDs, and one of
+	// its TimeRanges.
+	SourceExclusion struct {
+		Types           []string
+		Match           bson.M
+		UploadIDs       []string
+		ExceptUploadIDs []string
+		TimeRanges      []Date
+	}
+
+	// sourceWinner is the winning source of a rule found for a user
+	sourceWinner struct {
+		found      bool
+		uploadIDs  []string
+		timeRanges []Date
+	}
+)
+
+func mustParseSourceRules(data []byte) SourceRules {
+	rules := SourceRules{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		panic(fmt.Sprintf("source rules not valid: %s", err))
+	}
+	if err := rules.Validate(); err != nil {
+		panic(fmt.Sprintf("source rules not valid: %s", err))
+	}
+	return rules
+}
+
+// Validate checks that the rules are named uniquely and that each selects its winning and losing data
+func (r SourceRules) Validate() error {
+	names := map[string]bool{}
+	parameters := map[string]bool{}
+	for _, rule := range r {
+		if rule.Name == "" {
+			return errors.New("source rule name is missing")
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("source rule %s is duplicated", rule.Name)
+		}
+		names[rule.Name] = true
+
+		for _, parameter := range rule.Parameters {
+			if parameter.Name == "" {
+				return fmt.Errorf("source rule %s parameter name is missing", rule.Name)
+			}
+			if parameters[parameter.Name] {
+				return fmt.Errorf("source rule %s parameter %s is duplicated", rule.Name, parameter.Name)
+			}
+			parameters[parameter.Name] = true
+		}
+
+		switch rule.Winner.Collection {
+		case SourceCollectionData:
+			if rule.Loser.ExceptWinnerUploads {
+				return fmt.Errorf("source rule %s winner collection %s has no uploads", rule.Name, rule.Winner.Collection)
+			}
+		case SourceCollectionUploads, SourceCollectionDataSources:
+		default:
+			return fmt.Errorf("source rule %s winner collection %q not valid", rule.Name, rule.Winner.Collection)
+		}
+		if rule.Loser.UploadsHint != "" {
+			indexDate, ok := uploadsHintIndexDates[rule.Loser.UploadsHint]
+			if !ok {
+				return fmt.Errorf("source rule %s uploads hint %s not valid", rule.Name, rule.Loser.UploadsHint)
+			}
+			indexTime, _ := time.Parse(medtronicDateFormat, indexDate)
+			if rule.After == nil || rule.After.Before(indexTime) {
+				return fmt.Errorf("source rule %s must be after %s, from which its uploads hint indexes", rule.Name, indexDate)
+			}
+		}
+		if len(rule.Loser.Match) == 0 && len(rule.Loser.Uploads) == 0 && !rule.Loser.ExceptWinnerUploads {
+			return fmt.Errorf("source rule %s loser is missing", rule.Name)
+		}
+
+		// The user is always the user of the query
+		for _, match := range []bson.M{rule.Winner.Match, rule.Loser.Match, rule.Loser.Uploads} {
+			for key := range match {
+				if key == "_userId" || key == "userId" {
+					return fmt.Errorf("source rule %s matches %s", rule.Name, key)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ParameterNames returns the names of the query parameters of the rules
+func (r SourceRules) ParameterNames() []string {
+	names := []string{}
+	for _, rule := range r {
+		for _, parameter := range rule.Parameters {
+			names = append(names, parameter.Name)
+		}
+	}
+	return names
+}
+
+// parseSourceRuleOverrides parses the query parameters of the rules into whether each rule applies.
+// The first parameter of a rule in the query decides, and rules without parameters in the query are
+// decided by the user's data.
+func parseSourceRuleOverrides(q url.Values, rules SourceRules) (map[string]bool, error) {
+	var overrides map[string]bool
+	for _, rule := range rules {
+		for _, parameter := range rule.Parameters {
+			values, ok := q[parameter.Name]
+			if !ok {
+				continue
+			}
+			if len(values) < 1 {
+				return nil, fmt.Errorf("%s parameter not valid", parameter.Name)
+			}
+			value, err := strconv.ParseBool(values[len(values)-1])
+			if err != nil {
+				return nil, fmt.Errorf("%s parameter not valid", parameter.Name)
+			}
+			if overrides == nil {
+				overrides = map[string]bool{}
+			}
+			overrides[rule.Name] = value != parameter.Include
+			break
+		}
+	}
+	return overrides, nil
+}
+
+// sourceRuleParameterReason returns the reason a rule was decided by a query parameter
+func sourceRuleParameterReason(q url.Values, rule SourceRule) string {
+	for _, parameter := range rule.Parameters {
+		if _, ok := q[parameter.Name]; ok {
+			return parameter.Name + " parameter is " + q.Get(parameter.Name)
+		}
+	}
+	return ""
+}
+
+// dataSourcesWinner returns the data set IDs of the cloud data sources, and the range of times of the
+// data of each data source that records both its earliest and latest data time
+func dataSourcesWinner(dataSources []bson.M) ([]string, []Date) {
+	dataSetIDs := []string{}
+	dataDates := []Date{}
+	for _, dataSource := range dataSources {
+		if ids, ok := dataSource["dataSetIds"].(primitive.A); ok && len(ids) > 0 {
+			for _, id := range ids {
+				if dataSetID, ok := id.(string); ok {
+					dataSetIDs = append(dataSetIDs, dataSetID)
+				}
+			}
+			if earliestDataTime, ok := dataSource["earliestDataTime"].(primitive.DateTime); ok {
+				if latestDataTime, ok := dataSource["latestDataTime"].(primitive.DateTime); ok {
+					dataDates = append(dataDates, Date{earliestDataTime.Time().UTC(), latestDataTime.Time().UTC()})
+				}
+			}
+		}
+	}
+	return dataSetIDs, dataDates
+}
+
+// mergeMatch adds the fields of the match to the query
+func mergeMatch(query bson.M, match bson.M) bson.M {
+	for key, value := range match {
+		query[key] = value
+	}
+	return query
+}
+
+// afterQuery returns the query of the times after the rule's boundary, if it has one
+func (r SourceRule) afterQuery(query bson.M) bson.M {
+	if r.After != nil {
+		query["time"] = bson.M{"$gte": *r.After}
+	}
+	return query
+}
+
+// query returns the conditions of the data not excluded, any of which keeps the data
+func (e *SourceExclusion) query() []bson.M {
+	conditions := []bson.M{}
+	if len(e.ExceptUploadIDs) > 0 {
+		conditions = append(conditions, bson.M{"uploadId": bson.M{"$in": e.ExceptUploadIDs}})
+	}
+	switch {
+	case len(e.TimeRanges) == 1 && e.TimeRanges[0].End.IsZero():
+		conditions = append(conditions, bson.M{"time": bson.M{"$lt": e.TimeRanges[0].Start}})
+	case len(e.TimeRanges) > 0:
+		timeRanges := []bson.M{}
+		for _, date := range e.TimeRanges {
+			timeRanges = append(timeRanges, bson.M{"time": date.query()})
+		}
+		conditions = append(conditions, bson.M{"$nor": timeRanges})
+	}
+	switch len(e.Types) {
+	case 0:
+	case 1:
+		conditions = append(conditions, bson.M{"type": bson.M{"$ne": e.Types[0]}})
+	default:
+		conditions = append(conditions, bson.M{"type": bson.M{"$nin": e.Types}})
+	}
+	if len(e.UploadIDs) > 0 {
+		conditions = append(conditions, bson.M{"uploadId": bson.M{"$nin": e.UploadIDs}})
+	}
+	if len(e.Match) > 0 {
+		conditions = append(conditions, notMatchQuery(e.Match))
+	}
+	return conditions
+}
+
+// notMatchQuery returns the query of the data that doesn't match, as `$ne` for a single value
+func notMatchQuery(match bson.M) bson.M {
+	if len(match) == 1 {
+		for key, value := range match {
+			if _, ok := value.(map[string]interface{}); !ok && !strings.HasPrefix(key, "$") {
+				return bson.M{key: bson.M{"$ne": value}}
+			}
+		}
+	}
+	return bson.M{"$nor": []bson.M{match}}
+}
+
+// sourceSelectionsQuery adds the conditions of the data excluded by the source selections to the
+// query. Explicit upload IDs bypass the rules that don't apply to them.
+func sourceSelectionsQuery(p *Params, query bson.M, andQuery []bson.M) []bson.M {
+	for _, selection := range p.SourceSelections {
+		if selection.Exclusion == nil || (len(p.UploadIDs) > 0 && !selection.ApplyToUploadIDs) {
+			continue
+		}
+		conditions := selection.Exclusion.query()
+		if len(conditions) == 1 && len(conditions[0]) == 1 {
+			merged := false
+			for key, value := range conditions[0] {
+				if _, ok := query[key]; !ok && !strings.HasPrefix(key, "$") {
+					query[key] = value
+					merged = true
+				}
+			}
+			if merged {
+				continue
+			}
+		}
+		andQuery = append(andQuery, bson.M{"$or": conditions})
+	}
+	return andQuery
+}
+
+// SelectSources evaluates the rule for the user of the parameters, and adds its selection to them.
+// The query decides whether the rule was set by a parameter.
+func (c *MongoStoreClient) SelectSources(p *Params, rule SourceRule, q url.Values) error {
+	selection, err := c.selectSources(p, rule, q)
+	if err != nil {
+		return err
+	}
+	p.SourceSelections = append(p.SourceSelections, selection)
+	return nil
+}
+
+func (c *MongoStoreClient) selectSources(p *Params, rule SourceRule, q url.Values) (SourceSelection, error) {
+	selection := SourceSelection{Rule: rule.Name, ApplyToUploadIDs: rule.ApplyToUploadIDs}
+	if p.UserID == "" {
+		return selection, errors.New("user id is missing")
+	}
+
+	applies, explicit := p.SourceRuleOverrides[rule.Name]
+	if explicit && !applies {
+		selection.Reason = sourceRuleParameterReason(q, rule)
+		return selection, nil
+	}
+
+	// An explicit rule only needs the winning source if it excludes data by it
+	winner := sourceWinner{found: true}
+	if !explicit || rule.Loser.ExceptWinnerUploads || rule.Loser.DuringWinnerData {
+		var err error
+		if winner, err = c.findSourceWinner(p.UserID, rule); err != nil {
+			return selection, err
+		}
+		if !winner.found {
+			selection.Reason = "the user has no data from the winning source"
+			return selection, nil
+		}
+	}
+
+	exclusion := &SourceExclusion{Types: rule.Types, Match: rule.Loser.Match}
+	if rule.Loser.ExceptWinnerUploads {
+		exclusion.ExceptUploadIDs = winner.uploadIDs
+	}
+	if rule.Loser.DuringWinnerData {
+		exclusion.TimeRanges = winner.timeRanges
+	}
+	if len(exclusion.TimeRanges) == 0 && rule.After != nil {
+		exclusion.TimeRanges = []Date{{Start: *rule.After}}
+	}
+	if len(rule.Loser.Uploads) > 0 {
+		uploadIDs, err := c.findSourceLoserUploads(p.UserID, rule)
+		if err != nil {
+			return selection, err
+		}
+		if len(uploadIDs) == 0 {
+			selection.Reason = "the user has no uploads from the losing source"
+			return selection, nil
+		}
+		exclusion.UploadIDs = uploadIDs
+	}
+
+	selection.Fired = true
+	if explicit {
+		selection.Reason = sourceRuleParameterReason(q, rule)
+	} else {
+		selection.Reason = rule.Description
+	}
+	selection.Exclusion = exclusion
+	return selection, nil
+}
+
+// findSourceWinner finds the winning source of the rule for the user, with the upload IDs and time
+// ranges of its data if the losing data depends on them
+func (c *MongoStoreClient) findSourceWinner(userID string, rule SourceRule) (sourceWinner, error) {
+	winner := sourceWinner{}
+	needsUploads := rule.Loser.ExceptWinnerUploads || rule.Loser.DuringWinnerData
+
+	switch rule.Winner.Collection {
+	case SourceCollectionDataSources:
+		dataSources, err := c.findDataSources(userID, rule.Winner.Match)
+		if err != nil {
+			return winner, err
+		}
+		winner.uploadIDs, winner.timeRanges = dataSourcesWinner(dataSources)
+		winner.found = len(winner.uploadIDs) > 0
+		return winner, nil
+
+	case SourceCollectionUploads:
+		query := rule.afterQuery(mergeMatch(bson.M{"_userId": userID, "_active": true, "type": "upload"}, rule.Winner.Match))
+		if !needsUploads {
+			return c.findOne(dataSetsCollection(c), query)
+		}
+		uploadIDs, err := c.findUploadIDs(query, "")
+		if err != nil {
+			return winner, err
+		}
+		winner.uploadIDs = uploadIDs
+		winner.found = len(uploadIDs) > 0
+		if winner.found && rule.Loser.DuringWinnerData {
+			winner.timeRanges, err = c.findDataTimeRange(rule.afterQuery(bson.M{"_userId": userID, "_active": true, "uploadId": bson.M{"$in": uploadIDs}}), rule.Types)
+		}
+		return winner, err
+
+	default:
+		query := rule.afterQuery(mergeMatch(bson.M{"_userId": userID, "_active": true}, rule.Winner.Match))
+		if !rule.Loser.DuringWinnerData {
+			return c.findOne(dataCollection(c), query)
+		}
+		timeRanges, err := c.findDataTimeRange(query, rule.Types)
+		if err != nil {
+			return winner, err
+		}
+		winner.timeRanges = timeRanges
+		winner.found = len(timeRanges) > 0
+		return winner, nil
+	}
+}
+
+// findSourceLoserUploads finds the IDs of the uploads of the losing source of the rule for the user
+func (c *MongoStoreClient) findSourceLoserUploads(userID string, rule SourceRule) ([]string, error) {
+	return c.findUploadIDs(rule.afterQuery(mergeMatch(bson.M{"_userId": userID, "_active": true, "type": "upload"}, rule.Loser.Uploads)), rule.Loser.UploadsHint)
+}
+
+func (c *MongoStoreClient) findOne(collection *mongo.Collection, query bson.M) (sourceWinner, error) {
+	err := collection.FindOne(c.context, query).Err()
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return sourceWinner{}, err
+	}
+	return sourceWinner{found: err == nil}, nil
+}
+
+func (c *MongoStoreClient) findUploadIDs(query bson.M, hint string) ([]string, error) {
+	opts := options.Find().SetProjection(bson.M{"_id": 0, "uploadId": 1})
+	if hint != "" {
+		opts.SetHint(hint)
+	}
+	cursor, err := dataSetsCollection(c).Find(c.context, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c.context)
+
+	var objects []struct {
+		UploadID string `bson:"uploadId"`
+	}
+	if err = cursor.All(c.context, &objects); err != nil {
+		return nil, err
+	}
+
+	uploadIDs := make([]string, len(objects))
+	for index, object := range objects {
+		uploadIDs[index] = object.UploadID
+	}
+	return uploadIDs, nil
+}
+
+// findDataTimeRange finds the range of times of the data of the types, or all data if not set
+func (c *MongoStoreClient) findDataTimeRange(query bson.M, types []string) ([]Date, error) {
+	if len(types) > 0 {
+		query["type"] = bson.M{"$in": types}
+	}
+	pipeline := []bson.M{
+		{"$match": query},
+		{"$group": bson.M{"_id": nil, "start": bson.M{"$min": "$time"}, "end": bson.M{"$max": "$time"}}},
+	}
+	cursor, err := dataCollection(c).Aggregate(c.context, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c.context)
+
+	var results []struct {
+		Start time.Time `bson:"start"`
+		End   time.Time `bson:"end"`
+	}
+	if err = cursor.All(c.context, &results); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 || results[0].Start.IsZero() {
+		return nil, nil
+	}
+	return []Date{{Start: results[0].Start.UTC(), End: results[0].End.UTC()}}, nil
+}
@@ -0,0 +1,440 @@
+package store
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestStore_DataSourceRules_default(t *testing.T) {
+	names := []string{}
+	for _, rule := range DataSourceRules {
+		names = append(names, rule.Name)
+	}
+	if diff := cmp.Diff([]string{"carelink", "cbgFilter", "medtronic"}, names); diff != "" {
+		t.Errorf("Unexpected default rules (-want +have):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"carelink", "cbgFilter", "dexcom", "medtronic"}, DataSourceRules.ParameterNames()); diff != "" {
+		t.Errorf("Unexpected default rule parameters (-want +have):\n%s", diff)
+	}
+
+	medtronic := DataSourceRules[2]
+	if medtronic.After == nil || !medtronic.After.Equal(time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected medtronic boundary %v", medtronic.After)
+	}
+	if medtronic.Loser.UploadsHint != "GetLoopableMedtronicDirectUploadIdsAfter_v2_DateTime" {
+		t.Errorf("Unexpected medtronic uploads hint %q", medtronic.Loser.UploadsHint)
+	}
+}
+
+func TestStore_SourceRules_Validate(t *testing.T) {
+	valid := func() SourceRule {
+		return SourceRule{
+			Name:   "cgm",
+			Types:  []string{"cbg"},
+			Winner: SourceWinner{Collection: SourceCollectionUploads, Match: bson.M{"client.name": "org.tidepool.cgm"}},
+			Loser:  SourceLoser{Uploads: bson.M{"client.name": "com.example.cgm"}, DuringWinnerData: true},
+		}
+	}
+	if err := (SourceRules{valid()}).Validate(); err != nil {
+		t.Errorf("Validate returned error %s", err)
+	}
+
+	duplicated := valid()
+	duplicated.Parameters = []SourceRuleParameter{{Name: "cgm"}}
+	invalid := map[string]func(rule *SourceRule){
+		"source rule name is missing":                    func(rule *SourceRule) { rule.Name = "" },
+		`source rule cgm winner collection "" not valid`: func(rule *SourceRule) { rule.Winner.Collection = "" },
+		"source rule cgm winner collection data has no uploads": func(rule *SourceRule) {
+			rule.Winner.Collection = SourceCollectionData
+			rule.Loser.ExceptWinnerUploads = true
+		},
+		"source rule cgm loser is missing":            func(rule *SourceRule) { rule.Loser.Uploads = nil },
+		"source rule cgm matches _userId":             func(rule *SourceRule) { rule.Loser.Uploads["_userId"] = "abc123" },
+		"source rule cgm parameter name is missing":   func(rule *SourceRule) { rule.Parameters = []SourceRuleParameter{{}} },
+		"source rule cgm uploads hint blah not valid": func(rule *SourceRule) { rule.Loser.UploadsHint = "blah" },
+		"source rule cgm must be after 2017-09-01, from which its uploads hint indexes": func(rule *SourceRule) {
+			rule.Loser.UploadsHint = "GetLoopableMedtronicDirectUploadIdsAfter_v2_DateTime"
+			rule.After = ptr(time.Date(2017, 8, 31, 0, 0, 0, 0, time.UTC))
+		},
+	}
+	for expected, modify := range invalid {
+		rule := valid()
+		modify(&rule)
+		if err := (SourceRules{rule}).Validate(); err == nil || err.Error() != expected {
+			t.Errorf("Validate returned error %v, expected %s", err, expected)
+		}
+	}
+	if err := (SourceRules{valid(), duplicated}).Validate(); err == nil || err.Error() != "source rule cgm is duplicated" {
+		t.Errorf("Validate returned error %v for duplicated rules", err)
+	}
+}
+
+func TestStore_SourceRules_config(t *testing.T) {
+	config := `[{"name": "cgm", "types": ["cbg"], "after": "2021-01-01T00:00:00Z", "parameters": [{"name": "cgm", "include": true}],
+		"winner": {"collection": "data", "match": {"origin.name": "org.tidepool.cgm"}},
+		"loser": {"match": {"origin.name": {"$in": ["com.example.cgm"]}}}}]`
+	rules := SourceRules{}
+	if err := json.Unmarshal([]byte(config), &rules); err != nil {
+		t.Fatalf("Unmarshal returned error %s", err)
+	}
+	if err := rules.Validate(); err != nil {
+		t.Fatalf("Validate returned error %s", err)
+	}
+
+	exclusion := SourceExclusion{Types: rules[0].Types, Match: rules[0].Loser.Match, TimeRanges: []Date{{Start: *rules[0].After}}}
+	expected := []bson.M{
+		{"time": bson.M{"$lt": time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}},
+		{"type": bson.M{"$ne": "cbg"}},
+		{"$nor": []bson.M{{"origin.name": map[string]interface{}{"$in": []interface{}{"com.example.cgm"}}}}},
+	}
+	if !reflect.DeepEqual(expected, exclusion.query()) {
+		t.Errorf("Unexpected exclusion query %v", exclusion.query())
+	}
+}
+
+func TestStore_parseSourceRuleOverrides(t *testing.T) {
+	overrides, err := parseSourceRuleOverrides(url.Values{"carelink": []string{"true"}, "dexcom": []string{"false"}, "medtronic": []string{"true", "false"}}, DataSourceRules)
+	if err != nil {
+		t.Fatalf("parseSourceRuleOverrides returned error %s", err)
+	}
+	if diff := cmp.Diff(map[string]bool{"carelink": false, "cbgFilter": true, "medtronic": true}, overrides); diff != "" {
+		t.Errorf("Unexpected overrides (-want +have):\n%s", diff)
+	}
+
+	// The first parameter of a rule decides
+	overrides, _ = parseSourceRuleOverrides(url.Values{"cbgFilter": []string{"false"}, "dexcom": []string{"false"}}, DataSourceRules)
+	if diff := cmp.Diff(map[string]bool{"cbgFilter": false}, overrides); diff != "" {
+		t.Errorf("Unexpected overrides (-want +have):\n%s", diff)
+	}
+
+	if overrides, err := parseSourceRuleOverrides(url.Values{}, DataSourceRules); err != nil || overrides != nil {
+		t.Errorf("parseSourceRuleOverrides returned %v, %v without parameters", overrides, err)
+	}
+	if _, err := parseSourceRuleOverrides(url.Values{"dexcom": []string{"blah"}}, DataSourceRules); err == nil || err.Error() != "dexcom parameter not valid" {
+		t.Errorf("parseSourceRuleOverrides returned error %v", err)
+	}
+}
+
+func TestStore_dataSourcesWinner(t *testing.T) {
+	earliestDataTime, _ := time.Parse(time.RFC3339, "2015-10-07T15:00:00Z")
+	latestDataTime, _ := time.Parse(time.RFC3339, "2016-12-13T02:00:00Z")
+
+	uploadIDs, dates := dataSourcesWinner(cbgCloudDataSources())
+	if diff := cmp.Diff([]string{"123", "456", "789", "ABC", "DEF", "GHI", "JKL"}, uploadIDs); diff != "" {
+		t.Errorf("Unexpected upload IDs (-want +have):\n%s", diff)
+	}
+	// Only the data sources with both their earliest and latest data times have a range
+	expected := []Date{
+		{Start: earliestDataTime.Add(-24 * time.Hour), End: latestDataTime.Add(-24 * time.Hour)},
+		{Start: earliestDataTime.Add(24 * time.Hour), End: latestDataTime.Add(24 * time.Hour)},
+	}
+	if diff := cmp.Diff(expected, dates); diff != "" {
+		t.Errorf("Unexpected dates (-want +have):\n%s", diff)
+	}
+}
+
+func TestStore_generateMongoQuery_sourceSelections(t *testing.T) {
+	params := &Params{
+		UserID: "abc123",
+		Types:  []string{"cbg"},
+		SourceSelections: []SourceSelection{
+			carelinkSelection(),
+			{Rule: "notFired", Reason: "the user has no data from the winning source"},
+			{Rule: "source", Fired: true, Exclusion: &SourceExclusion{Match: bson.M{"source": "example"}}},
+		},
+	}
+
+	// The first single condition is merged, as the source is not otherwise queried
+	expected := bson.M{
+		"_userId": "abc123",
+		"_active": true,
+		"type":    bson.M{"$in": []string{"cbg"}},
+		"source":  bson.M{"$ne": "carelink"},
+		"$and":    []bson.M{{"$or": []bson.M{{"source": bson.M{"$ne": "example"}}}}},
+	}
+	if query := generateMongoQuery(params); !reflect.DeepEqual(query, expected) {
+		t.Error(getErrString(query, expected))
+	}
+
+	// Rules that don't apply to explicit uploads are bypassed
+	params.UploadIDs = []string{"xyz123"}
+	expected["uploadId"] = "xyz123"
+	delete(expected, "$and")
+	if query := generateMongoQuery(params); !reflect.DeepEqual(query, expected) {
+		t.Error(getErrString(query, expected))
+	}
+}
+
+func TestStore_SelectSources(t *testing.T) {
+	loopTime, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
+	uploadTime, _ := time.Parse(time.RFC3339, "2018-01-01T00:00:00Z")
+	boundary := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	// We keep _schemaVersion in the test data until BACK-1281 is completed.
+	store := before(t, TestDataSchema{
+		Active:        ptr(true),
+		UserId:        ptr("1234567890"),
+		SchemaVersion: ptr(1),
+		Time:          ptr(loopTime),
+		Type:          ptr("basal"),
+		Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Medtronic"}}}),
+	}, TestDataSchema{
+		Active:        ptr(true),
+		UserId:        ptr("1234567890"),
+		SchemaVersion: ptr(1),
+		Time:          ptr(uploadTime),
+		Type:          ptr("upload"),
+		DeviceModel:   ptr("554"),
+		UploadId:      ptr("555666777"),
+	})
+
+	params := &Params{UserID: "1234567890"}
+	for _, rule := range DataSourceRules {
+		if err := store.SelectSources(params, rule, url.Values{}); err != nil {
+			t.Fatalf("SelectSources %s returned error %s", rule.Name, err)
+		}
+	}
+
+	expected := []SourceSelection{
+		{Rule: "carelink", Reason: "the user has no data from the winning source", ApplyToUploadIDs: true},
+		{Rule: "cbgFilter", Reason: "the user has no data from the winning source"},
+		{
+			Rule:      "medtronic",
+			Fired:     true,
+			Reason:    DataSourceRules[2].Description,
+			Exclusion: &SourceExclusion{Types: []string{"basal", "bolus", "cbg"}, UploadIDs: []string{"555666777"}, TimeRanges: []Date{{Start: boundary}}},
+		},
+	}
+	if diff := cmp.Diff(expected, params.SourceSelections); diff != "" {
+		t.Errorf("Unexpected source selections (-want +have):\n%s", diff)
+	}
+
+	// An explicit parameter decides, whatever the user's data
+	params = &Params{UserID: "1234567890", SourceRuleOverrides: map[string]bool{"medtronic": false}}
+	if err := store.SelectSources(params, DataSourceRules[2], url.Values{"medtronic": []string{"true"}}); err != nil {
+		t.Fatalf("SelectSources returned error %s", err)
+	}
+	if selection := params.SourceSelections[0]; selection.Fired || selection.Reason != "medtronic parameter is true" {
+		t.Errorf("Unexpected source selection %v", selection)
+	}
+}
+
+func TestStore_SelectSources_winnersAndLosers(t *testing.T) {
+	deletedTime, _ := time.Parse(time.RFC3339, "2017-05-18T03:10:26Z")
+	loopTime, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
+	beforeBoundary, _ := time.Parse(time.RFC3339, "2017-08-31T23:59:59Z")
+	boundary := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	carelinkUpload := func(modify func(upload *TestDataSchema)) TestDataSchema {
+		upload := TestDataSchema{
+			UserId:              ptr("1234567890"),
+			Type:                ptr("upload"),
+			State:               ptr("closed"),
+			Active:              ptr(true),
+			DeviceManufacturers: ptr("Medtronic"),
+		}
+		if modify != nil {
+			modify(&upload)
+		}
+		return upload
+	}
+	// We keep _schemaVersion in the test data until BACK-1281 is completed.
+	loopData := func(modify func(datum *TestDataSchema)) TestDataSchema {
+		datum := TestDataSchema{
+			Active:        ptr(true),
+			UserId:        ptr("1234567890"),
+			SchemaVersion: ptr(1),
+			Time:          ptr(loopTime),
+			Type:          ptr("basal"),
+			Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Medtronic"}}}),
+		}
+		if modify != nil {
+			modify(&datum)
+		}
+		return datum
+	}
+	medtronicUpload := func(modify func(upload *TestDataSchema)) TestDataSchema {
+		upload := TestDataSchema{
+			Active:        ptr(true),
+			UserId:        ptr("1234567890"),
+			SchemaVersion: ptr(1),
+			Time:          ptr(loopTime),
+			Type:          ptr("upload"),
+			DeviceModel:   ptr("554"),
+			UploadId:      ptr("555666777"),
+		}
+		if modify != nil {
+			modify(&upload)
+		}
+		return upload
+	}
+
+	noWinner := "the user has no data from the winning source"
+	noLoser := "the user has no uploads from the losing source"
+	carelink := DataSourceRules[0]
+	medtronic := DataSourceRules[2]
+	medtronicExclusion := &SourceExclusion{Types: []string{"basal", "bolus", "cbg"}, UploadIDs: []string{"555666777"}, TimeRanges: []Date{{Start: boundary}}}
+
+	tests := []struct {
+		name      string
+		rule      SourceRule
+		docs      []interface{}
+		reason    string
+		exclusion *SourceExclusion
+	}{
+		{
+			name:      "carelink winner upload",
+			rule:      carelink,
+			docs:      []interface{}{carelinkUpload(nil)},
+			reason:    carelink.Description,
+			exclusion: &SourceExclusion{Match: carelink.Loser.Match},
+		},
+		{
+			name:   "carelink winner upload deleted",
+			rule:   carelink,
+			docs:   []interface{}{carelinkUpload(func(upload *TestDataSchema) { upload.DeletedTime = ptr(deletedTime) })},
+			reason: noWinner,
+		},
+		{
+			name:   "carelink winner upload not closed",
+			rule:   carelink,
+			docs:   []interface{}{carelinkUpload(func(upload *TestDataSchema) { upload.State = ptr("open") })},
+			reason: noWinner,
+		},
+		{
+			name:   "carelink winner upload not active",
+			rule:   carelink,
+			docs:   []interface{}{carelinkUpload(func(upload *TestDataSchema) { upload.Active = ptr(false) })},
+			reason: noWinner,
+		},
+		{
+			name:   "carelink winner upload of another manufacturer",
+			rule:   carelink,
+			docs:   []interface{}{carelinkUpload(func(upload *TestDataSchema) { upload.DeviceManufacturers = ptr("Acme") })},
+			reason: noWinner,
+		},
+		{
+			name:   "carelink winner of another type",
+			rule:   carelink,
+			docs:   []interface{}{carelinkUpload(func(upload *TestDataSchema) { upload.Type = ptr("cgm") })},
+			reason: noWinner,
+		},
+		{
+			name:   "carelink winner upload of another user",
+			rule:   carelink,
+			docs:   []interface{}{carelinkUpload(func(upload *TestDataSchema) { upload.UserId = ptr("0000000000") })},
+			reason: noWinner,
+		},
+		{
+			name: "carelink winner upload among others",
+			rule: carelink,
+			docs: []interface{}{
+				carelinkUpload(func(upload *TestDataSchema) { upload.UserId = ptr("0000000000") }),
+				carelinkUpload(func(upload *TestDataSchema) { upload.State = ptr("open") }),
+				carelinkUpload(func(upload *TestDataSchema) { upload.DeletedTime = ptr(deletedTime) }),
+				carelinkUpload(nil),
+			},
+			reason:    carelink.Description,
+			exclusion: &SourceExclusion{Match: carelink.Loser.Match},
+		},
+		{
+			name:      "medtronic loop data and upload",
+			rule:      medtronic,
+			docs:      []interface{}{loopData(nil), medtronicUpload(nil)},
+			reason:    medtronic.Description,
+			exclusion: medtronicExclusion,
+		},
+		{
+			name:      "medtronic loop data and upload at the boundary",
+			rule:      medtronic,
+			docs:      []interface{}{loopData(func(datum *TestDataSchema) { datum.Time = ptr(boundary) }), medtronicUpload(func(upload *TestDataSchema) { upload.Time = ptr(boundary) })},
+			reason:    medtronic.Description,
+			exclusion: medtronicExclusion,
+		},
+		{
+			name:   "medtronic loop data before the boundary",
+			rule:   medtronic,
+			docs:   []interface{}{loopData(func(datum *TestDataSchema) { datum.Time = ptr(beforeBoundary) }), medtronicUpload(nil)},
+			reason: noWinner,
+		},
+		{
+			name:   "medtronic loop data not active",
+			rule:   medtronic,
+			docs:   []interface{}{loopData(func(datum *TestDataSchema) { datum.Active = ptr(false) }), medtronicUpload(nil)},
+			reason: noWinner,
+		},
+		{
+			name: "medtronic loop data of another manufacturer",
+			rule: medtronic,
+			docs: []interface{}{
+				loopData(func(datum *TestDataSchema) {
+					datum.Origin = ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Animas"}}})
+				}),
+				medtronicUpload(nil),
+			},
+			reason: noWinner,
+		},
+		{
+			name:   "medtronic loop data of another user",
+			rule:   medtronic,
+			docs:   []interface{}{loopData(func(datum *TestDataSchema) { datum.UserId = ptr("0000000000") }), medtronicUpload(nil)},
+			reason: noWinner,
+		},
+		{
+			name:   "medtronic upload before the boundary",
+			rule:   medtronic,
+			docs:   []interface{}{loopData(nil), medtronicUpload(func(upload *TestDataSchema) { upload.Time = ptr(beforeBoundary) })},
+			reason: noLoser,
+		},
+		{
+			name:   "medtronic upload of a model that can't loop",
+			rule:   medtronic,
+			docs:   []interface{}{loopData(nil), medtronicUpload(func(upload *TestDataSchema) { upload.DeviceModel = ptr("751") })},
+			reason: noLoser,
+		},
+		{
+			name:   "medtronic upload not active",
+			rule:   medtronic,
+			docs:   []interface{}{loopData(nil), medtronicUpload(func(upload *TestDataSchema) { upload.Active = ptr(false) })},
+			reason: noLoser,
+		},
+		{
+			name:   "medtronic upload of another user",
+			rule:   medtronic,
+			docs:   []interface{}{loopData(nil), medtronicUpload(func(upload *TestDataSchema) { upload.UserId = ptr("0000000000") })},
+			reason: noLoser,
+		},
+	}
+	for _, test := range tests {
+		store := before(t, test.docs...)
+		// The losing uploads are queried with an index hint
+		if err := store.EnsureIndexes(); err != nil {
+			t.Fatalf("%s: EnsureIndexes returned error %s", test.name, err)
+		}
+
+		params := &Params{UserID: "1234567890"}
+		if err := store.SelectSources(params, test.rule, url.Values{}); err != nil {
+			t.Fatalf("%s: SelectSources returned error %s", test.name, err)
+		}
+		expected := SourceSelection{
+			Rule:             test.rule.Name,
+			Fired:            test.exclusion != nil,
+			Reason:           test.reason,
+			ApplyToUploadIDs: test.rule.ApplyToUploadIDs,
+			Exclusion:        test.exclusion,
+		}
+		if diff := cmp.Diff(expected, params.SourceSelections[0]); diff != "" {
+			t.Errorf("%s: unexpected source selection (-want +have):\n%s", test.name, diff)
+		}
+	}
+
+	if err := before(t).SelectSources(&Params{}, carelink, url.Values{}); err == nil || err.Error() != "user id is missing" {
+		t.Errorf("SelectSources returned error %v without a user", err)
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -34,6 +33,7 @@ type (
 		Next(context.Context) bool
 		Decode(interface{}) error
 		Close(context.Context) error
+		Err() error
 	}
 	// Storage - Interface for our storage layer
 	Storage interface {
@@ -54,30 +54,34 @@ type (
 		Maximum int
 	}
 
-	// FieldFilter is a map with field names and a list of values to filter by
-	FieldFilter map[string][]string
-
-	// TypeFieldFilter is a map with types to which to apply field filters
-	TypeFieldFilter map[string]FieldFilter
-
 	// Params struct
 	Params struct {
 		UserID          string
 		Types           []string
+		ExcludeTypes    []string
 		SubTypes        []string
 		TypeFieldFilter TypeFieldFilter
+		TimeOfDay       *TimeOfDay
+		DaysOfWeek      []time.Weekday
+		DateRanges      []Date
 		Date
 		*SchemaVersion
-		Carelink              bool
-		CBGFilter             bool
-		CBGCloudDataSources   []bson.M
-		DeviceID              string
+		SourceRuleOverrides   map[string]bool
+		SourceSelections      []SourceSelection
+		DeviceIDs             []string
+		ExcludeDeviceIDs      []string
 		Latest                bool
-		Medtronic             bool
-		MedtronicDate         string
-		MedtronicUploadIds    []string
-		UploadID              string
+		LatestCount           int
+		LatestBy              string
+		UploadIDs             []string
+		ExcludeUploadIDs      []string
 		SampleIntervalMinimum int
+		Limit                 int
+		Cursor                *Cursor
+		Sort                  int
+		Fields                []string
+		Dedupe                bool
+		Explain               string
 	}
 
 	// Date struct
@@ -100,12 +104,6 @@ type (
 	}
 )
 
-var AllowedFieldFilters = TypeFieldFilter{
-	"dosingDecision": FieldFilter{
-		"reason": nil,
-	},
-}
-
 func cleanDateString(dateString string) (time.Time, error) {
 	date := time.Time{}
 
@@ -123,66 +121,50 @@ func cleanDateString(dateString string) (time.Time, error) {
 
 // GetParams parses a URL to set parameters
 func GetParams(q url.Values, schema *SchemaVersion) (*Params, error) {
-	startDate, err := cleanDateString(q.Get("startDate"))
+	// Date only start and end dates are in the timezone, if set
+	location, err := ParseTimezone(q.Get("timezone"))
 	if err != nil {
 		return nil, err
 	}
 
-	endDate, err := cleanDateString(q.Get("endDate"))
+	now := time.Now()
+	date, err := parseDateRange(q.Get("startDate"), q.Get("endDate"), now, location)
 	if err != nil {
 		return nil, err
 	}
 
-	carelink := false
-	if values, ok := q["carelink"]; ok {
-		if len(values) < 1 {
-			return nil, errors.New("carelink parameter not valid")
-		}
-		carelink, err = strconv.ParseBool(values[len(values)-1])
-		if err != nil {
-			return nil, errors.New("carelink parameter not valid")
-		}
-	}
-
-	cbgFilter := true
-	if values, ok := q["cbgFilter"]; ok {
-		if len(values) < 1 {
-			return nil, errors.New("cbgFilter parameter not valid")
-		}
-		cbgFilter, err = strconv.ParseBool(values[len(values)-1])
-		if err != nil {
-			return nil, errors.New("cbgFilter parameter not valid")
-		}
-	} else if values, ok := q["dexcom"]; ok { // Legacy
-		if len(values) < 1 {
-			return nil, errors.New("dexcom parameter not valid")
-		}
-		dexcom, err := strconv.ParseBool(values[len(values)-1])
-		if err != nil {
-			return nil, errors.New("dexcom parameter not valid")
-		}
-		cbgFilter = !dexcom // Inverted logic for backwards compatibility
+	sourceRuleOverrides, err := parseSourceRuleOverrides(q, DataSourceRules)
+	if err != nil {
+		return nil, err
 	}
 
 	latest := false
+	var latestCount int
 	if values, ok := q["latest"]; ok {
 		if len(values) < 1 {
 			return nil, errors.New("latest parameter not valid")
 		}
-		latest, err = strconv.ParseBool(values[len(values)-1])
-		if err != nil {
+		// Either a boolean, for the most recent result, or the number of most recent results
+		if count, countErr := strconv.Atoi(values[len(values)-1]); countErr == nil {
+			if count < 0 || count > MaximumLatestCount {
+				return nil, errors.New("latest parameter not valid")
+			}
+			latestCount = count
+			latest = count > 0
+		} else if latest, err = strconv.ParseBool(values[len(values)-1]); err != nil {
 			return nil, errors.New("latest parameter not valid")
+		} else if latest {
+			latestCount = 1
 		}
 	}
 
-	medtronic := false
-	if values, ok := q["medtronic"]; ok {
-		if len(values) < 1 {
-			return nil, errors.New("medtronic parameter not valid")
+	var latestBy string
+	if value := q.Get("latestBy"); value != "" {
+		if !latest {
+			return nil, errors.New("latestBy parameter requires latest parameter")
 		}
-		medtronic, err = strconv.ParseBool(values[len(values)-1])
-		if err != nil {
-			return nil, errors.New("medtronic parameter not valid")
+		if latestBy, err = parseLatestBy(value); err != nil {
+			return nil, err
 		}
 	}
 
@@ -198,41 +180,123 @@ func GetParams(q url.Values, schema *SchemaVersion) (*Params, error) {
 		sampleIntervalMinimum = int(value)
 	}
 
-	p := &Params{
-		UserID:   q.Get(":userID"),
-		DeviceID: q.Get("deviceId"),
-		UploadID: q.Get("uploadId"),
-		//the query params for type and subtype can contain multiple values separated
-		//by a comma e.g. "type=smbg,cbg" so split them out into an array of values
-		Types:                 strings.Split(q.Get("type"), ","),
-		SubTypes:              strings.Split(q.Get("subType"), ","),
-		TypeFieldFilter:       TypeFieldFilter{},
-		Date:                  Date{startDate, endDate},
-		SchemaVersion:         schema,
-		Carelink:              carelink,
-		CBGFilter:             cbgFilter,
-		Latest:                latest,
-		Medtronic:             medtronic,
-		SampleIntervalMinimum: sampleIntervalMinimum,
+	fields, err := parseFields(q.Get("fields"))
+	if err != nil {
+		return nil, err
+	}
+
+	var sort int
+	if values, ok := q["sort"]; ok {
+		if len(values) < 1 {
+			return nil, errors.New("sort parameter not valid")
+		}
+		switch values[len(values)-1] {
+		case "time":
+			sort = SortAscending
+		case "-time":
+			sort = SortDescending
+		default:
+			return nil, errors.New("sort parameter not valid")
+		}
+	}
+
+	var limit int
+	if values, ok := q["limit"]; ok {
+		if len(values) < 1 {
+			return nil, errors.New("limit parameter not valid")
+		}
+		value, err := strconv.ParseInt(values[len(values)-1], 10, 32)
+		if err != nil || value < 1 || value > MaximumLimit {
+			return nil, errors.New("limit parameter not valid")
+		}
+		limit = int(value)
+	}
+
+	var cursor *Cursor
+	if value := q.Get("cursor"); value != "" {
+		if limit == 0 {
+			return nil, errors.New("cursor parameter requires limit parameter")
+		}
+		if cursor, err = DecodeCursor(value); err != nil {
+			return nil, err
+		}
+	}
+
+	dateRanges, err := parseDateRanges(q["range"], now, location)
+	if err != nil {
+		return nil, err
+	}
+
+	var timeOfDay *TimeOfDay
+	if value := q.Get("timeOfDay"); value != "" {
+		if timeOfDay, err = parseTimeOfDay(value); err != nil {
+			return nil, err
+		}
+	}
+
+	var daysOfWeek []time.Weekday
+	if value := q.Get("daysOfWeek"); value != "" {
+		if daysOfWeek, err = parseDaysOfWeek(value); err != nil {
+			return nil, err
+		}
+	}
+
+	dedupe, err := parseDedupe(q)
+	if err != nil {
+		return nil, err
+	}
+
+	explain, err := parseExplain(q.Get("explain"))
+	if err != nil {
+		return nil, err
+	}
+
+	var excludeTypes []string
+	if value := q.Get("excludeType"); value != "" {
+		excludeTypes = parseTypes(value)
 	}
 
 	// Parse the allowed filters to further restrict the result set,
 	// e.g. "dosingDecision.reason=normalBolus,simpleBolus,watchBolus" to filter out dosing decisions
 	// which have a 'reason' field other than [normalBolus,simpleBolus,watchBolus]
-	for typ, fields := range AllowedFieldFilters {
-		for field, _ := range fields {
-			key := fmt.Sprintf("%s.%s", typ, field)
-			value := q.Get(key)
-			if len(value) > 0 {
-				f, ok := p.TypeFieldFilter[typ]
-				if !ok {
-					f = FieldFilter{}
-				}
-				f[field] = strings.Split(value, ",")
-				p.TypeFieldFilter[typ] = f
-			}
+	typeFieldFilter, err := parseTypeFieldFilter(q)
+	if err != nil {
+		return nil, err
+	}
 
-		}
+	if latest && limit > 0 {
+		return nil, errors.New("limit parameter not valid with latest parameter")
+	}
+
+	p := &Params{
+		UserID:           q.Get(":userID"),
+		DeviceIDs:        splitValues(q.Get("deviceId")),
+		ExcludeDeviceIDs: splitValues(q.Get("excludeDeviceId")),
+		UploadIDs:        splitValues(q.Get("uploadId")),
+		ExcludeUploadIDs: splitValues(q.Get("excludeUploadId")),
+		//the query params for type and subtype can contain multiple values separated
+		//by a comma e.g. "type=smbg,cbg" so split them out into an array of values.
+		//type groups e.g. "type=glucose" are replaced by their types
+		Types:                 parseTypes(q.Get("type")),
+		ExcludeTypes:          excludeTypes,
+		SubTypes:              strings.Split(q.Get("subType"), ","),
+		TypeFieldFilter:       typeFieldFilter,
+		Date:                  date,
+		DateRanges:            dateRanges,
+		TimeOfDay:             timeOfDay,
+		DaysOfWeek:            daysOfWeek,
+		SchemaVersion:         schema,
+		SourceRuleOverrides:   sourceRuleOverrides,
+		Latest:                latest,
+		LatestCount:           latestCount,
+		LatestBy:              latestBy,
+		SampleIntervalMinimum: sampleIntervalMinimum,
+		Limit:                 limit,
+		Cursor:                cursor,
+		Sort:                  sort,
+		Fields:                fields,
+		Dedupe:                dedupe,
+		Explain:               explain,
 	}
 
 	return p, nil
@@ -290,6 +354,27 @@ func (c *MongoStoreClient) EnsureIndexes() error {
 					},
 				),
 		},
+		{
+			Keys: bson.D{{Key: "_userId", Value: 1}, {Key: "type", Value: 1}, {Key: "time", Value: -1}},
+			Options: options.Index().
+				SetName("LatestByType").
+				SetPartialFilterExpression(
+					bson.D{
+						{Key: "_active", Value: true},
+					},
+				),
+		},
+		// Sorted and deduped results are read in `time` then `_id` order, in either direction
+		{
+			Keys: bson.D{{Key: "_userId", Value: 1}, {Key: "time", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().
+				SetName("SortedByTime").
+				SetPartialFilterExpression(
+					bson.D{
+						{Key: "_active", Value: true},
+					},
+				),
+		},
 	}
 
 	if _, err := dataCollection(c).Indexes().CreateMany(context.Background(), dataIndexes); err != nil {
@@ -348,6 +433,31 @@ func dataSetsCollection(msc *MongoStoreClient) *mongo.Collection {
 	return msc.client.Database(msc.database).Collection(dataSetsCollectionName)
 }
 
+func (c *MongoStoreClient) collectionByName(name string) *mongo.Collection {
+	return c.client.Database(c.database).Collection(name)
+}
+
+// collectionNamesForParams returns the names of the collections that must be read to satisfy the
+// query, in the order in which they are read
+func collectionNamesForParams(p *Params) []string {
+	switch {
+	case len(p.Types) == 1 && p.Types[0] == "upload":
+		return []string{dataSetsCollectionName}
+	// Have to check for empty string as sometimes that is the type sent.
+	case len(p.Types) > 0 && !contains("upload", p.Types) && p.Types[0] != "":
+		return []string{dataCollectionName}
+	case contains("upload", p.ExcludeTypes):
+		return []string{dataCollectionName}
+	}
+	return []string{dataCollectionName, dataSetsCollectionName}
+}
+
+// appendAndQuery adds a condition to the `$and` clause of the query
+func appendAndQuery(query bson.M, condition bson.M) {
+	andQuery, _ := query["$and"].([]bson.M)
+	query["$and"] = append(andQuery, condition)
+}
+
 // generateMongoQuery takes in a number of parameters and constructs a mongo query
 // to retrieve objects from the Tidepool database. It is used by the router.Add("GET", "/{userID}"
 // endpoint, which implements the Tide-whisperer API. See that function for further documentation
@@ -359,8 +469,8 @@ func generateMongoQuery(p *Params) bson.M {
 		"_active": true}
 
 	//if optional parameters are present, then add them to the query
-	if len(p.Types) > 0 && p.Types[0] != "" {
-		groupDataQuery["type"] = bson.M{"$in": p.Types}
+	if typeQuery := typeQuery(p); typeQuery != nil {
+		groupDataQuery["type"] = typeQuery
 	}
 
 	if len(p.SubTypes) > 0 && p.SubTypes[0] != "" {
@@ -371,73 +481,25 @@ func generateMongoQuery(p *Params) bson.M {
 	// decimal point and therefore is not reliably sortable. And so we use our own custom format for
 	// database range queries that will properly sort any data with time stored as an ISO string.
 	// See https://github.com/golang/go/issues/19635
-	if !p.Date.Start.IsZero() && !p.Date.End.IsZero() {
-		groupDataQuery["time"] = bson.M{"$gte": p.Date.Start, "$lte": p.Date.End}
-	} else if !p.Date.Start.IsZero() {
-		groupDataQuery["time"] = bson.M{"$gte": p.Date.Start}
-	} else if !p.Date.End.IsZero() {
-		groupDataQuery["time"] = bson.M{"$lte": p.Date.End}
-	}
-
-	if !p.Carelink {
-		groupDataQuery["source"] = bson.M{"$ne": "carelink"}
+	if timeQuery := p.Date.query(); timeQuery != nil {
+		groupDataQuery["time"] = timeQuery
 	}
 
-	if p.DeviceID != "" {
-		groupDataQuery["deviceId"] = p.DeviceID
+	if deviceIDQuery := valuesQuery(p.DeviceIDs, p.ExcludeDeviceIDs); deviceIDQuery != nil {
+		groupDataQuery["deviceId"] = deviceIDQuery
 	}
 
 	andQuery := []bson.M{}
 
-	// If we have an explicit upload ID to filter by, we don't need or want to apply any further
-	// data source-based filtering
-	if p.UploadID != "" {
-		groupDataQuery["uploadId"] = p.UploadID
-	} else {
-		if p.CBGFilter {
-			cloudDataSetIds := primitive.A{}
-			cloudDataTimeRanges := []bson.M{}
-			for _, dataSource := range p.CBGCloudDataSources {
-				if dataSetIds, ok := dataSource["dataSetIds"].(primitive.A); ok && len(dataSetIds) > 0 {
-					cloudDataSetIds = append(cloudDataSetIds, dataSetIds...)
-					if earliestDataTime, ok := dataSource["earliestDataTime"].(primitive.DateTime); ok {
-						if latestDataTime, ok := dataSource["latestDataTime"].(primitive.DateTime); ok {
-							cloudDataTimeRanges = append(cloudDataTimeRanges, bson.M{
-								"time": bson.M{"$gte": earliestDataTime.Time().UTC(), "$lte": latestDataTime.Time().UTC()},
-							})
-						}
-					}
-				}
-			}
-
-			cloudQuery := []bson.M{}
-			if len(cloudDataSetIds) > 0 {
-				cloudQuery = append(cloudQuery, bson.M{"uploadId": bson.M{"$in": cloudDataSetIds}})
-			}
-			if len(cloudDataTimeRanges) > 0 {
-				cloudQuery = append(cloudQuery, bson.M{"$nor": cloudDataTimeRanges})
-			}
-
-			if len(cloudQuery) > 0 {
-				cloudQuery = append(cloudQuery, bson.M{"type": bson.M{"$ne": "cbg"}})
-				andQuery = append(andQuery, bson.M{"$or": cloudQuery})
-			}
-		}
-
-		if !p.Medtronic && len(p.MedtronicUploadIds) > 0 {
-			medtronicDateTime, err := time.Parse(medtronicDateFormat, p.MedtronicDate)
-			if err != nil {
-				medtronicDateTime, _ = time.Parse(time.RFC3339, p.MedtronicDate)
-			}
-			medtronicQuery := []bson.M{
-				{"time": bson.M{"$lt": medtronicDateTime}},
-				{"type": bson.M{"$nin": []string{"basal", "bolus", "cbg"}}},
-				{"uploadId": bson.M{"$nin": p.MedtronicUploadIds}},
-			}
-			andQuery = append(andQuery, bson.M{"$or": medtronicQuery})
-		}
+	if uploadIDQuery := valuesQuery(p.UploadIDs, p.ExcludeUploadIDs); uploadIDQuery != nil {
+		groupDataQuery["uploadId"] = uploadIDQuery
 	}
 
+	// The data sources excluded by the source rules. If we have explicit upload IDs to filter by,
+	// we don't need or want to apply the rules that don't apply to them. Excluded upload IDs don't
+	// select the data sources, so they are filtered as well.
+	andQuery = sourceSelectionsQuery(p, groupDataQuery, andQuery)
+
 	var orQueries []bson.M
 
 	if p.SampleIntervalMinimum > 0 {
@@ -450,17 +512,14 @@ func generateMongoQuery(p *Params) bson.M {
 		})
 	}
 
-	if len(p.TypeFieldFilter) > 0 {
-		for typ, fields := range p.TypeFieldFilter {
-			for field, values := range fields {
-				orQueries = append(orQueries, bson.M{
-					"$or": []bson.M{
-						{"type": bson.M{"$ne": typ}},
-						{field: bson.M{"$in": values}},
-					},
-				})
-			}
-		}
+	orQueries = append(orQueries, typeFieldFilterQueries(p.TypeFieldFilter)...)
+
+	if dateRangesQuery := dateRangesQuery(p.DateRanges); dateRangesQuery != nil {
+		orQueries = append(orQueries, dateRangesQuery)
+	}
+
+	if localTimeQuery := localTimeQuery(p); localTimeQuery != nil {
+		orQueries = append(orQueries, localTimeQuery)
 	}
 
 	if len(orQueries) > 0 {
@@ -485,43 +544,19 @@ func (c *MongoStoreClient) Disconnect() error {
 	return c.client.Disconnect(c.context)
 }
 
-// HasMedtronicDirectData - check whether the userID has Medtronic data that has been uploaded via Uploader
-func (c *MongoStoreClient) HasMedtronicDirectData(userID string) (bool, error) {
-	if userID == "" {
-		return false, errors.New("user id is missing")
-	}
-
-	query := bson.M{
-		"_userId": userID,
-		"type":    "upload",
-		"_state":  "closed",
-		"_active": true,
-		"deletedTime": bson.M{
-			"$exists": false,
-		},
-		"deviceManufacturers": "Medtronic",
-	}
-
-	err := dataSetsCollection(c).FindOne(c.context, query).Err()
-	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
-		return false, err
-	}
-	if errors.Is(err, mongo.ErrNoDocuments) {
-		return false, nil
-	}
-
-	return err == nil, err
-}
-
 // GetCBGCloudDataSources - get
 func (c *MongoStoreClient) GetCBGCloudDataSources(userID string) ([]bson.M, error) {
 	if userID == "" {
 		return nil, errors.New("user id is missing")
 	}
+	return c.findDataSources(userID, nil)
+}
 
+// findDataSources finds the user's cloud data sources with data sets that match
+func (c *MongoStoreClient) findDataSources(userID string, match bson.M) ([]bson.M, error) {
 	// `earliestDataTime` and `latestDataTime` are bson.Date fields. Internally, they are int64's
 	// so if they exist, the must be set to something, even if 0 (ie Unix epoch)
-	query := bson.M{
+	query := mergeMatch(bson.M{
 		"userId": userID,
 		"dataSetIds": bson.M{
 			"$exists": true,
@@ -529,7 +564,7 @@ func (c *MongoStoreClient) GetCBGCloudDataSources(userID string) ([]bson.M, erro
 				"$size": 0,
 			},
 		},
-	}
+	}, match)
 
 	cursor, err := c.client.Database("tidepool").Collection("data_sources").Find(c.context, query)
 	if err != nil {
@@ -548,164 +583,56 @@ func (c *MongoStoreClient) GetCBGCloudDataSources(userID string) ([]bson.M, erro
 	return dataSources, nil
 }
 
-// HasMedtronicLoopDataAfter checks the database to see if Loop data exists for `userID` that originated
-// from a Medtronic device after `date`
-func (c *MongoStoreClient) HasMedtronicLoopDataAfter(userID string, date string) (bool, error) {
-	if userID == "" {
-		return false, errors.New("user id is missing")
-	}
-	if date == "" {
-		return false, errors.New("date is missing")
-	}
-
-	dateTime, err := time.Parse(medtronicDateFormat, date)
-	if err != nil {
-		dateTime, err = time.Parse(time.RFC3339, date)
-	}
-	if err != nil {
-		return false, errors.New("date is invalid")
-	}
-
-	opts := options.FindOne()
-	query := bson.M{
-		"_active":                            true,
-		"_userId":                            userID,
-		"time":                               bson.M{"$gte": dateTime},
-		"origin.payload.device.manufacturer": "Medtronic",
-	}
-
-	err = dataCollection(c).FindOne(c.context, query, opts).Err()
-	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
-		return false, err
-	}
-
-	return err == nil, nil
-}
-
-// GetLoopableMedtronicDirectUploadIdsAfter returns all Upload IDs for `userID` where Loop data was found
-// for a Medtronic device after `date`.
-func (c *MongoStoreClient) GetLoopableMedtronicDirectUploadIdsAfter(userID string, date string) ([]string, error) {
-	if userID == "" {
-		return nil, errors.New("user id is missing")
-	}
-	if date == "" {
-		return nil, errors.New("date is missing")
-	}
-
-	dateTime, err := time.Parse(medtronicDateFormat, date)
-	if err != nil {
-		dateTime, err = time.Parse(time.RFC3339, date)
-	}
-	if err != nil {
-		return nil, errors.New("date is invalid")
-	}
-
-	opts := options.Find()
-	opts.SetHint("GetLoopableMedtronicDirectUploadIdsAfter_v2_DateTime")
-	opts.SetProjection(bson.M{"_id": 0, "uploadId": 1})
-
-	query := bson.M{
-		"_active":     true,
-		"_userId":     userID,
-		"time":        bson.M{"$gte": dateTime},
-		"type":        "upload", // redundant since all types in collection is deviceDataSets is upload but just leaving the original query here.
-		"deviceModel": bson.M{"$in": []string{"523", "523K", "554", "723", "723K", "754"}},
-	}
-
-	var objects []struct {
-		UploadID string `bson:"uploadId"`
-	}
-
-	cursor, err := dataSetsCollection(c).Find(c.context, query, opts)
-	if err != nil {
-		return nil, err
-	}
-	defer cursor.Close(c.context)
-
-	err = cursor.All(c.context, &objects)
-	if err != nil {
-		return nil, err
-	}
-
-	uploadIds := make([]string, len(objects))
-	for index, object := range objects {
-		uploadIds[index] = object.UploadID
-	}
-	return uploadIds, nil
-}
-
 // GetDeviceData returns all the device data for a user
 func (c *MongoStoreClient) GetDeviceData(p *Params) (StorageIterator, error) {
 
 	// _schemaVersion is still in the list of fields to remove. Although we don't query for it, data can still exist for it
 	// until BACK-1281 is done.
 	removeFieldsForReturn := bson.M{"_id": 0, "_userId": 0, "_groupId": 0, "_version": 0, "_active": 0, "_schemaVersion": 0, "createdTime": 0, "modifiedTime": 0, "_migrationMarker": 0, "provenance": 0}
+	projection := projectionForParams(p, removeFieldsForReturn)
 
 	if p.Latest {
-		latest := &latestIterator{pos: -1}
-
-		var typeRanges []string
-		if len(p.Types) > 0 && p.Types[0] != "" {
-			typeRanges = p.Types
-		} else {
-			typeRanges = []string{"physicalActivity", "basal", "cbg", "smbg", "bloodKetone", "bolus", "wizard", "deviceEvent", "food", "insulin", "cgmSettings", "pumpSettings", "reportedState", "upload"}
-		}
+		return c.getLatest(p, projection)
+	}
 
-		var err error
-
-		for _, theType := range typeRanges {
-			query := generateMongoQuery(p)
-			query["type"] = theType
-			opts := options.FindOne().SetProjection(removeFieldsForReturn).SetSort(bson.M{"time": -1})
-			// collections to search. stop at first collection that has data.
-			collection := dataCollection(c)
-			if theType == "upload" {
-				// Uploads are only in the deviceDataSets collection after migration completes.
-				collection = dataSetsCollection(c)
-			}
-			result, resultErr := collection.
-				FindOne(c.context, query, opts).
-				DecodeBytes()
-			if resultErr != nil {
-				if resultErr == mongo.ErrNoDocuments {
-					continue
-				}
-				err = resultErr
-				break
-			}
+	if p.Limit > 0 {
+		return c.getDeviceDataPage(p, projection)
+	}
 
-			latest.results = append(latest.results, result)
+	// Overlapping records are deduped as they are read in `time` order
+	if rules := dedupeRulesForParams(p); len(rules) > 0 {
+		sort := p.Sort
+		if sort == 0 {
+			sort = SortAscending
 		}
-		return latest, err
+		return c.findDeduped(p, projection, sort, rules)
 	}
 
-	opts := options.Find().SetProjection(removeFieldsForReturn)
+	if p.Sort != 0 {
+		return c.findSorted(p, projection, p.Sort, 0, nil)
+	}
+
+	opts := options.Find().SetProjection(projection)
 
 	mongoQuery := generateMongoQuery(p)
 
 	// If query only needs to read from one collection use the collection directly.
-	switch {
-	case len(p.Types) == 1 && p.Types[0] == "upload":
-		return dataSetsCollection(c).Find(c.context, mongoQuery, opts)
-	// Have to check for empty string as sometimes that is the type sent.
-	case len(p.Types) > 0 && !contains("upload", p.Types) && p.Types[0] != "":
-		return dataCollection(c).Find(c.context, mongoQuery, opts)
+	collectionNames := collectionNamesForParams(p)
+	if len(collectionNames) == 1 {
+		return c.collectionByName(collectionNames[0]).Find(c.context, mongoQuery, opts)
 	}
 
 	// Otherwise query needs to read from both deviceData and deviceDataSets collection.
-	dataIter, err := dataCollection(c).Find(c.context, mongoQuery, opts)
-	if err != nil {
-		return nil, err
-	}
-	dataSetIter, err := dataSetsCollection(c).Find(c.context, mongoQuery, opts)
-	if err != nil {
-		return nil, err
+	iters := []StorageIterator{}
+	for _, collectionName := range collectionNames {
+		iter, err := c.collectionByName(collectionName).Find(c.context, mongoQuery, opts)
+		if err != nil {
+			return nil, err
+		}
+		iters = append(iters, iter)
 	}
 	return &multiStorageIterator{
-		iters: []StorageIterator{
-			dataIter,
-			dataSetIter,
-		},
+		iters: iters,
 	}, nil
 }
 
@@ -722,6 +649,11 @@ func (l *latestIterator) Close(context.Context) error {
 	return nil
 }
 
+// Err returns nil, as the latest results are read in full before they are returned
+func (l *latestIterator) Err() error {
+	return nil
+}
+
 func (l *multiStorageIterator) Next(ctx context.Context) bool {
 	if l.currentIterIdx >= len(l.iters) {
 		return false
@@ -730,6 +662,10 @@ func (l *multiStorageIterator) Next(ctx context.Context) bool {
 	if hasNext {
 		return true
 	}
+	// The remaining iterators aren't read after an error, so that the results aren't taken as complete
+	if l.iters[l.currentIterIdx].Err() != nil {
+		return false
+	}
 	l.currentIterIdx++
 	return l.Next(ctx)
 }
@@ -751,11 +687,58 @@ func (l *multiStorageIterator) Close(ctx context.Context) error {
 	return nil
 }
 
+// Err returns the first error encountered by any of the iterators
+func (l *multiStorageIterator) Err() error {
+	for _, iter := range l.iters {
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitValues splits the comma separated values of a parameter, returning nil if it is not set
+func splitValues(value string) []string {
+	if value == "" {
+		return nil
+	}
+	values := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v != "" && !contains(v, values) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// valuesQuery returns the query of a field matching any of the included values and none of the
+// excluded values, or nil if there are neither. A single included value is matched by equality.
+func valuesQuery(include []string, exclude []string) interface{} {
+	if len(include) == 1 && len(exclude) == 0 {
+		return include[0]
+	}
+	query := bson.M{}
+	if len(include) > 0 {
+		query["$in"] = include
+	}
+	if len(exclude) > 0 {
+		query["$nin"] = exclude
+	}
+	if len(query) == 0 {
+		return nil
+	}
+	return query
+}
+
 func contains(needle string, haystack []string) bool {
-	for _, x := range haystack {
+	return indexOf(needle, haystack) >= 0
+}
+
+func indexOf(needle string, haystack []string) int {
+	for idx, x := range haystack {
 		if needle == x {
-			return true
+			return idx
 		}
 	}
-	return false
+	return -1
 }
@@ -3,6 +3,7 @@ package store
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
 	"reflect"
@@ -91,59 +92,93 @@ func formatForReading(toFormat interface{}) string {
 	return string(formatted)
 }
 
+func carelinkSelection() SourceSelection {
+	return SourceSelection{
+		Rule:             "carelink",
+		Fired:            true,
+		ApplyToUploadIDs: true,
+		Exclusion:        &SourceExclusion{Match: bson.M{"source": "carelink"}},
+	}
+}
+
+func medtronicSelection() SourceSelection {
+	medtronicDate, _ := time.Parse(time.RFC3339, "2017-01-01T00:00:00Z")
+	return SourceSelection{
+		Rule:  "medtronic",
+		Fired: true,
+		Exclusion: &SourceExclusion{
+			Types:      []string{"basal", "bolus", "cbg"},
+			UploadIDs:  []string{"555666777", "888999000"},
+			TimeRanges: []Date{{Start: medtronicDate}},
+		},
+	}
+}
+
+func cbgCloudDataSources() []bson.M {
+	earliestDataTime, _ := time.Parse(time.RFC3339, "2015-10-07T15:00:00Z")
+	latestDataTime, _ := time.Parse(time.RFC3339, "2016-12-13T02:00:00Z")
+
+	return []bson.M{
+		{
+			"dataSetIds":       primitive.A{"123", "456"},
+			"earliestDataTime": primitive.NewDateTimeFromTime(earliestDataTime.Add(-24 * time.Hour)),
+			"latestDataTime":   primitive.NewDateTimeFromTime(latestDataTime.Add(-24 * time.Hour)),
+		},
+		{
+			"dataSetIds":       primitive.A{"789"},
+			"earliestDataTime": primitive.NewDateTimeFromTime(earliestDataTime.Add(30 * time.Hour)),
+		},
+		{
+			"dataSetIds": primitive.A{"ABC"},
+		},
+		{
+			"dataSetIds":     primitive.A{"DEF"},
+			"latestDataTime": primitive.NewDateTimeFromTime(latestDataTime.Add(30 * time.Hour)),
+		},
+		{
+			"dataSetIds":       primitive.A{"GHI", "JKL"},
+			"earliestDataTime": primitive.NewDateTimeFromTime(earliestDataTime.Add(24 * time.Hour)),
+			"latestDataTime":   primitive.NewDateTimeFromTime(latestDataTime.Add(24 * time.Hour)),
+		},
+	}
+}
+
+func cbgFilterSelection() SourceSelection {
+	cloudDataSetIDs, cloudDataDates := dataSourcesWinner(cbgCloudDataSources())
+	return SourceSelection{
+		Rule:  "cbgFilter",
+		Fired: true,
+		Exclusion: &SourceExclusion{
+			Types:           []string{"cbg"},
+			ExceptUploadIDs: cloudDataSetIDs,
+			TimeRanges:      cloudDataDates,
+		},
+	}
+}
+
 func basicQuery() bson.M {
 	qParams := &Params{
-		UserID:        "abc123",
-		SchemaVersion: &SchemaVersion{Maximum: 2, Minimum: 0},
-		Medtronic:     true,
+		UserID:           "abc123",
+		SchemaVersion:    &SchemaVersion{Maximum: 2, Minimum: 0},
+		SourceSelections: []SourceSelection{carelinkSelection()},
 	}
 
 	return generateMongoQuery(qParams)
 }
 
 func allParams() *Params {
-	earliestDataTime, _ := time.Parse(time.RFC3339, "2015-10-07T15:00:00Z")
-	latestDataTime, _ := time.Parse(time.RFC3339, "2016-12-13T02:00:00Z")
-
 	dateStart, _ := time.Parse(time.RFC3339, "2015-10-07T15:00:00.000Z")
 	dateEnd, _ := time.Parse(time.RFC3339, "2015-10-11T15:00:00.000Z")
 
 	return &Params{
-		UserID:        "abc123",
-		DeviceID:      "device123",
-		SchemaVersion: &SchemaVersion{Maximum: 2, Minimum: 0},
-		Date:          Date{dateStart, dateEnd},
-		Types:         []string{"smbg", "cbg"},
-		SubTypes:      []string{"stuff"},
-		Carelink:      true,
-		CBGFilter:     true,
-		CBGCloudDataSources: []bson.M{
-			{
-				"dataSetIds":       primitive.A{"123", "456"},
-				"earliestDataTime": primitive.NewDateTimeFromTime(earliestDataTime.Add(-24 * time.Hour)),
-				"latestDataTime":   primitive.NewDateTimeFromTime(latestDataTime.Add(-24 * time.Hour)),
-			},
-			{
-				"dataSetIds":       primitive.A{"789"},
-				"earliestDataTime": primitive.NewDateTimeFromTime(earliestDataTime.Add(30 * time.Hour)),
-			},
-			{
-				"dataSetIds": primitive.A{"ABC"},
-			},
-			{
-				"dataSetIds":     primitive.A{"DEF"},
-				"latestDataTime": primitive.NewDateTimeFromTime(latestDataTime.Add(30 * time.Hour)),
-			},
-			{
-				"dataSetIds":       primitive.A{"GHI", "JKL"},
-				"earliestDataTime": primitive.NewDateTimeFromTime(earliestDataTime.Add(24 * time.Hour)),
-				"latestDataTime":   primitive.NewDateTimeFromTime(latestDataTime.Add(24 * time.Hour)),
-			},
-		},
-		Latest:             false,
-		Medtronic:          false,
-		MedtronicDate:      "2017-01-01",
-		MedtronicUploadIds: []string{"555666777", "888999000"},
+		UserID:           "abc123",
+		DeviceIDs:        []string{"device123"},
+		SchemaVersion:    &SchemaVersion{Maximum: 2, Minimum: 0},
+		Date:             Date{dateStart, dateEnd},
+		Types:            []string{"smbg", "cbg"},
+		SubTypes:         []string{"stuff"},
+		SourceSelections: []SourceSelection{cbgFilterSelection(), medtronicSelection()},
+		Latest:           false,
 	}
 }
 
@@ -153,29 +188,28 @@ func allParamsQuery() bson.M {
 
 func allParamsIncludingUploadIDQuery() bson.M {
 	qParams := allParams()
-	qParams.UploadID = "xyz123"
+	qParams.UploadIDs = []string{"xyz123"}
 
 	return generateMongoQuery(qParams)
 }
 
 func typeAndSubtypeQuery() bson.M {
 	qParams := &Params{
-		UserID:             "abc123",
-		SchemaVersion:      &SchemaVersion{Maximum: 2, Minimum: 0},
-		Types:              []string{"smbg", "cbg"},
-		SubTypes:           []string{"stuff"},
-		Medtronic:          false,
-		MedtronicDate:      "2017-01-01",
-		MedtronicUploadIds: []string{"555666777", "888999000"},
+		UserID:           "abc123",
+		SchemaVersion:    &SchemaVersion{Maximum: 2, Minimum: 0},
+		Types:            []string{"smbg", "cbg"},
+		SubTypes:         []string{"stuff"},
+		SourceSelections: []SourceSelection{carelinkSelection(), medtronicSelection()},
 	}
 	return generateMongoQuery(qParams)
 }
 
 func uploadIDQuery() bson.M {
 	qParams := &Params{
-		UserID:        "abc123",
-		SchemaVersion: &SchemaVersion{Maximum: 2, Minimum: 0},
-		UploadID:      "xyz123",
+		UserID:           "abc123",
+		SchemaVersion:    &SchemaVersion{Maximum: 2, Minimum: 0},
+		UploadIDs:        []string{"xyz123"},
+		SourceSelections: []SourceSelection{carelinkSelection(), medtronicSelection()},
 	}
 	return generateMongoQuery(qParams)
 }
@@ -344,6 +378,20 @@ func TestStore_EnsureIndexes(t *testing.T) {
 			},
 			Name: "HasMedtronicLoopDataAfter_v2_DateTime",
 		},
+		{
+			Key: makeKeySlice("_userId", "type", "-time"),
+			PartialFilterExpression: bson.D{
+				{Key: "_active", Value: true},
+			},
+			Name: "LatestByType",
+		},
+		{
+			Key: makeKeySlice("_userId", "time", "_id"),
+			PartialFilterExpression: bson.D{
+				{Key: "_active", Value: true},
+			},
+			Name: "SortedByTime",
+		},
 	}
 
 	eq := reflect.DeepEqual(indexes, expectedIndexes)
@@ -477,7 +525,7 @@ func TestStore_generateMongoQuery_allParams(t *testing.T) {
 		"time":     bson.M{"$gte": timeStart, "$lte": timeEnd},
 		"$and": []bson.M{
 			{"$or": []bson.M{
-				{"uploadId": bson.M{"$in": primitive.A{"123", "456", "789", "ABC", "DEF", "GHI", "JKL"}}},
+				{"uploadId": bson.M{"$in": []string{"123", "456", "789", "ABC", "DEF", "GHI", "JKL"}}},
 				{"$nor": []bson.M{
 					{"time": bson.M{"$gte": earliestDataTime.Add(-24 * time.Hour), "$lte": latestDataTime.Add(-24 * time.Hour)}},
 					{"time": bson.M{"$gte": earliestDataTime.Add(24 * time.Hour), "$lte": latestDataTime.Add(24 * time.Hour)}},
@@ -540,6 +588,49 @@ func TestStore_generateMongoQuery_uploadId(t *testing.T) {
 	}
 }
 
+func TestStore_generateMongoQuery_multipleUploadIds(t *testing.T) {
+
+	qParams := allParams()
+	qParams.UploadIDs = []string{"xyz123", "xyz456"}
+	qParams.DeviceIDs = []string{"device123", "device456"}
+	qParams.ExcludeDeviceIDs = []string{"device789"}
+	query := generateMongoQuery(qParams)
+
+	timeStart, _ := time.Parse(time.RFC3339, "2015-10-07T15:00:00.00Z")
+	timeEnd, _ := time.Parse(time.RFC3339, "2015-10-11T15:00:00.00Z")
+
+	expectedQuery := bson.M{
+		"_userId":  "abc123",
+		"deviceId": bson.M{"$in": []string{"device123", "device456"}, "$nin": []string{"device789"}},
+		"_active":  true,
+		"type":     bson.M{"$in": strings.Split("smbg,cbg", ",")},
+		"subType":  bson.M{"$in": strings.Split("stuff", ",")},
+		"uploadId": bson.M{"$in": []string{"xyz123", "xyz456"}},
+		"time":     bson.M{"$gte": timeStart, "$lte": timeEnd},
+	}
+
+	eq := reflect.DeepEqual(query, expectedQuery)
+	if !eq {
+		t.Error(getErrString(query, expectedQuery))
+	}
+}
+
+func TestStore_generateMongoQuery_excludeUploadIds(t *testing.T) {
+
+	qParams := allParams()
+	qParams.ExcludeUploadIDs = []string{"xyz123"}
+	query := generateMongoQuery(qParams)
+
+	// Excluded upload IDs don't bypass the data source selection
+	expectedQuery := allParamsQuery()
+	expectedQuery["uploadId"] = bson.M{"$nin": []string{"xyz123"}}
+
+	eq := reflect.DeepEqual(query, expectedQuery)
+	if !eq {
+		t.Error(getErrString(query, expectedQuery))
+	}
+}
+
 func TestStore_generateMongoQuery_noDates(t *testing.T) {
 
 	query := typeAndSubtypeQuery()
@@ -648,8 +739,8 @@ func TestStore_GetParams_Empty(t *testing.T) {
 		SchemaVersion:   schema,
 		Types:           []string{""},
 		SubTypes:        []string{""},
-		CBGFilter:       true,
 		TypeFieldFilter: TypeFieldFilter{},
+		Dedupe:          true,
 	}
 
 	params, err := GetParams(query, schema)
@@ -670,13 +761,13 @@ func TestStore_GetParams_Medtronic(t *testing.T) {
 	schema := &SchemaVersion{Minimum: 1, Maximum: 3}
 
 	expectedParams := &Params{
-		UserID:          "1122334455",
-		SchemaVersion:   schema,
-		Types:           []string{""},
-		SubTypes:        []string{""},
-		CBGFilter:       true,
-		Medtronic:       true,
-		TypeFieldFilter: TypeFieldFilter{},
+		UserID:              "1122334455",
+		SchemaVersion:       schema,
+		Types:               []string{""},
+		SubTypes:            []string{""},
+		SourceRuleOverrides: map[string]bool{"medtronic": false},
+		TypeFieldFilter:     TypeFieldFilter{},
+		Dedupe:              true,
 	}
 
 	params, err := GetParams(query, schema)
@@ -701,9 +792,42 @@ func TestStore_GetParams_UploadId(t *testing.T) {
 		SchemaVersion:   schema,
 		Types:           []string{""},
 		SubTypes:        []string{""},
-		CBGFilter:       true,
-		UploadID:        "xyz123",
+		UploadIDs:       []string{"xyz123"},
 		TypeFieldFilter: TypeFieldFilter{},
+		Dedupe:          true,
+	}
+
+	params, err := GetParams(query, schema)
+
+	if err != nil {
+		t.Error("should not have received error, but got one")
+	}
+	if !reflect.DeepEqual(params, expectedParams) {
+		t.Errorf("params %#v do not equal expected params %#v", params, expectedParams)
+	}
+}
+
+func TestStore_GetParams_MultipleIds(t *testing.T) {
+	query := url.Values{
+		":userID":         []string{"1122334455"},
+		"uploadId":        []string{"xyz123,xyz456,xyz123"},
+		"excludeUploadId": []string{"xyz789"},
+		"deviceId":        []string{"dev123,dev456"},
+		"excludeDeviceId": []string{"dev789,"},
+	}
+	schema := &SchemaVersion{Minimum: 1, Maximum: 3}
+
+	expectedParams := &Params{
+		UserID:           "1122334455",
+		SchemaVersion:    schema,
+		Types:            []string{""},
+		SubTypes:         []string{""},
+		UploadIDs:        []string{"xyz123", "xyz456"},
+		ExcludeUploadIDs: []string{"xyz789"},
+		DeviceIDs:        []string{"dev123", "dev456"},
+		ExcludeDeviceIDs: []string{"dev789"},
+		TypeFieldFilter:  TypeFieldFilter{},
+		Dedupe:           true,
 	}
 
 	params, err := GetParams(query, schema)
@@ -760,7 +884,7 @@ func TestStore_GetParams_DosingDecisionReason(t *testing.T) {
 		Types: []string{"cbg", "dosingDecision"},
 		TypeFieldFilter: TypeFieldFilter{
 			"dosingDecision": FieldFilter{
-				"reason": []string{"simpleBolus", "normalBolus"},
+				"reason": []FieldCondition{{Operator: FilterIn, Values: []interface{}{"simpleBolus", "normalBolus"}}},
 			},
 		},
 	}
@@ -781,588 +905,6 @@ func TestStore_GetParams_DosingDecisionReason(t *testing.T) {
 
 }
 
-func TestStore_HasMedtronicDirectData_UserID_Missing(t *testing.T) {
-	store := before(t)
-
-	hasMedtronicDirectData, err := store.HasMedtronicDirectData("")
-
-	if err == nil {
-		t.Error("should have received error, but got nil")
-	}
-	if hasMedtronicDirectData {
-		t.Error("should not have Medtronic Direct data, but got some")
-	}
-}
-
-func TestStore_HasMedtronicDirectData_Found(t *testing.T) {
-	store := before(t, bson.M{
-		"_userId":             "1234567890",
-		"type":                "upload",
-		"_state":              "closed",
-		"_active":             true,
-		"deviceManufacturers": "Medtronic",
-	})
-
-	hasMedtronicDirectData, err := store.HasMedtronicDirectData("1234567890")
-
-	if err != nil {
-		t.Error("failure querying HasMedtronicDirectData", err)
-	}
-	if !hasMedtronicDirectData {
-		t.Error("should have Medtronic Direct data, but got none")
-	}
-}
-
-func TestStore_HasMedtronicDirectData_Found_Multiple(t *testing.T) {
-	date1, _ := time.Parse(time.RFC3339, "2017-05-17T20:13:32.064-0700")
-	store := before(t, TestDataSchema{
-		UserId:              ptr("0000000000"),
-		Type:                ptr("upload"),
-		State:               ptr("closed"),
-		Active:              ptr(true),
-		DeviceManufacturers: ptr("Medtronic"),
-		Index:               ptr("0"),
-	}, TestDataSchema{
-		UserId:              ptr("1234567890"),
-		Type:                ptr("upload"),
-		State:               ptr("closed"),
-		Active:              ptr(true),
-		DeviceManufacturers: ptr("Medtronic"),
-		Index:               ptr("1"),
-	}, TestDataSchema{
-		UserId:              ptr("1234567890"),
-		Type:                ptr("upload"),
-		State:               ptr("open"),
-		Active:              ptr(true),
-		DeviceManufacturers: ptr("Medtronic"),
-		Index:               ptr("2"),
-	}, TestDataSchema{
-		UserId:              ptr("1234567890"),
-		Type:                ptr("upload"),
-		State:               ptr("closed"),
-		Active:              ptr(true),
-		DeviceManufacturers: ptr("Medtronic"),
-		Index:               ptr("3"),
-	}, TestDataSchema{
-		UserId:              ptr("1234567890"),
-		Type:                ptr("upload"),
-		State:               ptr("closed"),
-		Active:              ptr(true),
-		DeletedTime:         ptr(date1),
-		DeviceManufacturers: ptr("Medtronic"),
-		Index:               ptr("4"),
-	})
-
-	hasMedtronicDirectData, err := store.HasMedtronicDirectData("1234567890")
-
-	if err != nil {
-		t.Error("failure querying HasMedtronicDirectData", err)
-	}
-	if !hasMedtronicDirectData {
-		t.Error("should have Medtronic Direct data, but got none")
-	}
-}
-
-func TestStore_HasMedtronicDirectData_NotFound_UserID(t *testing.T) {
-	store := before(t, bson.M{
-		"_userId":             "0000000000",
-		"type":                "upload",
-		"_state":              "closed",
-		"_active":             true,
-		"deviceManufacturers": "Medtronic",
-	})
-
-	hasMedtronicDirectData, err := store.HasMedtronicDirectData("1234567890")
-
-	if err != nil {
-		t.Error("failure querying HasMedtronicDirectData", err)
-	}
-	if hasMedtronicDirectData {
-		t.Error("should not have Medtronic Direct data, but got some")
-	}
-}
-
-func TestStore_HasMedtronicDirectData_NotFound_Type(t *testing.T) {
-	store := before(t, bson.M{
-		"_userId":             "1234567890",
-		"type":                "cgm",
-		"_state":              "closed",
-		"_active":             true,
-		"deviceManufacturers": "Medtronic",
-	})
-
-	hasMedtronicDirectData, err := store.HasMedtronicDirectData("1234567890")
-
-	if err != nil {
-		t.Error("failure querying HasMedtronicDirectData", err)
-	}
-	if hasMedtronicDirectData {
-		t.Error("should not have Medtronic Direct data, but got some")
-	}
-}
-
-func TestStore_HasMedtronicDirectData_NotFound_State(t *testing.T) {
-	store := before(t, bson.M{
-		"_userId":             "1234567890",
-		"type":                "upload",
-		"_state":              "open",
-		"_active":             true,
-		"deviceManufacturers": "Medtronic",
-	})
-
-	hasMedtronicDirectData, err := store.HasMedtronicDirectData("1234567890")
-
-	if err != nil {
-		t.Error("failure querying HasMedtronicDirectData", err)
-	}
-	if hasMedtronicDirectData {
-		t.Error("should not have Medtronic Direct data, but got some")
-	}
-}
-
-func TestStore_HasMedtronicDirectData_NotFound_Active(t *testing.T) {
-	store := before(t, bson.M{
-		"_userId":             "1234567890",
-		"type":                "upload",
-		"_state":              "closed",
-		"_active":             false,
-		"deviceManufacturers": "Medtronic",
-	})
-
-	hasMedtronicDirectData, err := store.HasMedtronicDirectData("1234567890")
-
-	if err != nil {
-		t.Error("failure querying HasMedtronicDirectData", err)
-	}
-	if hasMedtronicDirectData {
-		t.Error("should not have Medtronic Direct data, but got some")
-	}
-}
-
-func TestStore_HasMedtronicDirectData_NotFound_DeletedTime(t *testing.T) {
-	date1, _ := time.Parse(time.RFC3339, "2017-05-17T20:10:26.607-0700")
-	store := before(t, bson.M{
-		"_userId":             "1234567890",
-		"type":                "upload",
-		"_state":              "closed",
-		"_active":             true,
-		"deletedTime":         date1,
-		"deviceManufacturers": "Medtronic",
-	})
-
-	hasMedtronicDirectData, err := store.HasMedtronicDirectData("1234567890")
-
-	if err != nil {
-		t.Error("failure querying HasMedtronicDirectData", err)
-	}
-	if hasMedtronicDirectData {
-		t.Error("should not have Medtronic Direct data, but got some")
-	}
-}
-
-func TestStore_HasMedtronicDirectData_NotFound_DeviceManufacturer(t *testing.T) {
-	store := before(t, bson.M{
-		"_userId":             "1234567890",
-		"type":                "upload",
-		"_state":              "closed",
-		"_active":             true,
-		"deviceManufacturers": "Acme",
-	})
-
-	hasMedtronicDirectData, err := store.HasMedtronicDirectData("1234567890")
-
-	if err != nil {
-		t.Error("failure querying HasMedtronicDirectData", err)
-	}
-	if hasMedtronicDirectData {
-		t.Error("should not have Medtronic Direct data, but got some")
-	}
-}
-
-func TestStore_HasMedtronicDirectData_NotFound_Multiple(t *testing.T) {
-	date1, _ := time.Parse(time.RFC3339Nano, "2017-05-17T20:13:32.064-07:00")
-	store := before(t, TestDataSchema{
-		UserId:              ptr("0000000000"),
-		Type:                ptr("upload"),
-		State:               ptr("closed"),
-		Active:              ptr(true),
-		DeviceManufacturers: ptr("Medtronic"),
-		Index:               ptr("0"),
-	}, TestDataSchema{
-		UserId:              ptr("1234567890"),
-		Type:                ptr("cgm"),
-		State:               ptr("closed"),
-		Active:              ptr(true),
-		DeviceManufacturers: ptr("Medtronic"),
-		Index:               ptr("1"),
-	}, TestDataSchema{
-		UserId:              ptr("1234567890"),
-		Type:                ptr("upload"),
-		State:               ptr("open"),
-		Active:              ptr(true),
-		DeviceManufacturers: ptr("Medtronic"),
-		Index:               ptr("2"),
-	}, TestDataSchema{
-		UserId:              ptr("1234567890"),
-		Type:                ptr("upload"),
-		State:               ptr("closed"),
-		Active:              ptr(false),
-		DeviceManufacturers: ptr("Medtronic"),
-		Index:               ptr("3"),
-	}, TestDataSchema{
-		UserId:              ptr("1234567890"),
-		Type:                ptr("upload"),
-		State:               ptr("closed"),
-		Active:              ptr(true),
-		DeletedTime:         ptr(date1),
-		DeviceManufacturers: ptr("Medtronic"),
-		Index:               ptr("4"),
-	})
-
-	hasMedtronicDirectData, err := store.HasMedtronicDirectData("1234567890")
-
-	if err != nil {
-		t.Error("failure querying HasMedtronicDirectData", err)
-	}
-	if hasMedtronicDirectData {
-		t.Error("should not have Medtronic Direct data, but got some")
-	}
-}
-
-func TestStore_HasMedtronicLoopDataAfter_NotFound_UserID(t *testing.T) {
-	date1, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date2, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date3, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	// We keep _schemaVersion in the test data until BACK-1281 is completed.
-	store := before(t, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("0000000000"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date1),
-		Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Medtronic"}}}),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date2),
-		Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Animas"}}}),
-	}, TestDataSchema{
-		Active:        ptr(false),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date3),
-		Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Medtronic"}}}),
-	})
-
-	// we need indexes here as the following queries rely on working index hints for performance
-	err := store.EnsureIndexes()
-	if err != nil {
-		t.Error("Failed to run EnsureIndexes()")
-	}
-
-	hasMedtronicLoopDataAfter, err := store.HasMedtronicLoopDataAfter("1234567890", "2017-01-01T00:00:00Z")
-
-	if err != nil {
-		t.Error("failure querying HasMedtronicLoopDataAfter", err)
-	}
-	if hasMedtronicLoopDataAfter {
-		t.Error("should not have Medtronic Loop Data After, but got some")
-	}
-}
-
-func TestStore_HasMedtronicLoopDataAfter_NotFound_Time(t *testing.T) {
-	date1, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date2, _ := time.Parse(time.RFC3339, "2016-12-31T23:59:59Z")
-	date3, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date4, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	// We keep _schemaVersion in the test data until BACK-1281 is completed.
-	store := before(t, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("0000000000"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date1),
-		Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Medtronic"}}}),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date2),
-		Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Medtronic"}}}),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date3),
-		Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Animas"}}}),
-	}, TestDataSchema{
-		Active:        ptr(false),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date4),
-		Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Medtronic"}}}),
-	})
-
-	// we need indexes here as the following queries rely on working index hints for performance
-	err := store.EnsureIndexes()
-	if err != nil {
-		t.Error("Failed to run EnsureIndexes()")
-	}
-
-	hasMedtronicLoopDataAfter, err := store.HasMedtronicLoopDataAfter("1234567890", "2017-01-01T00:00:00Z")
-
-	if err != nil {
-		t.Error("failure querying HasMedtronicLoopDataAfter", err)
-	}
-	if hasMedtronicLoopDataAfter {
-		t.Error("should not have Medtronic Loop Data After, but got some")
-	}
-}
-
-func TestStore_HasMedtronicLoopDataAfter_Found(t *testing.T) {
-	date1, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date2, _ := time.Parse(time.RFC3339, "2016-12-31T23:59:59Z")
-	date3, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date4, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date5, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	// We keep _schemaVersion in the test data until BACK-1281 is completed.
-	store := before(t, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("0000000000"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date1),
-		Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Medtronic"}}}),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date2),
-		Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Medtronic"}}}),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date3),
-		Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Medtronic"}}}),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date4),
-		Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Animas"}}}),
-	}, TestDataSchema{
-		Active:        ptr(false),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date5),
-		Origin:        ptr(bson.M{"payload": bson.M{"device": bson.M{"manufacturer": "Medtronic"}}}),
-	})
-
-	// we need indexes here as the following queries rely on working index hints for performance
-	err := store.EnsureIndexes()
-	if err != nil {
-		t.Error("Failed to run EnsureIndexes()")
-	}
-
-	hasMedtronicLoopDataAfter, err := store.HasMedtronicLoopDataAfter("1234567890", "2017-01-01T00:00:00Z")
-
-	if err != nil {
-		t.Error("failure querying HasMedtronicLoopDataAfter", err)
-	}
-	if !hasMedtronicLoopDataAfter {
-		t.Error("should have Medtronic Loop Data After, but got none")
-	}
-}
-
-func TestStore_GetLoopableMedtronicDirectUploadIdsAfter_NotFound_UserID(t *testing.T) {
-	date1, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date2, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date3, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date4, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	// We keep _schemaVersion in the test data until BACK-1281 is completed.
-	store := before(t, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("0000000000"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date1),
-		Type:          ptr("upload"),
-		DeviceModel:   ptr("523"),
-	}, TestDataSchema{
-		Active:        ptr(false),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date2),
-		Type:          ptr("upload"),
-		DeviceModel:   ptr("523"),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date3),
-		Type:          ptr("cgm"),
-		DeviceModel:   ptr("523"),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date4),
-		Type:          ptr("upload"),
-		DeviceModel:   ptr("Another Model"),
-	})
-
-	// we need indexes here as the following queries rely on working index hints for performance
-	err := store.EnsureIndexes()
-	if err != nil {
-		t.Error("Failed to run EnsureIndexes()")
-	}
-
-	loopableMedtronicDirectUploadIdsAfter, err := store.GetLoopableMedtronicDirectUploadIdsAfter("1234567890", "2017-01-01T00:00:00Z")
-
-	if err != nil {
-		t.Error("failure querying GetLoopableMedtronicDirectUploadIdsAfter", err)
-	}
-	if !reflect.DeepEqual(loopableMedtronicDirectUploadIdsAfter, []string{}) {
-		t.Error("should not have Loopable Medtronic Direct Upload Ids After, but got some")
-	}
-}
-
-func TestStore_GetLoopableMedtronicDirectUploadIdsAfter_NotFound_Time(t *testing.T) {
-	date1, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date2, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date3, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date4, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date5, _ := time.Parse(time.RFC3339, "2016-12-31T23:59:59Z")
-	// We keep _schemaVersion in the test data until BACK-1281 is completed.
-	store := before(t, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("0000000000"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date1),
-		Type:          ptr("upload"),
-		DeviceModel:   ptr("723"),
-	}, TestDataSchema{
-		Active:        ptr(false),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date2),
-		Type:          ptr("upload"),
-		DeviceModel:   ptr("523"),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date3),
-		Type:          ptr("cgm"),
-		DeviceModel:   ptr("523"),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date4),
-		Type:          ptr("upload"),
-		DeviceModel:   ptr("Another Model"),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date5),
-		Type:          ptr("upload"),
-		DeviceModel:   ptr("523"),
-	})
-
-	// we need indexes here as the following queries rely on working index hints for performance
-	err := store.EnsureIndexes()
-	if err != nil {
-		t.Error("Failed to run EnsureIndexes()")
-	}
-
-	loopableMedtronicDirectUploadIdsAfter, err := store.GetLoopableMedtronicDirectUploadIdsAfter("1234567890", "2017-01-01T00:00:00Z")
-
-	if err != nil {
-		t.Error("failure querying GetLoopableMedtronicDirectUploadIdsAfter", err)
-	}
-	if !reflect.DeepEqual(loopableMedtronicDirectUploadIdsAfter, []string{}) {
-		t.Error("should not have Loopable Medtronic Direct Upload Ids After, but got some")
-	}
-}
-
-func TestStore_GetLoopableMedtronicDirectUploadIdsAfter_Found(t *testing.T) {
-	date1, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date2, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date3, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date4, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date5, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date6, _ := time.Parse(time.RFC3339, "2018-02-03T04:05:06Z")
-	date7, _ := time.Parse(time.RFC3339, "2016-12-31T23:59:59Z")
-	// We keep _schemaVersion in the test data until BACK-1281 is completed.
-	store := before(t, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("0000000000"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date1),
-		Type:          ptr("upload"),
-		DeviceModel:   ptr("723"),
-	}, TestDataSchema{
-		Active:        ptr(false),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date2),
-		Type:          ptr("upload"),
-		DeviceModel:   ptr("523"),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date3),
-		Type:          ptr("upload"),
-		DeviceModel:   ptr("554"),
-		UploadId:      ptr("11223344"),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date4),
-		Type:          ptr("cgm"),
-		DeviceModel:   ptr("523"),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date5),
-		Type:          ptr("upload"),
-		DeviceModel:   ptr("523K"),
-		UploadId:      ptr("55667788"),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date6),
-		Type:          ptr("upload"),
-		DeviceModel:   ptr("Another Model"),
-	}, TestDataSchema{
-		Active:        ptr(true),
-		UserId:        ptr("1234567890"),
-		SchemaVersion: ptr(1),
-		Time:          ptr(date7),
-		Type:          ptr("upload"),
-		DeviceModel:   ptr("523"),
-	})
-
-	// we need indexes here as the following queries rely on working index hints for performance
-	err := store.EnsureIndexes()
-	if err != nil {
-		t.Error("Failed to run EnsureIndexes()")
-	}
-
-	loopableMedtronicDirectUploadIdsAfter, err := store.GetLoopableMedtronicDirectUploadIdsAfter("1234567890", "2017-01-01T00:00:00Z")
-
-	if err != nil {
-		t.Error("failure querying GetLoopableMedtronicDirectUploadIdsAfter", err)
-	}
-	if !reflect.DeepEqual(loopableMedtronicDirectUploadIdsAfter, []string{"55667788", "11223344"}) {
-		t.Error("should not have Loopable Medtronic Direct Upload Ids After, but got some")
-	}
-}
-
 func TestStore_LatestNoFilter(t *testing.T) {
 	testData := testDataForLatestTests()
 	storeData := storeDataForLatestTests(testData)
@@ -1467,7 +1009,7 @@ func TestStore_LatestUploadIdFilter(t *testing.T) {
 	qParams := &Params{
 		UserID:        "abc123",
 		SchemaVersion: &SchemaVersion{Maximum: 2, Minimum: 0},
-		UploadID:      "zzz4bb16e27c4973c2f37af81784a05d",
+		UploadIDs:     []string{"zzz4bb16e27c4973c2f37af81784a05d"},
 		Latest:        true,
 	}
 
@@ -1518,7 +1060,7 @@ func TestStore_LatestDeviceIdFilter(t *testing.T) {
 
 	qParams := &Params{
 		UserID:        "xyz123",
-		DeviceID:      "dev789",
+		DeviceIDs:     []string{"dev789"},
 		SchemaVersion: &SchemaVersion{Maximum: 2, Minimum: 0},
 		Latest:        true,
 	}
@@ -1648,7 +1190,7 @@ func TestStore_SampleIntervalFilter_FiveMinute(t *testing.T) {
 
 	qParams := &Params{
 		UserID:                "abc123",
-		DeviceID:              "dev123",
+		DeviceIDs:             []string{"dev123"},
 		Types:                 []string{"cbg"},
 		SchemaVersion:         &SchemaVersion{Maximum: 2, Minimum: 0},
 		SampleIntervalMinimum: fiveMinSampleIntervalMS,
@@ -1691,7 +1233,7 @@ func TestStore_SampleIntervalFilter_Minute(t *testing.T) {
 
 	qParams := &Params{
 		UserID:                "abc123",
-		DeviceID:              "dev123",
+		DeviceIDs:             []string{"dev123"},
 		Types:                 []string{"cbg"},
 		SchemaVersion:         &SchemaVersion{Maximum: 2, Minimum: 0},
 		SampleIntervalMinimum: oneMinSampleIntervalMS,
@@ -1734,7 +1276,7 @@ func TestStore_SampleIntervalFilter_FifteenMinute(t *testing.T) {
 
 	qParams := &Params{
 		UserID:                "abc123",
-		DeviceID:              "dev123",
+		DeviceIDs:             []string{"dev123"},
 		Types:                 []string{"cbg"},
 		SchemaVersion:         &SchemaVersion{Maximum: 2, Minimum: 0},
 		SampleIntervalMinimum: fifteenMinSampleIntervalMS,
@@ -1776,7 +1318,7 @@ func TestStore_SampleIntervalFilter_NotSet(t *testing.T) {
 
 	qParams := &Params{
 		UserID:        "abc123",
-		DeviceID:      "dev123",
+		DeviceIDs:     []string{"dev123"},
 		Types:         []string{"cbg"},
 		SchemaVersion: &SchemaVersion{Maximum: 2, Minimum: 0},
 	}
@@ -1863,11 +1405,11 @@ func TestStore_TypeFieldFilters_NoTypesAndDosingDecisionReasonFilter(t *testing.
 
 	qParams := &Params{
 		UserID:        "abc123",
-		DeviceID:      "dev123",
+		DeviceIDs:     []string{"dev123"},
 		SchemaVersion: &SchemaVersion{Maximum: 2, Minimum: 0},
 		TypeFieldFilter: TypeFieldFilter{
 			"dosingDecision": FieldFilter{
-				"reason": []string{"simpleBolus"},
+				"reason": []FieldCondition{{Operator: FilterIn, Values: []interface{}{"simpleBolus"}}},
 			},
 		},
 	}
@@ -1907,12 +1449,12 @@ func TestStore_TypeFieldFilters_TypesAndDosingDecisionFilter(t *testing.T) {
 
 	qParams := &Params{
 		UserID:        "abc123",
-		DeviceID:      "dev123",
+		DeviceIDs:     []string{"dev123"},
 		Types:         []string{"cbg", "dosingDecision"},
 		SchemaVersion: &SchemaVersion{Maximum: 2, Minimum: 0},
 		TypeFieldFilter: TypeFieldFilter{
 			"dosingDecision": FieldFilter{
-				"reason": []string{"simpleBolus"},
+				"reason": []FieldCondition{{Operator: FilterIn, Values: []interface{}{"simpleBolus"}}},
 			},
 		},
 	}
@@ -1952,12 +1494,12 @@ func TestStore_TypeFieldFilters_TypesAndDosingDecisionFilterSampleInterfacel(t *
 
 	qParams := &Params{
 		UserID:        "abc123",
-		DeviceID:      "dev123",
+		DeviceIDs:     []string{"dev123"},
 		Types:         []string{"cbg", "dosingDecision"},
 		SchemaVersion: &SchemaVersion{Maximum: 2, Minimum: 0},
 		TypeFieldFilter: TypeFieldFilter{
 			"dosingDecision": FieldFilter{
-				"reason": []string{"simpleBolus"},
+				"reason": []FieldCondition{{Operator: FilterIn, Values: []interface{}{"simpleBolus"}}},
 			},
 		},
 		SampleIntervalMinimum: fiveMinSampleIntervalMS,
@@ -1989,3 +1531,74 @@ func TestStore_TypeFieldFilters_TypesAndDosingDecisionFilterSampleInterfacel(t *
 		}
 	}
 }
+
+func TestStore_GetParams_Sort(t *testing.T) {
+	schema := &SchemaVersion{Minimum: 1, Maximum: 3}
+
+	for value, expectedSort := range map[string]int{"time": SortAscending, "-time": SortDescending} {
+		query := url.Values{
+			":userID": []string{"1122334455"},
+			"sort":    []string{value},
+		}
+
+		params, err := GetParams(query, schema)
+		if err != nil {
+			t.Errorf("should not have received error for sort %q, but got one", value)
+			continue
+		}
+		if params.Sort != expectedSort {
+			t.Errorf("expected sort %d for %q but got %d", expectedSort, value, params.Sort)
+		}
+	}
+
+	query := url.Values{
+		":userID": []string{"1122334455"},
+		"sort":    []string{"type"},
+	}
+	if _, err := GetParams(query, schema); err == nil {
+		t.Error("should have received error for invalid sort, but got nil")
+	}
+}
+
+// failingIterator is a StorageIterator that returns count results, then stops on err
+type failingIterator struct {
+	count int
+	err   error
+}
+
+func (l *failingIterator) Next(context.Context) bool {
+	l.count--
+	return l.count >= 0
+}
+
+func (l *failingIterator) Decode(interface{}) error {
+	return nil
+}
+
+func (l *failingIterator) Close(context.Context) error {
+	return nil
+}
+
+func (l *failingIterator) Err() error {
+	if l.count < 0 {
+		return l.err
+	}
+	return nil
+}
+
+func TestStore_multiStorageIterator_Err(t *testing.T) {
+	err := errors.New("cursor error")
+	iter := &multiStorageIterator{iters: []StorageIterator{&failingIterator{count: 1, err: err}, &failingIterator{count: 2}}}
+
+	count := 0
+	for iter.Next(context.Background()) {
+		count++
+	}
+	// The iterators after the failed one are not read
+	if count != 1 {
+		t.Errorf("multiStorageIterator read %d results after an error, expected 1", count)
+	}
+	if iter.Err() != err {
+		t.Errorf("multiStorageIterator returned error %v, expected %s", iter.Err(), err)
+	}
+}
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/tidepool-org/tide-whisperer/datum"
+)
+
+// defaultSampleInterval is the sampleInterval of cbg data that doesn't record one, in milliseconds
+const defaultSampleInterval = 5 * 60 * 1000
+
+// summaryTypes are the types of data summarized by GetGlucoseSummary
+var summaryTypes = []string{"cbg", "smbg"}
+
+type (
+	// GlucoseSummary summarizes the cbg and smbg data of a user over a period. Blood glucose values
+	// are in Units.
+	GlucoseSummary struct {
+		Units      string             `json:"units"`
+		Thresholds GlucoseThresholds  `json:"thresholds"`
+		CBG        *GlucoseStatistics `json:"cbg,omitempty"`
+		SMBG       *GlucoseStatistics `json:"smbg,omitempty"`
+	}
+
+	// GlucoseStatistics are the statistics of the blood glucose readings of a type. The glucose
+	// management indicator and wear are only calculated for cbg.
+	GlucoseStatistics struct {
+		Count                  int64         `json:"count"`
+		Earliest               time.Time     `json:"earliest"`
+		Latest                 time.Time     `json:"latest"`
+		Mean                   float64       `json:"mean"`
+		StandardDeviation      float64       `json:"standardDeviation"`
+		CoefficientOfVariation float64       `json:"coefficientOfVariation"`
+		GlucoseManagement      *float64      `json:"glucoseManagementIndicator,omitempty"`
+		LowBloodGlucoseIndex   float64       `json:"lowBloodGlucoseIndex"`
+		HighBloodGlucoseIndex  float64       `json:"highBloodGlucoseIndex"`
+		TimeInRanges           GlucoseRanges `json:"timeInRanges"`
+		Wear                   *float64      `json:"wear,omitempty"`
+	}
+
+	// GlucoseRanges are the percentages of readings in each of the GlucoseThresholds ranges
+	GlucoseRanges struct {
+		VeryLow  float64 `json:"veryLow"`
+		Low      float64 `json:"low"`
+		Target   float64 `json:"target"`
+		High     float64 `json:"high"`
+		VeryHigh float64 `json:"veryHigh"`
+	}
+
+	// glucoseSummaryGroup is the result of glucoseSummaryPipeline for a type, in mg/dL
+	glucoseSummaryGroup struct {
+		Type              string    `bson:"_id"`
+		Count             int64     `bson:"count"`
+		Earliest          time.Time `bson:"earliest"`
+		Latest            time.Time `bson:"latest"`
+		Mean              float64   `bson:"mean"`
+		StandardDeviation float64   `bson:"standardDeviation"`
+		LowRisk           float64   `bson:"lowRisk"`
+		HighRisk          float64   `bson:"highRisk"`
+		VeryLow           int64     `bson:"veryLow"`
+		Low               int64     `bson:"low"`
+		Target            int64     `bson:"target"`
+		High              int64     `bson:"high"`
+		VeryHigh          int64     `bson:"veryHigh"`
+		SampleDuration    int64     `bson:"sampleDuration"`
+	}
+)
+
+// glucoseSummaryPipeline returns the aggregation pipeline grouping the blood glucose data matching the
+// query by type. Values are converted to mg/dL before they are compared with the thresholds.
+func glucoseSummaryPipeline(query bson.M, thresholds GlucoseThresholds) []bson.M {
+	// The blood glucose risk function of Kovatchev et al., with blood glucose in mg/dL
+	risk := bson.M{"$multiply": bson.A{1.509, bson.M{"$subtract": bson.A{bson.M{"$pow": bson.A{bson.M{"$ln": "$mgdL"}, 1.084}}, 5.381}}}}
+	squaredRisk := bson.M{"$multiply": bson.A{10, "$risk", "$risk"}}
+
+	countIf := func(conditions ...bson.M) bson.M {
+		return bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$and": conditions}, 1, 0}}}
+	}
+
+	return []bson.M{
+		{"$match": query},
+		{"$project": bson.M{"type": 1, "time": 1, "sampleInterval": 1, "mgdL": bloodGlucoseMgdLExpression("value")}},
+		{"$match": bson.M{"mgdL": bson.M{"$gt": 0}}},
+		{"$addFields": bson.M{"risk": risk}},
+		{"$group": bson.M{
+			"_id":               "$type",
+			"count":             bson.M{"$sum": 1},
+			"earliest":          bson.M{"$min": "$time"},
+			"latest":            bson.M{"$max": "$time"},
+			"mean":              bson.M{"$avg": "$mgdL"},
+			"standardDeviation": bson.M{"$stdDevSamp": "$mgdL"},
+			"lowRisk":           bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$lt": bson.A{"$risk", 0}}, squaredRisk, 0}}},
+			"highRisk":          bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$risk", 0}}, squaredRisk, 0}}},
+			"veryLow":           countIf(bson.M{"$lt": bson.A{"$mgdL", thresholds.VeryLow}}),
+			"low":               countIf(bson.M{"$gte": bson.A{"$mgdL", thresholds.VeryLow}}, bson.M{"$lt": bson.A{"$mgdL", thresholds.Low}}),
+			"target":            countIf(bson.M{"$gte": bson.A{"$mgdL", thresholds.Low}}, bson.M{"$lte": bson.A{"$mgdL", thresholds.High}}),
+			"high":              countIf(bson.M{"$gt": bson.A{"$mgdL", thresholds.High}}, bson.M{"$lte": bson.A{"$mgdL", thresholds.VeryHigh}}),
+			"veryHigh":          countIf(bson.M{"$gt": bson.A{"$mgdL", thresholds.VeryHigh}}),
+			"sampleDuration":    bson.M{"$sum": bson.M{"$ifNull": bson.A{"$sampleInterval", defaultSampleInterval}}},
+		}},
+	}
+}
+
+// glucoseStatistics returns the statistics of the group in the units. Wear is calculated over the
+// period of the date parameters, or of the data where they are not set.
+func glucoseStatistics(group glucoseSummaryGroup, date Date, units string) *GlucoseStatistics {
+	statistics := &GlucoseStatistics{
+		Count:                 group.Count,
+		Earliest:              group.Earliest,
+		Latest:                group.Latest,
+		Mean:                  datum.BloodGlucoseInUnits(group.Mean, units),
+		StandardDeviation:     datum.BloodGlucoseInUnits(group.StandardDeviation, units),
+		LowBloodGlucoseIndex:  group.LowRisk / float64(group.Count),
+		HighBloodGlucoseIndex: group.HighRisk / float64(group.Count),
+		TimeInRanges: GlucoseRanges{
+			VeryLow:  percentage(group.VeryLow, group.Count),
+			Low:      percentage(group.Low, group.Count),
+			Target:   percentage(group.Target, group.Count),
+			High:     percentage(group.High, group.Count),
+			VeryHigh: percentage(group.VeryHigh, group.Count),
+		},
+	}
+	if group.Mean > 0 {
+		statistics.CoefficientOfVariation = group.StandardDeviation / group.Mean * 100
+	}
+
+	if group.Type == "cbg" {
+		// The glucose management indicator of Bergenstal et al., with the mean in mg/dL
+		glucoseManagement := 3.31 + 0.02392*group.Mean
+		statistics.GlucoseManagement = &glucoseManagement
+
+		start, end := date.Start, date.End
+		if start.IsZero() {
+			start = group.Earliest
+		}
+		if end.IsZero() {
+			end = group.Latest
+		}
+		if period := end.Sub(start); period > 0 {
+			wear := math.Min(float64(group.SampleDuration)/float64(period/time.Millisecond)*100, 100)
+			statistics.Wear = &wear
+		}
+	}
+	return statistics
+}
+
+func percentage(count int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total) * 100
+}
+
+// GetGlucoseSummary returns the summary of the user's cbg and smbg data matching the parameters, in the units
+func (c *MongoStoreClient) GetGlucoseSummary(p *Params, thresholds GlucoseThresholds, units string) (*GlucoseSummary, error) {
+	summary := &GlucoseSummary{Units: units, Thresholds: thresholds.InUnits(units)}
+
+	types := []string{}
+	for _, typ := range summaryTypes {
+		if (len(p.Types) == 0 || p.Types[0] == "" || contains(typ, p.Types)) && !contains(typ, p.ExcludeTypes) {
+			types = append(types, typ)
+		}
+	}
+	if len(types) == 0 {
+		return summary, nil
+	}
+
+	query := generateMongoQuery(p)
+	query["type"] = bson.M{"$in": types}
+
+	cursor, err := dataCollection(c).Aggregate(c.context, glucoseSummaryPipeline(query, thresholds))
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []glucoseSummaryGroup
+	if err = cursor.All(c.context, &groups); err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		switch group.Type {
+		case "cbg":
+			summary.CBG = glucoseStatistics(group, p.Date, units)
+		case "smbg":
+			summary.SMBG = glucoseStatistics(group, p.Date, units)
+		}
+	}
+	return summary, nil
+}
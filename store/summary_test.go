@@ -0,0 +1,79 @@
+package store
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestStore_glucoseSummaryPipeline(t *testing.T) {
+	query := bson.M{"_userId": "abc123", "type": bson.M{"$in": summaryTypes}}
+	pipeline := glucoseSummaryPipeline(query, DefaultGlucoseThresholds)
+
+	if !cmp.Equal(pipeline[0], bson.M{"$match": query}) {
+		t.Errorf("glucoseSummaryPipeline first stage is %v, expected the query", pipeline[0])
+	}
+
+	group := pipeline[len(pipeline)-1]["$group"].(bson.M)
+	expected := bson.M{"$sum": bson.M{"$cond": bson.A{
+		bson.M{"$and": []bson.M{{"$gte": bson.A{"$mgdL", 70.0}}, {"$lte": bson.A{"$mgdL", 180.0}}}}, 1, 0,
+	}}}
+	if diff := cmp.Diff(expected, group["target"]); diff != "" {
+		t.Errorf("glucoseSummaryPipeline target mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestStore_glucoseStatistics(t *testing.T) {
+	earliest := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	group := glucoseSummaryGroup{
+		Type:              "cbg",
+		Count:             200,
+		Earliest:          earliest,
+		Latest:            earliest.Add(24 * time.Hour),
+		Mean:              154,
+		StandardDeviation: 50,
+		LowRisk:           200,
+		HighRisk:          1000,
+		VeryLow:           2,
+		Low:               8,
+		Target:            140,
+		High:              40,
+		VeryHigh:          10,
+		SampleDuration:    200 * defaultSampleInterval,
+	}
+
+	statistics := glucoseStatistics(group, Date{Start: earliest, End: earliest.Add(24 * time.Hour)}, UnitsMgdL)
+
+	if statistics.Mean != 154 || statistics.LowBloodGlucoseIndex != 1 || statistics.HighBloodGlucoseIndex != 5 {
+		t.Errorf("glucoseStatistics returned %+v", statistics)
+	}
+	if math.Abs(statistics.CoefficientOfVariation-32.47) > 0.01 {
+		t.Errorf("glucoseStatistics returned coefficient of variation %f", statistics.CoefficientOfVariation)
+	}
+	if statistics.GlucoseManagement == nil || math.Abs(*statistics.GlucoseManagement-6.99) > 0.01 {
+		t.Errorf("glucoseStatistics returned glucose management indicator %v", statistics.GlucoseManagement)
+	}
+	if statistics.Wear == nil || math.Abs(*statistics.Wear-69.44) > 0.01 {
+		t.Errorf("glucoseStatistics returned wear %v", statistics.Wear)
+	}
+	if expected := (GlucoseRanges{VeryLow: 1, Low: 4, Target: 70, High: 20, VeryHigh: 5}); statistics.TimeInRanges != expected {
+		t.Errorf("glucoseStatistics returned time in ranges %+v, expected %+v", statistics.TimeInRanges, expected)
+	}
+
+	statistics = glucoseStatistics(group, Date{}, UnitsMmolL)
+	if math.Abs(statistics.Mean-8.55) > 0.01 {
+		t.Errorf("glucoseStatistics returned mean %f mmol/L", statistics.Mean)
+	}
+	if statistics.Wear == nil || math.Abs(*statistics.Wear-69.44) > 0.01 {
+		t.Errorf("glucoseStatistics returned wear %v over the period of the data", statistics.Wear)
+	}
+
+	group.Type = "smbg"
+	statistics = glucoseStatistics(group, Date{}, UnitsMgdL)
+	if statistics.GlucoseManagement != nil || statistics.Wear != nil {
+		t.Errorf("glucoseStatistics returned cbg only statistics for smbg")
+	}
+}
@@ -0,0 +1,21 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	// The production image has no zoneinfo database, so the timezone parameter relies on the embedded copy
+	_ "time/tzdata"
+)
+
+// ParseTimezone parses the IANA name of the `timezone` parameter, returning nil if it is not set
+func ParseTimezone(value string) (*time.Location, error) {
+	if value == "" {
+		return nil, nil
+	}
+	location, err := time.LoadLocation(value)
+	if err != nil || value == "Local" {
+		return nil, errors.New("timezone parameter not valid")
+	}
+	return location, nil
+}
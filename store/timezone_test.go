@@ -0,0 +1,17 @@
+package store
+
+import "testing"
+
+func TestStore_ParseTimezone(t *testing.T) {
+	if location, err := ParseTimezone(""); location != nil || err != nil {
+		t.Errorf("ParseTimezone returned %v, %v for no timezone", location, err)
+	}
+	if location, err := ParseTimezone("America/Los_Angeles"); err != nil || location.String() != "America/Los_Angeles" {
+		t.Errorf("ParseTimezone returned %v, %v", location, err)
+	}
+	for _, value := range []string{"Local", "Mars/Olympus_Mons"} {
+		if _, err := ParseTimezone(value); err == nil {
+			t.Errorf("ParseTimezone(%q) did not return an error", value)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TypeGroups are names that may be used in the `type` and `excludeType` parameters in place of the
+// types they group
+var TypeGroups = map[string][]string{
+	"glucose":         {"cbg", "smbg"},
+	"insulinDelivery": {"basal", "bolus", "insulin"},
+}
+
+// parseTypes splits the comma separated types, replacing type groups with their types. As for
+// strings.Split, an empty value returns a single empty type.
+func parseTypes(value string) []string {
+	types := []string{}
+	for _, typ := range strings.Split(value, ",") {
+		expanded, ok := TypeGroups[typ]
+		if !ok {
+			expanded = []string{typ}
+		}
+		for _, expandedType := range expanded {
+			if !contains(expandedType, types) {
+				types = append(types, expandedType)
+			}
+		}
+	}
+	return types
+}
+
+// typeQuery returns the query of the requested and excluded types, or nil if neither is set
+func typeQuery(p *Params) interface{} {
+	typeQuery := bson.M{}
+	if len(p.Types) > 0 && p.Types[0] != "" {
+		typeQuery["$in"] = p.Types
+	}
+	if len(p.ExcludeTypes) > 0 {
+		typeQuery["$nin"] = p.ExcludeTypes
+	}
+	if len(typeQuery) == 0 {
+		return nil
+	}
+	return typeQuery
+}
+
+// typeRequested returns whether the parameters read data of the type
+func typeRequested(p *Params, typ string) bool {
+	if contains(typ, p.ExcludeTypes) {
+		return false
+	}
+	return len(p.Types) == 0 || p.Types[0] == "" || contains(typ, p.Types)
+}
@@ -0,0 +1,61 @@
+package store
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestStore_parseTypes(t *testing.T) {
+	tests := map[string][]string{
+		"":                        {""},
+		"cbg":                     {"cbg"},
+		"glucose":                 {"cbg", "smbg"},
+		"insulinDelivery,food":    {"basal", "bolus", "insulin", "food"},
+		"smbg,glucose,wizard,cbg": {"smbg", "cbg", "wizard"},
+	}
+	for value, expected := range tests {
+		if diff := cmp.Diff(expected, parseTypes(value)); diff != "" {
+			t.Errorf("parseTypes(%q) mismatch (-want +got):\n%s", value, diff)
+		}
+	}
+}
+
+func TestStore_GetParams_ExcludeType(t *testing.T) {
+	query := url.Values{
+		":userID":     []string{"1122334455"},
+		"type":        []string{"glucose,insulinDelivery"},
+		"excludeType": []string{"smbg,insulin"},
+	}
+
+	params, err := GetParams(query, &SchemaVersion{Minimum: 1, Maximum: 3})
+	if err != nil {
+		t.Fatalf("GetParams returned error %s", err)
+	}
+	if diff := cmp.Diff([]string{"cbg", "smbg", "basal", "bolus", "insulin"}, params.Types); diff != "" {
+		t.Errorf("Unexpected 'types' result when getting query params (-want +have):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"smbg", "insulin"}, params.ExcludeTypes); diff != "" {
+		t.Errorf("Unexpected 'excludeTypes' result when getting query params (-want +have):\n%s", diff)
+	}
+
+	mongoQuery := generateMongoQuery(params)
+	expected := bson.M{"$in": params.Types, "$nin": params.ExcludeTypes}
+	if diff := cmp.Diff(expected, mongoQuery["type"]); diff != "" {
+		t.Errorf("Unexpected type query (-want +have):\n%s", diff)
+	}
+}
+
+func TestStore_generateMongoQuery_excludeTypeOnly(t *testing.T) {
+	params := &Params{UserID: "abc123", Types: []string{""}, ExcludeTypes: []string{"cbg", "upload"}}
+
+	mongoQuery := generateMongoQuery(params)
+	if diff := cmp.Diff(bson.M{"$nin": []string{"cbg", "upload"}}, mongoQuery["type"]); diff != "" {
+		t.Errorf("Unexpected type query (-want +have):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{dataCollectionName}, collectionNamesForParams(params)); diff != "" {
+		t.Errorf("Unexpected collections when excluding uploads (-want +have):\n%s", diff)
+	}
+}
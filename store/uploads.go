@@ -0,0 +1,219 @@
+package store
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// DefaultUploadsLimit is the number of uploads returned by GetUploads when `limit` is not set
+	DefaultUploadsLimit = 100
+	// MaximumUploadsLimit is the largest number of uploads that may be requested with `limit`
+	MaximumUploadsLimit = 1000
+)
+
+// UploadStates are the values of the `_state` of an upload
+var UploadStates = []string{"open", "closed"}
+
+type (
+	// UploadParams are the parameters of GetUploads
+	UploadParams struct {
+		UserID    string
+		States    []string
+		DeviceIDs []string
+		Deleted   bool
+		Limit     int
+		Cursor    *Cursor
+	}
+
+	// Upload is an upload (data set) of a user, with the number of records uploaded and the range
+	// of their times. Earliest and Latest are not set if the upload has no records.
+	Upload struct {
+		ID                  interface{} `bson:"_id" json:"-"`
+		UploadID            string      `bson:"uploadId" json:"uploadId"`
+		DeviceID            string      `bson:"deviceId" json:"deviceId,omitempty"`
+		Time                time.Time   `bson:"time" json:"time"`
+		DeviceManufacturers []string    `bson:"deviceManufacturers" json:"deviceManufacturers,omitempty"`
+		DeviceModel         string      `bson:"deviceModel" json:"deviceModel,omitempty"`
+		DeviceSerialNumber  string      `bson:"deviceSerialNumber" json:"deviceSerialNumber,omitempty"`
+		DataSetType         string      `bson:"dataSetType" json:"dataSetType,omitempty"`
+		State               string      `bson:"state" json:"state,omitempty"`
+		DeletedTime         *time.Time  `bson:"deletedTime" json:"deletedTime,omitempty"`
+		ClientName          string      `bson:"clientName" json:"clientName,omitempty"`
+		Count               int64       `bson:"-" json:"count"`
+		Earliest            *time.Time  `bson:"-" json:"earliest,omitempty"`
+		Latest              *time.Time  `bson:"-" json:"latest,omitempty"`
+	}
+
+	// uploadCount is the number of records of an upload, and the range of their times
+	uploadCount struct {
+		UploadID string    `bson:"_id"`
+		Count    int64     `bson:"count"`
+		Earliest time.Time `bson:"earliest"`
+		Latest   time.Time `bson:"latest"`
+	}
+)
+
+// ParseUploadParams parses the parameters of the uploads of a user. `state` and `deviceId` are comma
+// separated lists, and deleted uploads are only returned if `deleted` is true.
+func ParseUploadParams(q url.Values) (*UploadParams, error) {
+	p := &UploadParams{
+		UserID:    q.Get(":userID"),
+		States:    splitValues(q.Get("state")),
+		DeviceIDs: splitValues(q.Get("deviceId")),
+		Limit:     DefaultUploadsLimit,
+	}
+
+	for _, state := range p.States {
+		if !contains(state, UploadStates) {
+			return nil, errors.New("state parameter not valid")
+		}
+	}
+
+	if value := q.Get("deleted"); value != "" {
+		deleted, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("deleted parameter not valid")
+		}
+		p.Deleted = deleted
+	}
+
+	if value := q.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > MaximumUploadsLimit {
+			return nil, errors.New("limit parameter not valid")
+		}
+		p.Limit = limit
+	}
+
+	if value := q.Get("cursor"); value != "" {
+		cursor, err := DecodeCursor(value)
+		if err != nil {
+			return nil, err
+		}
+		if cursor.Collection != dataSetsCollectionName {
+			return nil, errors.New("cursor parameter not valid")
+		}
+		p.Cursor = cursor
+	}
+
+	return p, nil
+}
+
+// uploadsQuery returns the query of the uploads matching the parameters
+func uploadsQuery(p *UploadParams) bson.M {
+	query := bson.M{
+		"_userId": p.UserID,
+		"type":    "upload",
+	}
+	if !p.Deleted {
+		query["_active"] = true
+		query["deletedTime"] = bson.M{"$exists": false}
+	}
+	if len(p.States) > 0 {
+		query["_state"] = bson.M{"$in": p.States}
+	}
+	if len(p.DeviceIDs) > 0 {
+		query["deviceId"] = bson.M{"$in": p.DeviceIDs}
+	}
+	if p.Cursor != nil {
+		appendAndQuery(query, cursorQuery(p.Cursor, 0, SortDescending))
+	}
+	return query
+}
+
+// uploadsPipeline returns the aggregation pipeline reading the page of uploads matching the
+// parameters, most recent first, with one more upload than the limit to tell if there is a next page.
+// `deletedTime` has been stored as both a string and a date, so it is converted to a date.
+func uploadsPipeline(p *UploadParams) []bson.M {
+	return []bson.M{
+		{"$match": uploadsQuery(p)},
+		{"$sort": bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}},
+		{"$limit": p.Limit + 1},
+		{"$project": bson.M{
+			"_id":                 1,
+			"uploadId":            1,
+			"deviceId":            1,
+			"time":                1,
+			"deviceManufacturers": 1,
+			"deviceModel":         1,
+			"deviceSerialNumber":  1,
+			"dataSetType":         1,
+			"state":               "$_state",
+			"deletedTime":         bson.M{"$convert": bson.M{"input": "$deletedTime", "to": "date", "onError": nil, "onNull": nil}},
+			"clientName":          "$client.name",
+		}},
+	}
+}
+
+// uploadCountsPipeline returns the aggregation pipeline counting the active records of each of the
+// uploads, and the range of their times
+func uploadCountsPipeline(userID string, uploadIDs []string) []bson.M {
+	return []bson.M{
+		{"$match": bson.M{
+			"_userId":  userID,
+			"_active":  true,
+			"uploadId": bson.M{"$in": uploadIDs},
+		}},
+		{"$group": bson.M{
+			"_id":      "$uploadId",
+			"count":    bson.M{"$sum": 1},
+			"earliest": bson.M{"$min": "$time"},
+			"latest":   bson.M{"$max": "$time"},
+		}},
+	}
+}
+
+// GetUploads returns a page of the uploads of a user matching the parameters, most recent first,
+// along with the cursor to the next page, or nil if this is the last page
+func (c *MongoStoreClient) GetUploads(p *UploadParams) ([]Upload, *Cursor, error) {
+	cursor, err := dataSetsCollection(c).Aggregate(c.context, uploadsPipeline(p))
+	if err != nil {
+		return nil, nil, err
+	}
+	uploads := []Upload{}
+	if err = cursor.All(c.context, &uploads); err != nil {
+		return nil, nil, err
+	}
+
+	var nextCursor *Cursor
+	if len(uploads) > p.Limit {
+		uploads = uploads[:p.Limit]
+		last := uploads[len(uploads)-1]
+		nextCursor = &Cursor{Collection: dataSetsCollectionName, Time: last.Time, ID: last.ID}
+	}
+	if len(uploads) == 0 {
+		return uploads, nil, nil
+	}
+
+	uploadIDs := make([]string, len(uploads))
+	for idx, upload := range uploads {
+		uploadIDs[idx] = upload.UploadID
+	}
+	cursor, err = dataCollection(c).Aggregate(c.context, uploadCountsPipeline(p.UserID, uploadIDs))
+	if err != nil {
+		return nil, nil, err
+	}
+	var counts []uploadCount
+	if err = cursor.All(c.context, &counts); err != nil {
+		return nil, nil, err
+	}
+
+	for _, count := range counts {
+		for idx := range uploads {
+			if uploads[idx].UploadID != count.UploadID {
+				continue
+			}
+			count := count
+			uploads[idx].Count = count.Count
+			uploads[idx].Earliest = &count.Earliest
+			uploads[idx].Latest = &count.Latest
+		}
+	}
+
+	return uploads, nextCursor, nil
+}
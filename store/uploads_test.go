@@ -0,0 +1,110 @@
+package store
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestStore_ParseUploadParams(t *testing.T) {
+	params, err := ParseUploadParams(url.Values{":userID": []string{"abc123"}})
+	if err != nil {
+		t.Fatalf("ParseUploadParams returned error %s", err)
+	}
+	if diff := cmp.Diff(&UploadParams{UserID: "abc123", Limit: DefaultUploadsLimit}, params); diff != "" {
+		t.Errorf("Unexpected default upload params (-want +have):\n%s", diff)
+	}
+
+	cursor := &Cursor{Collection: dataSetsCollectionName, Time: time.Date(2021, 3, 14, 0, 0, 0, 0, time.UTC), ID: "upload123"}
+	encoded, _ := cursor.Encode()
+	params, err = ParseUploadParams(url.Values{
+		":userID":  []string{"abc123"},
+		"state":    []string{"open,closed"},
+		"deviceId": []string{"dev123,dev456"},
+		"deleted":  []string{"true"},
+		"limit":    []string{"10"},
+		"cursor":   []string{encoded},
+	})
+	if err != nil {
+		t.Fatalf("ParseUploadParams returned error %s", err)
+	}
+	expected := &UploadParams{
+		UserID:    "abc123",
+		States:    []string{"open", "closed"},
+		DeviceIDs: []string{"dev123", "dev456"},
+		Deleted:   true,
+		Limit:     10,
+		Cursor:    cursor,
+	}
+	if diff := cmp.Diff(expected, params); diff != "" {
+		t.Errorf("Unexpected upload params (-want +have):\n%s", diff)
+	}
+
+	dataCursor, _ := (&Cursor{Collection: dataCollectionName, Time: cursor.Time, ID: "datum123"}).Encode()
+	for key, value := range map[string]string{"state": "deleted", "deleted": "maybe", "limit": "1001", "cursor": dataCursor} {
+		if _, err := ParseUploadParams(url.Values{":userID": []string{"abc123"}, key: []string{value}}); err == nil || err.Error() != key+" parameter not valid" {
+			t.Errorf("ParseUploadParams with %s=%s returned error %v", key, value, err)
+		}
+	}
+}
+
+func TestStore_uploadsQuery(t *testing.T) {
+	query := uploadsQuery(&UploadParams{UserID: "abc123", States: []string{"closed"}, DeviceIDs: []string{"dev123"}})
+	expected := bson.M{
+		"_userId":     "abc123",
+		"type":        "upload",
+		"_active":     true,
+		"deletedTime": bson.M{"$exists": false},
+		"_state":      bson.M{"$in": []string{"closed"}},
+		"deviceId":    bson.M{"$in": []string{"dev123"}},
+	}
+	if diff := cmp.Diff(expected, query); diff != "" {
+		t.Errorf("Unexpected uploads query (-want +have):\n%s", diff)
+	}
+
+	cursor := &Cursor{Collection: dataSetsCollectionName, Time: time.Date(2021, 3, 14, 0, 0, 0, 0, time.UTC), ID: "upload123"}
+	query = uploadsQuery(&UploadParams{UserID: "abc123", Deleted: true, Cursor: cursor})
+	expected = bson.M{
+		"_userId": "abc123",
+		"type":    "upload",
+		"$and": []bson.M{{"$or": []bson.M{
+			{"time": bson.M{"$lt": cursor.Time}},
+			{"time": cursor.Time, "_id": bson.M{"$lt": cursor.ID}},
+		}}},
+	}
+	if diff := cmp.Diff(expected, query); diff != "" {
+		t.Errorf("Unexpected deleted uploads query (-want +have):\n%s", diff)
+	}
+}
+
+func TestStore_uploadsPipeline(t *testing.T) {
+	pipeline := uploadsPipeline(&UploadParams{UserID: "abc123", Limit: 10})
+	if len(pipeline) != 4 {
+		t.Fatalf("Unexpected uploads pipeline %v", pipeline)
+	}
+	if diff := cmp.Diff(bson.M{"$limit": 11}, pipeline[2]); diff != "" {
+		t.Errorf("Unexpected uploads pipeline limit (-want +have):\n%s", diff)
+	}
+	project := pipeline[3]["$project"].(bson.M)
+	if project["state"] != "$_state" || project["clientName"] != "$client.name" {
+		t.Errorf("Unexpected uploads pipeline projection %v", project)
+	}
+}
+
+func TestStore_uploadCountsPipeline(t *testing.T) {
+	expected := []bson.M{
+		{"$match": bson.M{"_userId": "abc123", "_active": true, "uploadId": bson.M{"$in": []string{"upload123", "upload456"}}}},
+		{"$group": bson.M{
+			"_id":      "$uploadId",
+			"count":    bson.M{"$sum": 1},
+			"earliest": bson.M{"$min": "$time"},
+			"latest":   bson.M{"$max": "$time"},
+		}},
+	}
+	if diff := cmp.Diff(expected, uploadCountsPipeline("abc123", []string{"upload123", "upload456"})); diff != "" {
+		t.Errorf("Unexpected upload counts pipeline (-want +have):\n%s", diff)
+	}
+}
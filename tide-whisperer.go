@@ -8,8 +8,11 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -25,6 +28,9 @@ import (
 	"github.com/tidepool-org/go-common/clients/shoreline"
 
 	"github.com/tidepool-org/tide-whisperer/auth"
+	"github.com/tidepool-org/tide-whisperer/export"
+	"github.com/tidepool-org/tide-whisperer/nightscout"
+	"github.com/tidepool-org/tide-whisperer/report"
 	"github.com/tidepool-org/tide-whisperer/store"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -40,6 +46,10 @@ type (
 		Service             disc.ServiceListing `json:"service"`
 		Mongo               mongo.Config        `json:"mongo"`
 		store.SchemaVersion `json:"schemaVersion"`
+		GlucoseThresholds   *store.GlucoseThresholds      `json:"glucoseThresholds"`
+		FieldFilters        store.AllowedTypeFieldFilters `json:"fieldFilters"`
+		SourceRules         store.SourceRules             `json:"sourceRules"`
+		DedupeRules         store.DedupeRules             `json:"dedupeRules"`
 	}
 
 	// so we can wrap and marshal the detailed error
@@ -73,9 +83,10 @@ var (
 )
 
 const (
-	dataAPIPrefix             = "api/data "
-	medtronicLoopBoundaryDate = "2017-09-01"
-	slowQueryDuration         = 0.1 // seconds
+	dataAPIPrefix        = "api/data "
+	nextCursorHeader     = "x-tidepool-next-cursor"
+	slowQueryDuration    = 0.1 // seconds
+	defaultAGPBinMinutes = 15
 )
 
 // set the internal message that we will use for logging
@@ -109,6 +120,39 @@ func main() {
 
 	config.Mongo.FromEnv()
 
+	if config.GlucoseThresholds == nil {
+		config.GlucoseThresholds = &store.DefaultGlucoseThresholds
+	} else if err := config.GlucoseThresholds.Validate(); err != nil {
+		log.Fatal(dataAPIPrefix, "Problem loading config: ", err)
+	}
+
+	// The allowlist of field filters is replaced by the config, if set, so that filters can be added without a release e.g.
+	// {"fieldFilters": {"cbg": {"value": {"valueType": "number", "operators": ["gte", "lte"]}}}}
+	if config.FieldFilters != nil {
+		if err := config.FieldFilters.Validate(); err != nil {
+			log.Fatal(dataAPIPrefix, "Problem loading config: ", err)
+		}
+		store.AllowedFieldFilters = config.FieldFilters
+	}
+
+	// The data source rules are replaced by the config, if set, so that new overlaps between data sources can be
+	// resolved without a release. See store/source_rules.json for the default rules.
+	if config.SourceRules != nil {
+		if err := config.SourceRules.Validate(); err != nil {
+			log.Fatal(dataAPIPrefix, "Problem loading config: ", err)
+		}
+		store.DataSourceRules = config.SourceRules
+	}
+	nightscout.SourceParameters = store.DataSourceRules.ParameterNames()
+
+	// The dedupe rules are replaced by the config, if set. See store/dedupe_rules.json for the default rules.
+	if config.DedupeRules != nil {
+		if err := config.DedupeRules.Validate(); err != nil {
+			log.Fatal(dataAPIPrefix, "Problem loading config: ", err)
+		}
+		store.DataDedupeRules = config.DedupeRules
+	}
+
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
@@ -211,7 +255,127 @@ func main() {
 		res.Write([]byte("OK\n"))
 	}))
 
-	f := httpgzip.NewHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+	// requestCanViewData returns whether the request is authenticated, with a session token or a restricted
+	// token, as a user that can view the data of userID
+	requestCanViewData := func(req *http.Request, userID string) bool {
+		var td *shoreline.TokenData
+		if sessionToken := req.Header.Get("x-tidepool-session-token"); sessionToken != "" {
+			td = shorelineClient.CheckToken(sessionToken)
+		} else if restrictedTokens, found := req.URL.Query()["restricted_token"]; found && len(restrictedTokens) == 1 {
+			restrictedToken, restrictedTokenErr := authClient.GetRestrictedToken(req.Context(), restrictedTokens[0])
+			if restrictedTokenErr == nil && restrictedToken != nil && restrictedToken.Authenticates(req) {
+				td = &shoreline.TokenData{UserID: restrictedToken.UserID}
+			}
+		}
+
+		return td != nil && (td.IsServer || td.UserID == userID || userCanViewData(td.UserID, userID))
+	}
+
+	// selectDataSources applies the data source rules to the user's data, to decide which of the user's
+	// overlapping data sources are returned, unless the query sets them
+	selectDataSources := func(storageWithCtx *store.MongoStoreClient, query url.Values, queryParams *store.Params, requestID string) error {
+		userID := queryParams.UserID
+		for _, rule := range store.DataSourceRules {
+			queryStart := time.Now()
+			if err := storageWithCtx.SelectSources(queryParams, rule, query); err != nil {
+				log.Printf("%s request %s user %s SelectSources %s returned error: %s", dataAPIPrefix, requestID, userID, rule.Name, err)
+				return err
+			}
+			if queryDuration := time.Since(queryStart).Seconds(); queryDuration > slowQueryDuration {
+				slowDataCheckCount.WithLabelValues(rule.Name, "source_rule").Inc()
+				log.Printf("%s request %s user %s SelectSources %s took %.3fs", dataAPIPrefix, requestID, userID, rule.Name, queryDuration)
+			}
+		}
+		return nil
+	}
+
+	// authorizeDataQuery parses the data query parameters and selects the data sources for a request that can
+	// view the user's data. It writes the error response and returns false if the request can't be served.
+	authorizeDataQuery := func(res http.ResponseWriter, req *http.Request, storageWithCtx *store.MongoStoreClient, query url.Values, start time.Time) (*store.Params, string, bool) {
+		queryParams, err := store.GetParams(query, &config.SchemaVersion)
+		if err != nil {
+			log.Println(dataAPIPrefix, fmt.Sprintf("Error parsing query params: %s", err))
+			jsonError(res, errorInvalidParameters, start)
+			return nil, "", false
+		}
+
+		if !requestCanViewData(req, queryParams.UserID) {
+			log.Printf("userid %v", queryParams.UserID)
+			jsonError(res, errorNoViewPermission, start)
+			return nil, "", false
+		}
+
+		requestID := NewRequestID()
+		if err := selectDataSources(storageWithCtx, query, queryParams, requestID); err != nil {
+			jsonError(res, errorRunningQuery, start)
+			return nil, "", false
+		}
+		return queryParams, requestID, true
+	}
+
+	// readDeviceData reads the device data matching the parameters, passing each datum to add. It returns the
+	// number of data read.
+	readDeviceData := func(req *http.Request, storageWithCtx *store.MongoStoreClient, queryParams *store.Params, requestID string, add func(map[string]interface{})) (int, error) {
+		iter, err := storageWithCtx.GetDeviceData(queryParams)
+		if err != nil {
+			mongoErrorCount.WithLabelValues(err.Error()).Inc()
+			log.Printf("%s request %s user %s Mongo Query returned error: %s", dataAPIPrefix, requestID, queryParams.UserID, err)
+			return 0, err
+		}
+
+		defer iter.Close(req.Context())
+
+		var readCount int
+		for iter.Next(req.Context()) {
+			var results map[string]interface{}
+			if err := iter.Decode(&results); err != nil {
+				mongoErrorCount.WithLabelValues("decode").Inc()
+				log.Printf("%s request %s user %s Mongo Decode returned error: %s", dataAPIPrefix, requestID, queryParams.UserID, err)
+				continue
+			}
+			add(results)
+			readCount++
+		}
+		if err := iter.Err(); err != nil {
+			mongoErrorCount.WithLabelValues(err.Error()).Inc()
+			log.Printf("%s request %s user %s Mongo Cursor returned error: %s", dataAPIPrefix, requestID, queryParams.UserID, err)
+			return readCount, err
+		}
+		return readCount, nil
+	}
+
+	// failOnIteratorError fails the request if the iterator stopped on an error rather than at the end of the
+	// data, and returns whether it did. The error response is written if no data was, in place of the headers
+	// set for the data, otherwise the response is aborted, so that the data written isn't taken as complete.
+	failOnIteratorError := func(res http.ResponseWriter, iter store.StorageIterator, requestID string, userID string, writeCount int, start time.Time) bool {
+		err := iter.Err()
+		if err == nil {
+			return false
+		}
+		mongoErrorCount.WithLabelValues(err.Error()).Inc()
+		log.Printf("%s request %s user %s Mongo Cursor returned error: %s", dataAPIPrefix, requestID, userID, err)
+		if writeCount == 0 {
+			for _, header := range []string{"Content-Type", "Content-Disposition", nextCursorHeader} {
+				res.Header().Del(header)
+			}
+			jsonError(res, errorRunningQuery, start)
+			return true
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	// writeJSON writes the value as the application/json response
+	writeJSON := func(res http.ResponseWriter, value interface{}) error {
+		bytes, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		res.Header().Add("Content-Type", "application/json")
+		_, err = res.Write(bytes)
+		return err
+	}
+
+	getData := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		start := time.Now()
 
 		storageWithCtx := storage.WithContext(req.Context())
@@ -224,101 +388,80 @@ func main() {
 			return
 		}
 
-		var td *shoreline.TokenData
-		if sessionToken := req.Header.Get("x-tidepool-session-token"); sessionToken != "" {
-			td = shorelineClient.CheckToken(sessionToken)
-		} else if restrictedTokens, found := req.URL.Query()["restricted_token"]; found && len(restrictedTokens) == 1 {
-			restrictedToken, restrictedTokenErr := authClient.GetRestrictedToken(req.Context(), restrictedTokens[0])
-			if restrictedTokenErr == nil && restrictedToken != nil && restrictedToken.Authenticates(req) {
-				td = &shoreline.TokenData{UserID: restrictedToken.UserID}
-			}
+		format, err := export.RequestedFormat(req)
+		if err != nil {
+			log.Println(dataAPIPrefix, fmt.Sprintf("Error parsing format: %s", err))
+			jsonError(res, errorInvalidParameters, start)
+			return
 		}
 
 		userID := queryParams.UserID
-		if td == nil || !(td.IsServer || td.UserID == userID || userCanViewData(td.UserID, userID)) {
+		if !requestCanViewData(req, userID) {
 			log.Printf("userid %v", userID)
 			jsonError(res, errorNoViewPermission, start)
 			return
 		}
 
 		requestID := NewRequestID()
-		queryStart := time.Now()
-		if _, ok := req.URL.Query()["carelink"]; !ok {
-			if hasMedtronicDirectData, medtronicErr := storageWithCtx.HasMedtronicDirectData(queryParams.UserID); medtronicErr != nil {
-				log.Printf("%s request %s user %s HasMedtronicDirectData returned error: %s", dataAPIPrefix, requestID, userID, medtronicErr)
-				jsonError(res, errorRunningQuery, start)
-				return
-			} else if !hasMedtronicDirectData {
-				queryParams.Carelink = true
-			}
-			if queryDuration := time.Since(queryStart).Seconds(); queryDuration > slowQueryDuration {
-				slowDataCheckCount.WithLabelValues("medtronic", "direct").Inc()
-				log.Printf("%s request %s user %s HasMedtronicDirectData took %.3fs", dataAPIPrefix, requestID, userID, queryDuration)
-			}
-			queryStart = time.Now()
+		if err := selectDataSources(storageWithCtx, req.URL.Query(), queryParams, requestID); err != nil {
+			jsonError(res, errorRunningQuery, start)
+			return
 		}
-		if queryParams.CBGFilter {
-			cbgCloudDataSources, cbgCloudErr := storageWithCtx.GetCBGCloudDataSources(queryParams.UserID)
-			if cbgCloudErr != nil {
-				log.Printf("%s request %s user %s GetCBGCloudDataSources returned error: %s", dataAPIPrefix, requestID, userID, cbgCloudErr)
-				jsonError(res, errorRunningQuery, start)
-				return
-			}
-			queryParams.CBGCloudDataSources = cbgCloudDataSources
 
-			if queryDuration := time.Since(queryStart).Seconds(); queryDuration > slowQueryDuration {
-				slowDataCheckCount.WithLabelValues("cbg", "cloud", "data_sources").Inc()
-				log.Printf("%s request %s user %s GetCBGCloudDataSources took %.3fs", dataAPIPrefix, requestID, userID, queryDuration)
-			}
-			queryStart = time.Now()
-		}
-		if _, ok := req.URL.Query()["medtronic"]; !ok {
-			hasMedtronicLoopData, medtronicErr := storageWithCtx.HasMedtronicLoopDataAfter(queryParams.UserID, medtronicLoopBoundaryDate)
-			if medtronicErr != nil {
-				log.Printf("%s request %s user %s HasMedtronicLoopDataAfter returned error: %s", dataAPIPrefix, requestID, userID, medtronicErr)
-				jsonError(res, errorRunningQuery, start)
-				return
-			}
-			if !hasMedtronicLoopData {
-				queryParams.Medtronic = true
-			}
-			if queryDuration := time.Since(queryStart).Seconds(); queryDuration > slowQueryDuration {
-				slowDataCheckCount.WithLabelValues("medtronic", "loop_data").Inc()
-				log.Printf("%s request %s user %s HasMedtronicLoopDataAfter took %.3fs", dataAPIPrefix, requestID, userID, queryDuration)
-			}
-			queryStart = time.Now()
-		}
-		if !queryParams.Medtronic {
-			medtronicUploadIds, medtronicErr := storageWithCtx.GetLoopableMedtronicDirectUploadIdsAfter(queryParams.UserID, medtronicLoopBoundaryDate)
-			if medtronicErr != nil {
-				log.Printf("%s request %s user %s GetLoopableMedtronicDirectUploadIdsAfter returned error: %s", dataAPIPrefix, requestID, userID, medtronicErr)
+		if queryParams.Explain == store.ExplainSelection {
+			selection, err := store.ExplainDataSelection(queryParams)
+			if err != nil {
+				log.Printf("%s request %s user %s ExplainDataSelection returned error: %s", dataAPIPrefix, requestID, userID, err)
 				jsonError(res, errorRunningQuery, start)
 				return
 			}
-			queryParams.MedtronicDate = medtronicLoopBoundaryDate
-			queryParams.MedtronicUploadIds = medtronicUploadIds
-
-			if queryDuration := time.Since(queryStart).Seconds(); queryDuration > slowQueryDuration {
-				slowDataCheckCount.WithLabelValues("medtronic", "loop_direct_upload_ids").Inc()
-				log.Printf("%s request %s user %s GetLoopableMedtronicDirectUploadIdsAfter took %.3fs", dataAPIPrefix, requestID, userID, queryDuration)
+			if err := writeJSON(res, selection); err != nil {
+				log.Printf("%s request %s user %s writeJSON returned error: %s", dataAPIPrefix, requestID, userID, err)
 			}
-			queryStart = time.Now()
+			log.Printf("%s request %s user %s explain selection took %.3fs", dataAPIPrefix, requestID, userID, time.Since(start).Seconds())
+			return
 		}
+		queryStart := time.Now()
 
 		iter, err := storageWithCtx.GetDeviceData(queryParams)
 		if err != nil {
 			mongoErrorCount.WithLabelValues(err.Error()).Inc()
 			log.Printf("%s request %s user %s Mongo Query returned error: %s", dataAPIPrefix, requestID, userID, err)
+			jsonError(res, errorRunningQuery, start)
+			return
 		}
 
 		defer iter.Close(req.Context())
 
-		var writeCount int
+		writerOptions := export.Options{
+			Types:      queryParams.Types,
+			UserID:     userID,
+			SelfURL:    requestURL(req, req.URL.Query()),
+			RangeIndex: len(queryParams.DateRanges) > 0,
+		}
 
-		res.Header().Add("Content-Type", "application/json")
+		if paged, ok := iter.(store.PagedStorageIterator); ok {
+			nextCursor, err := paged.NextCursor()
+			if err != nil {
+				log.Printf("%s request %s user %s NextCursor returned error: %s", dataAPIPrefix, requestID, userID, err)
+				jsonError(res, errorRunningQuery, start)
+				return
+			}
+			if nextCursor != "" {
+				res.Header().Add(nextCursorHeader, nextCursor)
+				nextQuery := req.URL.Query()
+				nextQuery.Set("cursor", nextCursor)
+				writerOptions.NextURL = requestURL(req, nextQuery)
+			}
+		}
 
-		res.Write([]byte("["))
+		writer := export.NewWriter(format, res, writerOptions)
+		res.Header().Add("Content-Type", writer.ContentType())
+		if disposition := export.ContentDisposition(format); disposition != "" {
+			res.Header().Set("Content-Disposition", disposition)
+		}
 
+		var writeCount int
 		for iter.Next(req.Context()) {
 			var results map[string]interface{}
 			err := iter.Decode(&results)
@@ -328,47 +471,479 @@ func main() {
 			}
 
 			if len(results) > 0 {
-				if bytes, err := json.Marshal(results); err != nil {
+				store.TagDateRange(queryParams, results)
+				if err := writer.WriteDatum(results); err != nil {
 					mongoErrorCount.WithLabelValues("marshal").Inc()
-					log.Printf("%s request %s user %s Marshal returned error: %s", dataAPIPrefix, requestID, userID, err)
+					log.Printf("%s request %s user %s WriteDatum returned error: %s", dataAPIPrefix, requestID, userID, err)
 				} else {
-					if writeCount > 0 {
-						res.Write([]byte(","))
-					}
-					res.Write([]byte("\n"))
-					res.Write(bytes)
 					writeCount++
 				}
 			}
 		}
+		if failOnIteratorError(res, iter, requestID, userID, writeCount, start) {
+			return
+		}
 
-		if writeCount > 0 {
-			res.Write([]byte("\n"))
+		if err := writer.Close(); err != nil {
+			log.Printf("%s request %s user %s Close returned error: %s", dataAPIPrefix, requestID, userID, err)
 		}
-		res.Write([]byte("]"))
 
 		if queryDuration := time.Since(queryStart).Seconds(); queryDuration > slowQueryDuration {
 			// XXX use metrics
 			//log.Printf("%s request %s user %s GetDeviceData took %.3fs", DATA_API_PREFIX, requestID, userID, queryDuration)
 		}
 		log.Printf("%s request %s user %s took %.3fs returned %d records", dataAPIPrefix, requestID, userID, time.Since(start).Seconds(), writeCount)
-	}))
+	})
+
+	// The gzip writer can't be flushed, so streamed formats are written uncompressed
+	gzipGetData := httpgzip.NewHandler(getData)
+	f := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if format, err := export.RequestedFormat(req); err == nil && export.IsStreaming(format) {
+			getData.ServeHTTP(res, req)
+		} else {
+			gzipGetData.ServeHTTP(res, req)
+		}
+	})
+
+	// getNightscout returns the handler of the read-only Nightscout API for the collection. Tools built
+	// for Nightscout use /data/{userID} as the base URL of the site.
+	getNightscout := func(collection string) http.Handler {
+		return httpgzip.NewHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+
+			storageWithCtx := storage.WithContext(req.Context())
+
+			userID := req.URL.Query().Get(":userID")
+			query, err := nightscout.Query(collection, userID, req.URL.Query())
+			if err != nil {
+				log.Println(dataAPIPrefix, fmt.Sprintf("Error parsing Nightscout query params: %s", err))
+				jsonError(res, errorInvalidParameters, start)
+				return
+			}
+
+			queryParams, requestID, ok := authorizeDataQuery(res, req, storageWithCtx, query, start)
+			if !ok {
+				return
+			}
+
+			iter, err := storageWithCtx.GetDeviceData(queryParams)
+			if err != nil {
+				mongoErrorCount.WithLabelValues(err.Error()).Inc()
+				log.Printf("%s request %s user %s Mongo Query returned error: %s", dataAPIPrefix, requestID, userID, err)
+				jsonError(res, errorRunningQuery, start)
+				return
+			}
+
+			defer iter.Close(req.Context())
+
+			writer := export.NewWriter(export.FormatJSON, res, export.Options{})
+			res.Header().Add("Content-Type", writer.ContentType())
+
+			var writeCount int
+			for iter.Next(req.Context()) {
+				var results map[string]interface{}
+				if err := iter.Decode(&results); err != nil {
+					mongoErrorCount.WithLabelValues("decode").Inc()
+					log.Printf("%s request %s user %s Mongo Decode returned error: %s", dataAPIPrefix, requestID, userID, err)
+					continue
+				}
+
+				if record, ok := nightscout.Record(collection, results); ok {
+					if err := writer.WriteDatum(record); err != nil {
+						mongoErrorCount.WithLabelValues("marshal").Inc()
+						log.Printf("%s request %s user %s WriteDatum returned error: %s", dataAPIPrefix, requestID, userID, err)
+					} else {
+						writeCount++
+					}
+				}
+			}
+			if failOnIteratorError(res, iter, requestID, userID, writeCount, start) {
+				return
+			}
+
+			if err := writer.Close(); err != nil {
+				log.Printf("%s request %s user %s Close returned error: %s", dataAPIPrefix, requestID, userID, err)
+			}
+
+			log.Printf("%s request %s user %s Nightscout %s took %.3fs returned %d records", dataAPIPrefix, requestID, userID, collection, time.Since(start).Seconds(), writeCount)
+		}))
+	}
+
+	// The /data/userId/facets endpoint returns the number of records of the user's data, and their earliest
+	// and latest `time`, by each of type, subType, deviceId, origin.name and dosingDecision.reason. It takes
+	// the same filtering parameters as /data/userId, and the same rules decide which data sources are counted. The counts
+	// include overlapping records, as the dedupe rules don't apply to them.
+	router.Add("GET", "/data/{userID}/facets", httpgzip.NewHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		storageWithCtx := storage.WithContext(req.Context())
+
+		queryParams, requestID, ok := authorizeDataQuery(res, req, storageWithCtx, req.URL.Query(), start)
+		if !ok {
+			return
+		}
+		userID := queryParams.UserID
+
+		facets, err := storageWithCtx.GetDataFacets(queryParams)
+		if err != nil {
+			mongoErrorCount.WithLabelValues(err.Error()).Inc()
+			log.Printf("%s request %s user %s GetDataFacets returned error: %s", dataAPIPrefix, requestID, userID, err)
+			jsonError(res, errorRunningQuery, start)
+			return
+		}
+
+		if err := writeJSON(res, facets); err != nil {
+			log.Printf("%s request %s user %s writeJSON returned error: %s", dataAPIPrefix, requestID, userID, err)
+		}
+		log.Printf("%s request %s user %s facets took %.3fs", dataAPIPrefix, requestID, userID, time.Since(start).Seconds())
+	})))
+
+	// The /data/userId/uploads endpoint returns the user's uploads (data sets), most recent first, with their device,
+	// client and state, and the number of records uploaded and their earliest and latest `time`.
+	// state (optional) : A comma separated list of the states of the uploads to return, `open` or `closed`
+	// deviceId (optional) : A comma separated list of the deviceIds of the uploads to return
+	// deleted (optional) : If true, deleted uploads are returned as well, with their deletedTime
+	// limit (optional) : Returns at most this many uploads, up to 1000. 100 if not set. If more uploads are available, the
+	//					x-tidepool-next-cursor response header holds the cursor to the next page
+	// cursor (optional) : The x-tidepool-next-cursor value of the previous page, to continue reading from that point
+	router.Add("GET", "/data/{userID}/uploads", httpgzip.NewHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		storageWithCtx := storage.WithContext(req.Context())
+
+		uploadParams, err := store.ParseUploadParams(req.URL.Query())
+		if err != nil {
+			log.Println(dataAPIPrefix, fmt.Sprintf("Error parsing upload params: %s", err))
+			jsonError(res, errorInvalidParameters, start)
+			return
+		}
+
+		userID := uploadParams.UserID
+		if !requestCanViewData(req, userID) {
+			log.Printf("userid %v", userID)
+			jsonError(res, errorNoViewPermission, start)
+			return
+		}
+
+		requestID := NewRequestID()
+		uploads, nextCursor, err := storageWithCtx.GetUploads(uploadParams)
+		if err != nil {
+			mongoErrorCount.WithLabelValues(err.Error()).Inc()
+			log.Printf("%s request %s user %s GetUploads returned error: %s", dataAPIPrefix, requestID, userID, err)
+			jsonError(res, errorRunningQuery, start)
+			return
+		}
+
+		if nextCursor != nil {
+			encoded, err := nextCursor.Encode()
+			if err != nil {
+				log.Printf("%s request %s user %s Encode returned error: %s", dataAPIPrefix, requestID, userID, err)
+				jsonError(res, errorRunningQuery, start)
+				return
+			}
+			res.Header().Add(nextCursorHeader, encoded)
+		}
+
+		if err := writeJSON(res, uploads); err != nil {
+			log.Printf("%s request %s user %s writeJSON returned error: %s", dataAPIPrefix, requestID, userID, err)
+		}
+		log.Printf("%s request %s user %s uploads took %.3fs returned %d uploads", dataAPIPrefix, requestID, userID, time.Since(start).Seconds(), len(uploads))
+	})))
+
+	// The /data/userId/devices endpoint returns the devices that contributed the user's data, most recently seen first, with
+	// the manufacturers, model and serial number of their most recent upload, the earliest and latest `time` and types of
+	// their data, and the cloud data sources that imported it. It takes the same filtering parameters as /data/userId, and
+	// the same rules decide which data sources are included e.g. /data/userId/devices?startDate=-30d for the devices used in
+	// the last 30 days. The dedupe rules don't apply to the types and times of the data.
+	router.Add("GET", "/data/{userID}/devices", httpgzip.NewHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		storageWithCtx := storage.WithContext(req.Context())
+
+		queryParams, requestID, ok := authorizeDataQuery(res, req, storageWithCtx, req.URL.Query(), start)
+		if !ok {
+			return
+		}
+		userID := queryParams.UserID
+
+		devices, err := storageWithCtx.GetDevices(queryParams)
+		if err != nil {
+			mongoErrorCount.WithLabelValues(err.Error()).Inc()
+			log.Printf("%s request %s user %s GetDevices returned error: %s", dataAPIPrefix, requestID, userID, err)
+			jsonError(res, errorRunningQuery, start)
+			return
+		}
+
+		if err := writeJSON(res, devices); err != nil {
+			log.Printf("%s request %s user %s writeJSON returned error: %s", dataAPIPrefix, requestID, userID, err)
+		}
+		log.Printf("%s request %s user %s devices took %.3fs returned %d devices", dataAPIPrefix, requestID, userID, time.Since(start).Seconds(), len(devices))
+	})))
+
+	// The /data/userId/summary endpoint returns the time in ranges, mean, standard deviation, coefficient of variation,
+	// LBGI and HBGI of the user's cbg and smbg data, and the glucose management indicator and wear of the cbg data. It
+	// takes the same filtering parameters as /data/userId, and the same rules decide which data sources are summarized,
+	// but overlapping readings aren't deduped. The ranges are set by the glucoseThresholds config, and default to the international consensus ranges.
+	// units (optional) : `mg/dL` (the default) or `mmol/L`, the units of the blood glucose values and thresholds returned
+	router.Add("GET", "/data/{userID}/summary", httpgzip.NewHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		storageWithCtx := storage.WithContext(req.Context())
+
+		units, err := store.ParseBloodGlucoseUnits(req.URL.Query().Get("units"))
+		if err != nil {
+			log.Println(dataAPIPrefix, fmt.Sprintf("Error parsing query params: %s", err))
+			jsonError(res, errorInvalidParameters, start)
+			return
+		}
+
+		queryParams, requestID, ok := authorizeDataQuery(res, req, storageWithCtx, req.URL.Query(), start)
+		if !ok {
+			return
+		}
+		userID := queryParams.UserID
+
+		summary, err := storageWithCtx.GetGlucoseSummary(queryParams, *config.GlucoseThresholds, units)
+		if err != nil {
+			mongoErrorCount.WithLabelValues(err.Error()).Inc()
+			log.Printf("%s request %s user %s GetGlucoseSummary returned error: %s", dataAPIPrefix, requestID, userID, err)
+			jsonError(res, errorRunningQuery, start)
+			return
+		}
+
+		if err := writeJSON(res, summary); err != nil {
+			log.Printf("%s request %s user %s writeJSON returned error: %s", dataAPIPrefix, requestID, userID, err)
+		}
+		log.Printf("%s request %s user %s summary took %.3fs", dataAPIPrefix, requestID, userID, time.Since(start).Seconds())
+	})))
+
+	// The /data/userId/agp endpoint returns the Ambulatory Glucose Profile of the user's cbg data: the 5th, 25th, 50th,
+	// 75th and 95th percentiles and number of readings in each time of day bin. It takes the same filtering parameters
+	// as /data/userId, and the same rules decide which data sources are included. The limit, cursor, latest, latestBy,
+	// sort, explain and format parameters are not valid, as the profile is of all of the data in the range.
+	// binMinutes (optional) : The length of the time of day bins in minutes, which must divide a day. Defaults to 15
+	// timezone (optional) : The IANA name of the timezone of the bins e.g. America/New_York . If not set, each reading
+	//					is placed by its own timezoneOffset
+	// units (optional) : `mg/dL` (the default) or `mmol/L`
+	router.Add("GET", "/data/{userID}/agp", httpgzip.NewHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		storageWithCtx := storage.WithContext(req.Context())
+
+		query := req.URL.Query()
+		if err := report.ValidateQuery(query); err != nil {
+			log.Println(dataAPIPrefix, fmt.Sprintf("Error parsing query params: %s", err))
+			jsonError(res, errorInvalidParameters, start)
+			return
+		}
+		units, err := store.ParseBloodGlucoseUnits(query.Get("units"))
+		if err != nil {
+			log.Println(dataAPIPrefix, fmt.Sprintf("Error parsing query params: %s", err))
+			jsonError(res, errorInvalidParameters, start)
+			return
+		}
+		location, err := store.ParseTimezone(query.Get("timezone"))
+		if err != nil {
+			log.Println(dataAPIPrefix, fmt.Sprintf("Error parsing query params: %s", err))
+			jsonError(res, errorInvalidParameters, start)
+			return
+		}
+		binMinutes := defaultAGPBinMinutes
+		if value := query.Get("binMinutes"); value != "" {
+			if binMinutes, err = strconv.Atoi(value); err != nil {
+				binMinutes = 0
+			}
+		}
+		agp, err := report.NewAGP(binMinutes, location)
+		if err != nil {
+			log.Println(dataAPIPrefix, fmt.Sprintf("Error parsing query params: %s", err))
+			jsonError(res, errorInvalidParameters, start)
+			return
+		}
+
+		query.Set("type", "cbg")
+		query.Set("fields", "value,units,timezoneOffset")
+		queryParams, requestID, ok := authorizeDataQuery(res, req, storageWithCtx, query, start)
+		if !ok {
+			return
+		}
+		userID := queryParams.UserID
+
+		readCount, err := readDeviceData(req, storageWithCtx, queryParams, requestID, agp.Add)
+		if err != nil {
+			jsonError(res, errorRunningQuery, start)
+			return
+		}
+
+		if err := writeJSON(res, agp.Result(units)); err != nil {
+			log.Printf("%s request %s user %s writeJSON returned error: %s", dataAPIPrefix, requestID, userID, err)
+		}
+		log.Printf("%s request %s user %s agp took %.3fs read %d records", dataAPIPrefix, requestID, userID, time.Since(start).Seconds(), readCount)
+	})))
+
+	// The /data/userId/daily endpoint returns the insulin and carbohydrate totals of each of the user's local days with
+	// data: basal (the rate integrated over the duration of each basal), bolus (normal and extended), insulin (not
+	// delivered by a pump), their total, the basal percentage, and carbs (wizard carbInput and food net carbohydrates).
+	// It takes the same filtering parameters as /data/userId, and the same rules decide which data sources are included.
+	// As for /data/userId/agp, the limit, cursor, latest, latestBy, sort, explain and format parameters are not valid.
+	// timezone (optional) : The IANA name of the timezone of the days e.g. America/New_York . If not set, each datum is
+	//					placed by its own timezoneOffset
+	router.Add("GET", "/data/{userID}/daily", httpgzip.NewHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		storageWithCtx := storage.WithContext(req.Context())
+
+		query := req.URL.Query()
+		if err := report.ValidateQuery(query); err != nil {
+			log.Println(dataAPIPrefix, fmt.Sprintf("Error parsing query params: %s", err))
+			jsonError(res, errorInvalidParameters, start)
+			return
+		}
+		location, err := store.ParseTimezone(query.Get("timezone"))
+		if err != nil {
+			log.Println(dataAPIPrefix, fmt.Sprintf("Error parsing query params: %s", err))
+			jsonError(res, errorInvalidParameters, start)
+			return
+		}
+
+		query.Set("type", strings.Join(report.DailyTotalsTypes, ","))
+		query.Set("fields", "timezoneOffset,rate,duration,normal,extended,dose,carbInput,nutrition")
+		queryParams, requestID, ok := authorizeDataQuery(res, req, storageWithCtx, query, start)
+		if !ok {
+			return
+		}
+		userID := queryParams.UserID
+
+		totals := report.NewDailyTotals(location)
+		readCount, err := readDeviceData(req, storageWithCtx, queryParams, requestID, totals.Add)
+		if err != nil {
+			jsonError(res, errorRunningQuery, start)
+			return
+		}
+
+		if err := writeJSON(res, totals.Result()); err != nil {
+			log.Printf("%s request %s user %s writeJSON returned error: %s", dataAPIPrefix, requestID, userID, err)
+		}
+		log.Printf("%s request %s user %s daily took %.3fs read %d records", dataAPIPrefix, requestID, userID, time.Since(start).Seconds(), readCount)
+	})))
+
+	// The /data/userId/buckets endpoint returns the user's data aggregated into time buckets, aligned to UTC, for each type.
+	// It takes the same filtering parameters as /data/userId, and the same rules decide which data sources are included,
+	// but the dedupe rules don't apply to the buckets.
+	// bucket : `15m`, `1h` or `1d`, the size of the buckets
+	// agg (optional) : `mean` (the default), `min`, `max` or `median` of the blood glucose values of cbg (the default
+	//					type) or smbg data, or `count` of data of any type
+	// units (optional) : `mg/dL` (the default) or `mmol/L`
+	router.Add("GET", "/data/{userID}/buckets", httpgzip.NewHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		storageWithCtx := storage.WithContext(req.Context())
+
+		bucketParams, err := store.ParseBucketParams(req.URL.Query())
+		if err != nil {
+			log.Println(dataAPIPrefix, fmt.Sprintf("Error parsing query params: %s", err))
+			jsonError(res, errorInvalidParameters, start)
+			return
+		}
+
+		queryParams, requestID, ok := authorizeDataQuery(res, req, storageWithCtx, req.URL.Query(), start)
+		if !ok {
+			return
+		}
+		userID := queryParams.UserID
+
+		buckets, err := storageWithCtx.GetDataBuckets(queryParams, bucketParams)
+		if err != nil {
+			mongoErrorCount.WithLabelValues(err.Error()).Inc()
+			log.Printf("%s request %s user %s GetDataBuckets returned error: %s", dataAPIPrefix, requestID, userID, err)
+			jsonError(res, errorRunningQuery, start)
+			return
+		}
+
+		if err := writeJSON(res, buckets); err != nil {
+			log.Printf("%s request %s user %s writeJSON returned error: %s", dataAPIPrefix, requestID, userID, err)
+		}
+		log.Printf("%s request %s user %s buckets took %.3fs returned %d buckets", dataAPIPrefix, requestID, userID, time.Since(start).Seconds(), len(buckets))
+	})))
+
+	// The Nightscout routes must be added before /data/{userID}, as routes match by prefix.
+	// Both /entries and /entries.json (and likewise for treatments) are matched.
+	// count (optional) : The number of records to return, most recent first. Defaults to 10
+	// find[date][$gte|$gt|$lte|$lt] (optional) : Only records at or after/before the time in epoch milliseconds
+	// find[dateString|created_at][$gte|$gt|$lte|$lt] (optional) : As find[date], with the time as an ISO date
+	// find[type] (optional, entries only) : `sgv` for cbg or `mbg` for smbg entries only
+	router.Add("GET", "/data/{userID}/api/v1/entries", getNightscout(nightscout.Entries))
+	router.Add("GET", "/data/{userID}/api/v1/treatments", getNightscout(nightscout.Treatments))
 
 	// The /data/userId endpoint retrieves device/health data for a user based on a set of parameters
 	// userid: the ID of the user you want to retrieve data for
 	// uploadId (optional) : Search for Tidepool data by uploadId. Only objects with a uploadId field matching the specified uploadId param will be returned.
-	// deviceId (optional) : Search for Tidepool data by deviceId. Only objects with a deviceId field matching the specified uploadId param will be returned.
+	//					May be a comma separated list e.g. /userid?uploadId=abc,def . Data from the uploads is returned regardless of the
+	//					data source rules that don't apply to explicit uploads (the cbgFilter and medtronic rules by default)
+	// excludeUploadId (optional) : A comma separated list of uploadIds whose objects are not returned
+	// deviceId (optional) : Search for Tidepool data by deviceId. Only objects with a deviceId field matching the specified deviceId param will be returned.
+	//					May be a comma separated list e.g. /userid?deviceId=abc,def
+	// excludeDeviceId (optional) : A comma separated list of deviceIds whose objects are not returned
 	// type (optional) : The Tidepool data type to search for. Only objects with a type field matching the specified type param will be returned.
 	//					can be /userid?type=smbg or a comma seperated list e.g /userid?type=smgb,cbg . If is a comma seperated
-	//					list, then objects matching any of the sub types will be returned
+	//					list, then objects matching any of the sub types will be returned. The type groups `glucose` (cbg, smbg) and
+	//					`insulinDelivery` (basal, bolus, insulin) may be used in place of their types
+	// excludeType (optional) : A comma separated list of types, or type groups, whose objects are not returned e.g.
+	//					/userid?excludeType=cbg,upload
 	// subType (optional) : The Tidepool data subtype to search for. Only objects with a subtype field matching the specified subtype param will be returned.
 	//					can be /userid?subtype=physicalactivity or a comma seperated list e.g /userid?subtypetype=physicalactivity,steps . If is a comma seperated
 	//					list, then objects matching any of the types will be returned
 	// startDate (optional) : Only objects with 'time' field equal to or greater than start date will be returned.
-	//					Must be in ISO date/time format e.g. 2015-10-10T15:00:00.000Z
+	//					Either in ISO date/time format e.g. 2015-10-10T15:00:00.000Z, `now` or relative to now in m, h, d or w e.g. -14d,
+	//					epoch milliseconds of 12 or more digits e.g. 1444489200000, or a date e.g. 2015-10-10 for the start of that day
 	// endDate (optional) : Only objects with 'time' field less than to or equal to start date will be returned.
-	//					Must be in ISO date/time format e.g. 2015-10-10T15:00:00.000Z
-	// latest (optional) : Returns only the most recent results for each `type` matching the results filtered by the other query parameters
+	//					In the same formats as startDate, where a date is the end of that day
+	// range (optional) : A `start/end` window of 'time', in the same formats as startDate and endDate, where either may be empty.
+	//					May be repeated, up to 10 times, to return objects within any of the windows e.g.
+	//					/userid?range=-14d/now&range=-28d/-14d . Each object has a `rangeIndex` field holding the index of the first
+	//					window that includes it
+	// timezone (optional) : The IANA timezone of date only startDate, endDate and range values e.g. America/Los_Angeles. UTC if not set
+	// timeOfDay (optional) : Only objects whose local time is within the HH:MM-HH:MM window are returned e.g. /userid?timeOfDay=00:00-06:00 .
+	//					The end is exclusive and may be 24:00, and a window ending before it starts wraps midnight e.g. 22:00-06:00.
+	//					Local time is the object's time shifted by its timezoneOffset, or UTC if it has none
+	// daysOfWeek (optional) : Only objects whose local time is on one of the comma separated days are returned e.g.
+	//					/userid?daysOfWeek=saturday,sunday or /userid?daysOfWeek=sat,sun
+	// <type>.<field>[<operator>] (optional) : Only objects of the type whose field matches the condition are returned e.g.
+	//					/userid?dosingDecision.reason=normalBolus,simpleBolus or /userid?cbg.value[gte]=3.9 . The operator is
+	//					one of eq, in (the default), nin, gte, lte or exists, and the value is a comma separated list for in and nin
+	//					and true or false for exists. Only the fields allowed by the fieldFilters config may be filtered on
+	// latest (optional) : Returns only the most recent results for each `type` matching the results filtered by the other query parameters.
+	//					Either `true`, for the most recent result, or the number of most recent results to return for each `type`, up to 100
+	// latestBy (optional) : `type` (the default), `deviceId` or `uploadId`, the field by which latest results are grouped e.g.
+	//					/userid?latest=true&latestBy=deviceId returns the most recent result from each device
+	// format (optional) : `json` (the default), `ndjson`, `csv` or `zip`. May also be requested with an `Accept` header of
+	//					application/x-ndjson, text/csv or application/zip.
+	//					ndjson writes each object on its own line as soon as it is read, without compression.
+	//					csv writes one row per object, with columns for all of the requested types (or all known types if `type` is not set).
+	//					zip writes a ZIP archive with one CSV file per type.
+	//					fhir (or `Accept: application/fhir+json`) writes a FHIR R4 searchset Bundle of cbg and smbg Observations and
+	//					bolus, insulin and basal MedicationAdministrations, linking to the next page when `limit` is set
+	// fields (optional) : A comma separated list of the fields to return e.g. /userid?fields=value,units . `time` and `type` are
+	//					always returned. Nested fields such as nutrition.carbohydrate.net may be requested. Not valid with the fhir format
+	// sort (optional) : Either `time` or `-time`. Returns results from all collections merged in ascending or descending `time` order.
+	//					If not set, results are returned in no particular order
+	// limit (optional) : Returns at most this many results, ordered by `sort` (ascending `time` if not set). If more results are available, the
+	//					x-tidepool-next-cursor response header holds the cursor to the next page
+	// cursor (optional) : The x-tidepool-next-cursor value of the previous page, to continue reading from that point.
+	//					Must be used with the same query parameters as the previous page
+	// carelink, cbgFilter, dexcom, medtronic (optional) : `true` or `false`, the parameters of the data source rules, which decide
+	//					whether each rule applies regardless of the user's data. The rules, and their parameters, are set by the
+	//					sourceRules config, or store/source_rules.json by default
+	// dedupe (optional) : `true` (the default) or `false`. Records of the types of the dedupeRules config (store/dedupe_rules.json
+	//					by default) within the rule's tolerance of a record of the same type from a different upload are dropped,
+	//					keeping the record of the source with the highest priority. Deduped results are read in `time` order, as for
+	//					`sort=time` if `sort` is not set. With `limit`, each page also reads the overlapping records that chain back
+	//					from the cursor, so that pages are deduped as the unpaged results are. The parameter also applies to the
+	//					agp and daily endpoints, but not to the latest results or to the Nightscout, facets, devices, summary, buckets
+	//					and uploads endpoints
+	// explain (optional) : `selection` returns, instead of the data, the data source selection rules considered for the user and
+	//					whether they fired, the uploadIds, types and time ranges they exclude and why, the final MongoDB filter,
+	//					and the dedupe rules of the data and the endpoints they apply to
 	router.Add("GET", "/data/{userID}", f)
 	router.Add("GET", "/{userID}", f)
 
@@ -406,6 +981,27 @@ func main() {
 	<-done
 }
 
+// requestURL returns the absolute URL of the request with its query replaced by query, excluding the
+// route parameters that pat adds to the query
+func requestURL(req *http.Request, query url.Values) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if forwardedProto := req.Header.Get("X-Forwarded-Proto"); forwardedProto != "" {
+		scheme = forwardedProto
+	}
+
+	for key := range query {
+		if strings.HasPrefix(key, ":") {
+			delete(query, key)
+		}
+	}
+
+	u := url.URL{Scheme: scheme, Host: req.Host, Path: req.URL.Path, RawQuery: query.Encode()}
+	return u.String()
+}
+
 // NewRequestID returns a new random hexadecimal ID
 func NewRequestID() string {
 	bytes := make([]byte, 8)